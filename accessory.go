@@ -1,6 +1,7 @@
 package hkdoorbell
 
 import (
+	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/service"
 	"github.com/brutella/hc/accessory"
 )
@@ -12,6 +13,12 @@ type Doorbell struct {
 	StreamManagement1 *service.CameraRTPStreamManagement
 	Speaker 	  *service.Speaker
 	Microphone	  *service.Microphone
+	// Messages are the switches which play the pre-recorded voice messages
+	Messages []*service.Switch
+	// ChimeMute is the switch which mutes the chime driven by a relay
+	ChimeMute *service.Switch
+	// Tampered is raised while the doorbell is tampered with
+	Tampered *characteristic.StatusTampered
 }
 
 // NewDoorbell returns a Video Doorbell accessory.
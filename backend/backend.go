@@ -2,41 +2,133 @@ package backend
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
 
 	"database/sql"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
 )
 
+// MessagePlayer plays the pre-recorded voice messages
+type MessagePlayer interface {
+	Names() []string
+	Play(name string) error
+}
+
 type Backend struct {
 	dbFile   string
 	inetAddr string
 	dbHandle *sql.DB
+	ff       ffmpeg.FFMPEG
+	messages MessagePlayer
+	server   *http.Server
+	// ctx is cancelled by Shutdown to end the live view requests
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the writes hold dbMutex for reading so that the database is closed after them
+	dbMutex sync.RWMutex
+	closed  bool
+	// snapshotDir contains the snapshots named after the sha256 of their content
+	snapshotDir string
+	// snapshotMutex keeps a file from being removed while a snapshot with the same content is inserted
+	snapshotMutex sync.Mutex
+	// user and password protect every endpoint; empty leaves the web service open
+	user     string
+	password string
+	// tlsCert and tlsKey serve the web service over HTTPS; empty serves HTTP
+	tlsCert string
+	tlsKey  string
+	// intercoms are the WebRTC sessions of the intercom page
+	intercomMutex sync.Mutex
+	intercoms     map[*intercomSession]bool
 }
 
-func InitBackend(dbFile string, inetAddr string) *Backend {
-	return &Backend{
-		dbFile:   dbFile,
-		inetAddr: inetAddr,
+// InitBackend opens the database so that events are recorded before the web service starts
+func InitBackend(dbFile string, inetAddr string, ff ffmpeg.FFMPEG) *Backend {
+	b := &Backend{
+		dbFile:      dbFile,
+		inetAddr:    inetAddr,
+		snapshotDir: filepath.Join(filepath.Dir(dbFile), "snapshots"),
+		ff:          ff,
+		server:      &http.Server{Addr: inetAddr},
+		intercoms:   make(map[*intercomSession]bool, 0),
 	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.openDB()
+
+	return b
 }
 
-func (b *Backend) createSchema() {
-	createSnapshotTableSQL := `
-CREATE TABLE doorbell_snapshot (
+// SetMessages enables the endpoints of the voice messages
+func (b *Backend) SetMessages(m MessagePlayer) {
+	b.messages = m
+}
+
+// SetAuth protects every endpoint with HTTP basic authentication;
+// the intercom is served only with authentication
+func (b *Backend) SetAuth(user, password string) {
+	b.user, b.password = user, password
+}
+
+// SetTLS serves the web service over HTTPS with the certificate and the key in the PEM files;
+// browsers give the microphone to the intercom page only over HTTPS
+func (b *Backend) SetTLS(certFile, keyFile string) {
+	b.tlsCert, b.tlsKey = certFile, keyFile
+}
+
+// authenticate passes the requests with the user and the password of SetAuth to h
+func (b *Backend) authenticate(h http.Handler) http.Handler {
+	if b.user == "" && b.password == "" {
+		return h
+	}
+
+	// the hashes are compared in constant time whatever the length of the credentials
+	user, password := sha256.Sum256([]byte(b.user)), sha256.Sum256([]byte(b.password))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		hu, hp := sha256.Sum256([]byte(u)), sha256.Sum256([]byte(p))
+		if !ok || subtle.ConstantTimeCompare(hu[:], user[:])&subtle.ConstantTimeCompare(hp[:], password[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hkdoorbell"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// the snapshots are files in snapshotDir; the table contains their metadata
+const createSnapshotTableSQL = `
+CREATE TABLE IF NOT EXISTS doorbell_snapshot (
 "id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
 "datetime" DATE DEFAULT (datetime('now')),
-"photo" BLOB NOT NULL
+"file" TEXT NOT NULL,
+"sha256" TEXT NOT NULL,
+"size" integer NOT NULL
 );`
 
+func (b *Backend) createSchema() {
 	log.Println("Creating doorbell_snapshot table")
 	s, err := b.dbHandle.Prepare(createSnapshotTableSQL)
 	if err != nil {
@@ -71,47 +163,441 @@ func (b *Backend) openDB() {
 
 	if newDB {
 		b.createSchema()
+	} else {
+		b.migrateSnapshots()
+	}
+
+	// tables added after the first release are created in existing databases too
+	b.createDayNightTable()
+	b.createSessionTable()
+	b.createRingTable()
+	b.createEventTable()
+}
+
+func (b *Backend) createDayNightTable() {
+	createDayNightTableSQL := `
+CREATE TABLE IF NOT EXISTS doorbell_daynight (
+"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"datetime" DATE DEFAULT (datetime('now')),
+"mode" TEXT NOT NULL,
+"brightness" REAL NOT NULL
+);`
+
+	s, err := b.dbHandle.Prepare(createDayNightTableSQL)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	s.Exec()
+}
+
+func (b *Backend) createSessionTable() {
+	createSessionTableSQL := `
+CREATE TABLE IF NOT EXISTS doorbell_session (
+"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"datetime" DATE DEFAULT (datetime('now')),
+"started" DATE NOT NULL,
+"duration" REAL NOT NULL,
+"video_packets" integer NOT NULL,
+"video_bytes" integer NOT NULL,
+"audio_packets" integer NOT NULL,
+"audio_bytes" integer NOT NULL,
+"bitrate" REAL NOT NULL,
+"frames" integer NOT NULL,
+"dropped_frames" integer NOT NULL,
+"framerate" REAL NOT NULL,
+"speed" REAL NOT NULL,
+"loss" REAL NOT NULL,
+"lost" integer NOT NULL,
+"jitter" REAL NOT NULL,
+"rtt" REAL NOT NULL
+);`
+
+	s, err := b.dbHandle.Prepare(createSessionTableSQL)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	s.Exec()
+}
+
+func (b *Backend) createRingTable() {
+	createRingTableSQL := `
+CREATE TABLE IF NOT EXISTS doorbell_ring (
+"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"datetime" DATE DEFAULT (datetime('now')),
+"source" TEXT NOT NULL,
+"suppressed" TEXT NOT NULL DEFAULT '',
+"prank" integer NOT NULL DEFAULT 0
+);`
+
+	s, err := b.dbHandle.Prepare(createRingTableSQL)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	s.Exec()
+
+	// rings recorded before the rate limiting have neither suppressed nor prank;
+	// adding an existing column fails and is ignored
+	for _, column := range []string{
+		`"suppressed" TEXT NOT NULL DEFAULT ''`,
+		`"prank" integer NOT NULL DEFAULT 0`,
+	} {
+		b.dbHandle.Exec("ALTER TABLE doorbell_ring ADD COLUMN " + column)
+	}
+}
+
+func (b *Backend) createEventTable() {
+	createEventTableSQL := `
+CREATE TABLE IF NOT EXISTS doorbell_event (
+"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"datetime" DATE DEFAULT (datetime('now')),
+"kind" TEXT NOT NULL,
+"priority" TEXT NOT NULL,
+"detail" TEXT NOT NULL,
+"recording" TEXT NOT NULL
+);`
+
+	s, err := b.dbHandle.Prepare(createEventTableSQL)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	s.Exec()
+}
+
+// migrateSnapshots moves the snapshots stored as BLOBs by the first releases
+// to files; it does nothing once the table contains only metadata
+func (b *Backend) migrateSnapshots() {
+	var blobs int
+	err := b.dbHandle.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('doorbell_snapshot') WHERE name = 'photo'`).Scan(&blobs)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if blobs == 0 {
+		return
+	}
+
+	log.Println("Moving the snapshots to " + b.snapshotDir)
+	tx, err := b.dbHandle.Begin()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	// the files are named after their content, so that a failed migration is repeated
+	// from the beginning at the next start
+	fail := func(err error) {
+		tx.Rollback()
+		log.Fatalln("Snapshot migration failed:", err.Error())
+	}
+
+	if _, err := tx.Exec(`ALTER TABLE doorbell_snapshot RENAME TO doorbell_snapshot_blob`); err != nil {
+		fail(err)
+	}
+	if _, err := tx.Exec(createSnapshotTableSQL); err != nil {
+		fail(err)
+	}
+
+	type snapshotFile struct {
+		id         int64
+		file, hash string
+		size       int
+	}
+	var files []snapshotFile
+	rows, err := tx.Query(`SELECT id, photo FROM doorbell_snapshot_blob ORDER BY id`)
+	if err != nil {
+		fail(err)
+	}
+	for rows.Next() {
+		var (
+			id    int64
+			photo []byte
+		)
+		if err := rows.Scan(&id, &photo); err != nil {
+			rows.Close()
+			fail(err)
+		}
+		file, hash, err := b.writeSnapshotFile(photo)
+		if err != nil {
+			rows.Close()
+			fail(err)
+		}
+		files = append(files, snapshotFile{id, file, hash, len(photo)})
+	}
+	if err := rows.Err(); err != nil {
+		fail(err)
+	}
+	rows.Close()
+
+	// the datetime is copied as it is stored
+	for _, f := range files {
+		_, err := tx.Exec(`
+INSERT INTO doorbell_snapshot(id, datetime, file, sha256, size)
+SELECT id, datetime, ?, ?, ? FROM doorbell_snapshot_blob WHERE id = ?`, f.file, f.hash, f.size, f.id)
+		if err != nil {
+			fail(err)
+		}
+	}
+	if _, err := tx.Exec(`DROP TABLE doorbell_snapshot_blob`); err != nil {
+		fail(err)
 	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalln("Snapshot migration failed:", err.Error())
+	}
+
+	// give the space of the BLOBs back to the file system
+	if _, err := b.dbHandle.Exec("VACUUM"); err != nil {
+		log.Println(err.Error())
+	}
+	log.Printf("Moved %d snapshots\n", len(files))
 }
 
+// writeSnapshotFile stores the jpeg in snapshotDir unless a snapshot with the same
+// content exists and returns the name of the file and its sha256
+func (b *Backend) writeSnapshotFile(jpg []byte) (string, string, error) {
+	sum := sha256.Sum256(jpg)
+	hash := hex.EncodeToString(sum[:])
+	file := hash + ".jpg"
+	path := filepath.Join(b.snapshotDir, file)
+
+	if _, err := os.Stat(path); err == nil {
+		return file, hash, nil
+	}
+	if err := os.MkdirAll(b.snapshotDir, 0755); err != nil {
+		return "", "", err
+	}
+
+	// the file is renamed once complete so that it is never served partially
+	tmp, err := ioutil.TempFile(b.snapshotDir, ".snapshot")
+	if err != nil {
+		return "", "", err
+	}
+	_, err = tmp.Write(jpg)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+
+	return file, hash, nil
+}
+
+// closeDB waits for the pending writes and closes the database;
+// later writes are dropped
 func (b *Backend) closeDB() {
+	b.dbMutex.Lock()
+	defer b.dbMutex.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	log.Println("Close database")
 	b.dbHandle.Close()
 }
 
+// beginWrite keeps the database open until endWrite;
+// it returns false if the database is closed
+func (b *Backend) beginWrite() bool {
+	b.dbMutex.RLock()
+	if b.closed {
+		b.dbMutex.RUnlock()
+		log.Println("Database is closed: write dropped")
+		return false
+	}
+
+	return true
+}
+
+func (b *Backend) endWrite() {
+	b.dbMutex.RUnlock()
+}
+
 func (b *Backend) InsertSnapshot(image *image.Image) {
+	if !b.beginWrite() {
+		return
+	}
+	defer b.endWrite()
+
 	// we permit at most N snapshot
 	maxSnapshot := 100
 
+	buf := new(bytes.Buffer)
+	err := jpeg.Encode(buf, *image, nil)
+	if err != nil {
+		fmt.Println("JPEG: failed to create buffer", err)
+		return
+	}
+
+	b.snapshotMutex.Lock()
+	defer b.snapshotMutex.Unlock()
+
+	// insert new snapshot
+	log.Println("Insert new snapshot")
+	file, hash, err := b.writeSnapshotFile(buf.Bytes())
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	_, err = b.dbHandle.Exec(`INSERT INTO doorbell_snapshot(file, sha256, size) VALUES (?, ?, ?)`, file, hash, buf.Len())
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
 	// delete snapshot over maxSnapshot
-	q := `
-DELETE from doorbell_snapshot WHERE id IN
-(SELECT id FROM doorbell_snapshot ORDER BY id DESC LIMIT -1 OFFSET ?)
-`
 	log.Println("Delete old snapshot")
+	b.deleteSnapshots(maxSnapshot)
+}
+
+// deleteSnapshots deletes the snapshots older than the newest keep ones
+// with their files unless a newer snapshot has the same content;
+// it must be called with snapshotMutex held
+func (b *Backend) deleteSnapshots(keep int) {
+	rows, err := b.dbHandle.Query(`SELECT id, file FROM doorbell_snapshot ORDER BY id DESC LIMIT -1 OFFSET ?`, keep)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	var (
+		ids   []int64
+		files []string
+	)
+	for rows.Next() {
+		var (
+			id   int64
+			file string
+		)
+		if err := rows.Scan(&id, &file); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		ids = append(ids, id)
+		files = append(files, file)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		if _, err := b.dbHandle.Exec(`DELETE FROM doorbell_snapshot WHERE id = ?`, id); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		var used int
+		if err := b.dbHandle.QueryRow(`SELECT COUNT(*) FROM doorbell_snapshot WHERE file = ?`, files[i]).Scan(&used); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if used == 0 {
+			if err := os.Remove(filepath.Join(b.snapshotDir, files[i])); err != nil && !os.IsNotExist(err) {
+				log.Println(err.Error())
+			}
+		}
+	}
+}
+
+// InsertDayNight records a switch between day and night mode
+func (b *Backend) InsertDayNight(night bool, brightness float64) {
+	if !b.beginWrite() {
+		return
+	}
+	defer b.endWrite()
+
+	mode := "day"
+	if night {
+		mode = "night"
+	}
+
+	q := `INSERT INTO doorbell_daynight(mode, brightness) VALUES (?, ?)`
+	log.Println("Insert day/night transition")
 	s, err := b.dbHandle.Prepare(q)
 	if err != nil {
 		log.Println(err.Error())
+		return
 	}
-	_, err = s.Exec(maxSnapshot)
+	_, err = s.Exec(mode, brightness)
 	if err != nil {
 		log.Println(err.Error())
 	}
+}
 
-	// insert new snapshot
-	q = `INSERT INTO doorbell_snapshot(photo) VALUES (?)`
-	log.Println("Insert new snapshot")
-	s, err = b.dbHandle.Prepare(q)
+// InsertRing records a press of the doorbell from source, e.g. gpio or mqtt;
+// suppressed is the reason why it did not ring, empty if it rang
+func (b *Backend) InsertRing(source string, suppressed string, prank bool) {
+	if !b.beginWrite() {
+		return
+	}
+	defer b.endWrite()
+
+	q := `INSERT INTO doorbell_ring(source, suppressed, prank) VALUES (?, ?, ?)`
+	if suppressed == "" {
+		log.Println("Insert ring from " + source)
+	} else {
+		log.Println("Insert suppressed (" + suppressed + ") ring from " + source)
+	}
+	s, err := b.dbHandle.Prepare(q)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	_, err = s.Exec(source, suppressed, prank)
 	if err != nil {
 		log.Println(err.Error())
 	}
+}
 
-	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, *image, nil)
+// InsertEvent records an event of kind with priority, e.g. a tamper with high priority;
+// recording is the file of its recording in the recordings directory, empty if there is none
+func (b *Backend) InsertEvent(kind string, priority string, detail string, recording string) {
+	if !b.beginWrite() {
+		return
+	}
+	defer b.endWrite()
+
+	q := `INSERT INTO doorbell_event(kind, priority, detail, recording) VALUES (?, ?, ?, ?)`
+	log.Println("Insert " + priority + " priority " + kind + " event: " + detail)
+	s, err := b.dbHandle.Prepare(q)
 	if err != nil {
-		fmt.Println("JPEG: failed to create buffer", err)
+		log.Println(err.Error())
+		return
+	}
+	_, err = s.Exec(kind, priority, detail, recording)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// InsertSession records the summary of an ended stream session;
+// durations are stored in seconds, jitter and round trip time in milliseconds
+func (b *Backend) InsertSession(st ffmpeg.SessionStats) {
+	if !b.beginWrite() {
 		return
 	}
-	_, err = s.Exec(buf.Bytes())
+	defer b.endWrite()
+
+	q := `INSERT INTO doorbell_session(started, duration, video_packets, video_bytes, audio_packets, audio_bytes,
+bitrate, frames, dropped_frames, framerate, speed, loss, lost, jitter, rtt)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	log.Println("Insert stream session")
+	s, err := b.dbHandle.Prepare(q)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	_, err = s.Exec(
+		st.Started.UTC().Format("2006-01-02 15:04:05"),
+		st.Duration.Seconds(),
+		int64(st.VideoPackets), int64(st.VideoBytes),
+		int64(st.AudioPackets), int64(st.AudioBytes),
+		st.Bitrate,
+		int64(st.Frames), int64(st.DroppedFrames),
+		st.Framerate, st.Speed,
+		st.Loss, st.Lost,
+		st.Jitter.Seconds()*1000, st.RoundTrip.Seconds()*1000)
 	if err != nil {
 		log.Println(err.Error())
 	}
@@ -177,18 +663,284 @@ func (b *Backend) getJSON(sqlString string) (string, error) {
 
 func (b *Backend) getSnapshots(w http.ResponseWriter, r *http.Request) {
 	log.Println("WebService: getSnapshots requested")
-	json, err := b.getJSON("SELECT * from doorbell_snapshot")
+	json, err := b.getJSON("SELECT *, '/snapshots/' || file AS url from doorbell_snapshot ORDER BY id DESC")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	fmt.Fprintf(w, json)
+}
+
+// names of the snapshot files: the SHA-256 of their content
+var snapshotFile = regexp.MustCompile(`^[0-9a-f]{64}\.jpg$`)
+
+// getSnapshot serves the file /snapshots/<file> of a stored snapshot
+func (b *Backend) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if !snapshotFile.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var stored int
+	if err := b.dbHandle.QueryRow(`SELECT COUNT(*) FROM doorbell_snapshot WHERE file = ?`, name).Scan(&stored); err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if stored == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, filepath.Join(b.snapshotDir, name))
+}
+
+func (b *Backend) getDayNight(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getDayNight requested")
+	json, err := b.getJSON("SELECT * from doorbell_daynight ORDER BY id DESC")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	fmt.Fprintf(w, json)
+}
+
+func (b *Backend) getRings(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getRings requested")
+	json, err := b.getJSON("SELECT * from doorbell_ring ORDER BY id DESC")
 	if err != nil {
 		log.Println(err.Error())
 	}
 	fmt.Fprintf(w, json)
 }
 
+func (b *Backend) getEvents(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getEvents requested")
+	json, err := b.getJSON("SELECT * from doorbell_event ORDER BY id DESC")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	fmt.Fprintf(w, json)
+}
+
+func (b *Backend) getSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getSessions requested")
+	json, err := b.getJSON("SELECT * from doorbell_session ORDER BY id DESC")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	fmt.Fprintf(w, json)
+}
+
+// getStats returns the live statistics of the running stream sessions
+func (b *Backend) getStats(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getStats requested")
+	st := b.ff.Stats()
+	if st == nil {
+		st = []ffmpeg.SessionStats{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// getMessages returns the names of the voice messages
+func (b *Backend) getMessages(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getMessages requested")
+	names := []string{}
+	if b.messages != nil {
+		names = b.messages.Names()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// playMessage plays the voice message ?name= to the visitor
+func (b *Backend) playMessage(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: playMessage requested")
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if b.messages == nil {
+		http.Error(w, "no messages", http.StatusNotFound)
+		return
+	}
+
+	switch err := b.messages.Play(r.FormValue("name")); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ffmpeg.ErrAudioBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// getStatus returns the health of the ffmpeg processes of the active streams
+func (b *Backend) getStatus(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getStatus requested")
+	st := b.ff.Status()
+	if st == nil {
+		st = []ffmpeg.StreamStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// getMaskPreview returns a frame with the outlines of the privacy masks
+func (b *Backend) getMaskPreview(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: getMaskPreview requested")
+	img, err := b.ff.MaskPreview()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if img == nil {
+		http.Error(w, "no frame available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	if err := jpeg.Encode(w, *img, nil); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// getLatest returns the latest frame of the camera; ?width= resizes it keeping the aspect ratio
+func (b *Backend) getLatest(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: latest.jpg requested")
+	width, _ := strconv.ParseUint(r.FormValue("width"), 10, 32)
+	img, err := b.ff.Snapshot(uint(width), 0)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if img == nil {
+		http.Error(w, "no frame available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := jpeg.Encode(w, *img, nil); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// how long the live view endpoints wait for a frame or for the HLS playlist
+const liveTimeout = 10 * time.Second
+
+// getMJPEG streams the live view as multipart jpeg until the client disconnects
+func (b *Backend) getMJPEG(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: live.mjpeg requested")
+	if err := b.ff.AddViewer(); err != nil {
+		log.Println(err.Error())
+		code := http.StatusServiceUnavailable
+		if err == ffmpeg.ErrTooManyViewers {
+			code = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	defer b.ff.RemoveViewer()
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var seq uint64
+	for {
+		frame, next, err := b.ff.LiveFrame(seq, liveTimeout)
+		if err != nil {
+			// the camera moves between live view and HomeKit streams
+			log.Println(err.Error())
+			select {
+			case <-r.Context().Done():
+				return
+			case <-b.ctx.Done():
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		seq = next
+
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {"image/jpeg"},
+			"Content-Length": {strconv.Itoa(len(frame))},
+		})
+		if err != nil {
+			return
+		}
+		if _, err := part.Write(frame); err != nil {
+			// the client is gone
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		if b.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// names of the files of the HLS live view
+var hlsFile = regexp.MustCompile(`^live[0-9]*\.ts$`)
+
+// getHLS serves the HLS playlist /hls/live.m3u8 of the live view and its segments
+func (b *Backend) getHLS(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name != ffmpeg.HLSPlaylist && !hlsFile.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// every request keeps the live view running
+	dir, err := b.ff.WatchHLS()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	file := filepath.Join(dir, name)
+
+	if name == ffmpeg.HLSPlaylist {
+		log.Println("WebService: HLS playlist requested")
+		// the playlist is written after the first segment
+		deadline := time.Now().Add(liveTimeout)
+		for {
+			if _, err := os.Stat(file); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				http.Error(w, "live view is starting", http.StatusServiceUnavailable)
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+
+	http.ServeFile(w, r, file)
+}
+
 func (b *Backend) getHome(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("WebService: getHome requested")
 
-	stmt, err := b.dbHandle.Prepare("SELECT datetime, photo FROM doorbell_snapshot ORDER BY id DESC")
+	stmt, err := b.dbHandle.Prepare("SELECT datetime, file FROM doorbell_snapshot ORDER BY id DESC")
 	if err != nil {
 		fmt.Fprintf(w, err.Error())
 	}
@@ -223,15 +975,15 @@ th, td {
 	for rows.Next() {
 		var (
 			datetime string
-			photo    []byte
+			file     string
 		)
-		if err := rows.Scan(&datetime, &photo); err != nil {
+		if err := rows.Scan(&datetime, &file); err != nil {
 			log.Fatal(err)
 		}
 		homepage += fmt.Sprintf(
-			"<tr><td><script type='text/javascript'>document.write(new Date('%s'))</script></td><td><img src='data:image/jpeg;base64,%s' alt=snapshot width=300 /></td></tr>",
+			"<tr><td><script type='text/javascript'>document.write(new Date('%s'))</script></td><td><img src='/snapshots/%s' alt=snapshot width=300 loading=lazy /></td></tr>",
 			datetime,
-			base64.StdEncoding.EncodeToString(photo))
+			file)
 	}
 
 	homepage += `
@@ -243,17 +995,52 @@ th, td {
 	fmt.Fprintf(w, homepage)
 }
 
-func (b *Backend) StartWebService() {
-
-	b.openDB()
+// Handle serves handler at pattern, e.g. the HTTP trigger at /ring;
+// the handler may be added while the web service runs
+func (b *Backend) Handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, handler)
+}
 
+func (b *Backend) StartWebService() {
 	http.HandleFunc("/", b.getHome)
 	http.HandleFunc("/getSnapshots", b.getSnapshots)
+	http.HandleFunc("/snapshots/", b.getSnapshot)
+	http.HandleFunc("/getStatus", b.getStatus)
+	http.HandleFunc("/getMaskPreview", b.getMaskPreview)
+	http.HandleFunc("/getDayNight", b.getDayNight)
+	http.HandleFunc("/getStats", b.getStats)
+	http.HandleFunc("/getSessions", b.getSessions)
+	http.HandleFunc("/getRings", b.getRings)
+	http.HandleFunc("/getEvents", b.getEvents)
+	http.HandleFunc("/getMessages", b.getMessages)
+	http.HandleFunc("/playMessage", b.playMessage)
+	http.HandleFunc("/latest.jpg", b.getLatest)
+	http.HandleFunc("/live.mjpeg", b.getMJPEG)
+	http.HandleFunc("/hls/", b.getHLS)
+	http.HandleFunc("/intercom", b.getIntercom)
+	http.HandleFunc("/intercom/offer", b.postIntercomOffer)
+
+	b.server.Handler = b.authenticate(http.DefaultServeMux)
 
 	log.Println("Backend is listening at " + b.inetAddr)
-	log.Fatalln(http.ListenAndServe(b.inetAddr, nil))
+	var err error
+	if b.tlsCert != "" || b.tlsKey != "" {
+		err = b.server.ListenAndServeTLS(b.tlsCert, b.tlsKey)
+	} else {
+		err = b.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
 }
 
-func (b *Backend) StopWebService() {
+// Shutdown stops the web service after the running requests
+// and closes the database after the pending writes
+func (b *Backend) Shutdown(ctx context.Context) error {
+	b.cancel()
+	b.closeIntercoms()
+	err := b.server.Shutdown(ctx)
 	b.closeDB()
+
+	return err
 }
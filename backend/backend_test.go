@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func snapshotFiles(t *testing.T, b *Backend) map[string]bool {
+	t.Helper()
+	infos, err := ioutil.ReadDir(b.snapshotDir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	files := make(map[string]bool)
+	for _, i := range infos {
+		files[i.Name()] = true
+	}
+
+	return files
+}
+
+func TestMigrateSnapshots(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "history.sqlite")
+
+	// the schema and the rows of the first releases
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE doorbell_snapshot (
+"id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"datetime" DATE DEFAULT (datetime('now')),
+"photo" BLOB NOT NULL
+)`,
+		`INSERT INTO doorbell_snapshot(datetime, photo) VALUES ('2020-05-01 12:00:00', x'FFD801')`,
+		`INSERT INTO doorbell_snapshot(datetime, photo) VALUES ('2020-05-01 12:01:00', x'FFD802')`,
+		`INSERT INTO doorbell_snapshot(datetime, photo) VALUES ('2020-05-01 12:02:00', x'FFD801')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	b := InitBackend(dbFile, "", nil)
+	defer b.Shutdown(context.Background())
+
+	rows, err := b.dbHandle.Query(`SELECT id, strftime('%H:%M', datetime), file, sha256, size FROM doorbell_snapshot ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	type snapshot struct {
+		id         int
+		at         string
+		file, hash string
+		size       int
+	}
+	first := "df2fec7a8910ce9bb0c3ab7e3de0ad9c5d3a69297128440e2a3a9a17c61a144f"
+	second := "ca74648e757abed219398fc7b0cb96f11b2bdc751d494cf53de5155a160c8c80"
+	want := []snapshot{
+		{1, "12:00", first + ".jpg", first, 3},
+		{2, "12:01", second + ".jpg", second, 3},
+		{3, "12:02", first + ".jpg", first, 3},
+	}
+	var is []snapshot
+	for rows.Next() {
+		var s snapshot
+		if err := rows.Scan(&s.id, &s.at, &s.file, &s.hash, &s.size); err != nil {
+			t.Fatal(err)
+		}
+		is = append(is, s)
+	}
+	if len(is) != len(want) {
+		t.Fatalf("snapshots is=%v want=%v", is, want)
+	}
+	for i := range want {
+		if is[i] != want[i] {
+			t.Fatalf("snapshot %d is=%v want=%v", i, is[i], want[i])
+		}
+	}
+
+	files := snapshotFiles(t, b)
+	if len(files) != 2 || !files[first+".jpg"] || !files[second+".jpg"] {
+		t.Fatalf("files is=%v", files)
+	}
+	if jpg, err := ioutil.ReadFile(filepath.Join(b.snapshotDir, second+".jpg")); err != nil || string(jpg) != "\xff\xd8\x02" {
+		t.Fatalf("file is=%q err=%v", jpg, err)
+	}
+
+	// the migration is done once
+	b.migrateSnapshots()
+	var blobTables int
+	if err := b.dbHandle.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'doorbell_snapshot_blob'`).Scan(&blobTables); err != nil || blobTables != 0 {
+		t.Fatalf("blob table left: %d %v", blobTables, err)
+	}
+}
+
+func TestInsertSnapshot(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", nil)
+	defer b.Shutdown(context.Background())
+
+	images := make([]image.Image, 3)
+	for i := range images {
+		img := image.NewGray(image.Rect(0, 0, 8, 8))
+		img.Set(0, 0, color.Gray{Y: uint8(i * 100)})
+		images[i] = img
+	}
+	// the first content is inserted twice and stored once
+	for _, i := range []int{0, 1, 0, 2} {
+		b.InsertSnapshot(&images[i])
+	}
+	if files := snapshotFiles(t, b); len(files) != 3 {
+		t.Fatalf("files is=%v", files)
+	}
+
+	// the file of the first content is still used by the third snapshot
+	b.snapshotMutex.Lock()
+	b.deleteSnapshots(2)
+	b.snapshotMutex.Unlock()
+	if files := snapshotFiles(t, b); len(files) != 2 {
+		t.Fatalf("files after deleting 2 snapshots is=%v", files)
+	}
+
+	var n int
+	if err := b.dbHandle.QueryRow(`SELECT COUNT(*) FROM doorbell_snapshot`).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("snapshots is=%d err=%v", n, err)
+	}
+}
+
+func TestGetSnapshot(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", nil)
+	defer b.Shutdown(context.Background())
+
+	var img image.Image = image.NewGray(image.Rect(0, 0, 8, 8))
+	b.InsertSnapshot(&img)
+	var file string
+	if err := b.dbHandle.QueryRow(`SELECT file FROM doorbell_snapshot`).Scan(&file); err != nil {
+		t.Fatal(err)
+	}
+	// a temporary file of writeSnapshotFile and a file which is not stored
+	for _, name := range []string{".snapshot123", strings.Repeat("0", 64) + ".jpg"} {
+		if err := ioutil.WriteFile(filepath.Join(b.snapshotDir, name), []byte("\xff\xd8"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/snapshots/" + file, http.StatusOK},
+		{"/snapshots/", http.StatusNotFound},
+		{"/snapshots/.snapshot123", http.StatusNotFound},
+		{"/snapshots/" + strings.Repeat("0", 64) + ".jpg", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		b.getSnapshot(w, httptest.NewRequest(http.MethodGet, c.path, nil))
+		if w.Code != c.status {
+			t.Fatalf("%s: status is=%d want=%d", c.path, w.Code, c.status)
+		}
+	}
+}
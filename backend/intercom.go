@@ -0,0 +1,431 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+var (
+	// a viewer which does not connect within intercomConnectTimeout is removed
+	intercomConnectTimeout = 30 * time.Second
+	// the answer waits at most intercomGatherTimeout for the local ICE candidates
+	intercomGatherTimeout = 5 * time.Second
+)
+
+// format parameters of the H.264 of the live view which every browser decodes
+const intercomH264Fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"
+
+// intercomSession is the WebRTC connection of a viewer of the intercom page.
+// It counts as viewer of the live view until it is closed.
+type intercomSession struct {
+	pc *webrtc.PeerConnection
+	// stopVideo ends the live view packets of the session
+	stopVideo func()
+	// audio is the two-way audio; nil while a stream or another viewer holds it
+	audio     io.WriteCloser
+	closeOnce sync.Once
+}
+
+// intercomAnswer is the answer to the offer of the intercom page.
+type intercomAnswer struct {
+	webrtc.SessionDescription
+	// Audio is false if the viewer only watches since the audio is busy
+	Audio bool `json:"audio"`
+}
+
+// intercomAllowed returns true if the intercom may be served; anyone who reaches
+// it talks to the visitor, therefore it needs the authentication of SetAuth.
+func (b *Backend) intercomAllowed(w http.ResponseWriter) bool {
+	if b.user == "" || b.password == "" {
+		http.Error(w, "the intercom needs the authentication of the backend", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// getIntercom serves the page which answers the door from the browser
+func (b *Backend) getIntercom(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: intercom requested")
+	if !b.intercomAllowed(w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, intercomPage)
+}
+
+// postIntercomOffer answers the WebRTC offer of the intercom page with the live view
+// and, if the audio is free, the two-way audio
+func (b *Backend) postIntercomOffer(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebService: intercom offer")
+	if !b.intercomAllowed(w) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	answer, err := b.startIntercom(offer)
+	switch {
+	case err == ffmpeg.ErrTooManyViewers:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
+
+// startIntercom adds a viewer and returns the answer to its offer
+func (b *Backend) startIntercom(offer webrtc.SessionDescription) (*intercomAnswer, error) {
+	if b.ctx.Err() != nil {
+		return nil, errors.New("backend is shut down")
+	}
+	if err := b.ff.AddViewer(); err != nil {
+		return nil, err
+	}
+
+	s := &intercomSession{}
+	api, err := newIntercomAPI()
+	if err != nil {
+		b.ff.RemoveViewer()
+		return nil, err
+	}
+	if s.pc, err = api.NewPeerConnection(webrtc.Configuration{}); err != nil {
+		b.ff.RemoveViewer()
+		return nil, err
+	}
+	fail := func(err error) (*intercomAnswer, error) {
+		b.closeIntercom(s)
+		return nil, err
+	}
+
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: intercomH264Fmtp,
+	}, "video", "hkdoorbell")
+	if err != nil {
+		return fail(err)
+	}
+	if err := addTrack(s.pc, video); err != nil {
+		return fail(err)
+	}
+
+	microphone, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: 48000,
+		Channels:  2,
+	}, "audio", "hkdoorbell")
+	if err != nil {
+		return fail(err)
+	}
+	audio, err := b.ff.StartIntercom(func(pkt []byte) {
+		microphone.Write(pkt)
+	})
+	if err != nil {
+		// the viewer watches without audio
+		log.Println("intercom: audio:", err)
+	} else {
+		s.audio = audio
+		if err := addTrack(s.pc, microphone); err != nil {
+			return fail(err)
+		}
+		s.pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			if track.Kind() != webrtc.RTPCodecTypeAudio {
+				return
+			}
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := track.Read(buf)
+				if err != nil {
+					return
+				}
+				audio.Write(buf[:n])
+			}
+		})
+	}
+
+	rewriter := &rtpRewriter{clockRate: 90000}
+	s.stopVideo, err = b.ff.WatchLiveVideo(func(pkt []byte) {
+		var p rtp.Packet
+		if err := p.Unmarshal(pkt); err != nil {
+			return
+		}
+		rewriter.rewrite(&p, time.Now())
+		video.WriteRTP(&p)
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	s.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Println("intercom:", state)
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			// the session is not closed from within the callbacks of its connection
+			go b.closeIntercom(s)
+		}
+	})
+
+	if err := s.pc.SetRemoteDescription(offer); err != nil {
+		return fail(err)
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(err)
+	}
+	// the answer contains every candidate; the page does not trickle them
+	gathered := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return fail(err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(intercomGatherTimeout):
+	}
+
+	b.intercomMutex.Lock()
+	if b.ctx.Err() != nil {
+		b.intercomMutex.Unlock()
+		return fail(errors.New("backend is shut down"))
+	}
+	b.intercoms[s] = true
+	b.intercomMutex.Unlock()
+
+	time.AfterFunc(intercomConnectTimeout, func() {
+		if s.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			b.closeIntercom(s)
+		}
+	})
+
+	return &intercomAnswer{SessionDescription: *s.pc.LocalDescription(), Audio: s.audio != nil}, nil
+}
+
+// closeIntercom ends the session and removes its viewer; it may be called more than once
+func (b *Backend) closeIntercom(s *intercomSession) {
+	s.closeOnce.Do(func() {
+		b.intercomMutex.Lock()
+		delete(b.intercoms, s)
+		b.intercomMutex.Unlock()
+
+		if s.stopVideo != nil {
+			s.stopVideo()
+		}
+		if s.audio != nil {
+			s.audio.Close()
+		}
+		s.pc.Close()
+		b.ff.RemoveViewer()
+	})
+}
+
+// closeIntercoms ends every session of the intercom
+func (b *Backend) closeIntercoms() {
+	b.intercomMutex.Lock()
+	sessions := make([]*intercomSession, 0, len(b.intercoms))
+	for s := range b.intercoms {
+		sessions = append(sessions, s)
+	}
+	b.intercomMutex.Unlock()
+
+	for _, s := range sessions {
+		b.closeIntercom(s)
+	}
+}
+
+// newIntercomAPI returns the WebRTC API with the default codecs, NACK and RTCP reports
+func newIntercomAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i)), nil
+}
+
+// addTrack adds track to pc and reads the RTCP packets of its sender, which the interceptors need
+func addTrack(pc *webrtc.PeerConnection, track webrtc.TrackLocal) error {
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// rtpRewriter keeps the sequence numbers and the timestamps of the video of a viewer
+// continuous when the live view restarts with a new SSRC, e.g. after a HomeKit stream
+type rtpRewriter struct {
+	clockRate float64
+	started   bool
+	ssrc      uint32
+	seqOffset uint16
+	tsOffset  uint32
+	// the last rewritten packet was sent at lastAt
+	lastSeq uint16
+	lastTS  uint32
+	lastAt  time.Time
+}
+
+// rewrite rewrites the packet p received at now
+func (r *rtpRewriter) rewrite(p *rtp.Packet, now time.Time) {
+	if r.started && p.SSRC != r.ssrc {
+		// the new source continues after the last packet and the time in between
+		r.seqOffset = r.lastSeq + 1 - p.SequenceNumber
+		r.tsOffset = r.lastTS + uint32(now.Sub(r.lastAt).Seconds()*r.clockRate) - p.Timestamp
+	}
+	r.started, r.ssrc = true, p.SSRC
+
+	p.SequenceNumber += r.seqOffset
+	p.Timestamp += r.tsOffset
+	r.lastSeq, r.lastTS, r.lastAt = p.SequenceNumber, p.Timestamp, now
+}
+
+const intercomPage = `<html>
+<head>
+<title>Intercom</title>
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<style>
+body { font-family: sans-serif; text-align: center; }
+video { width: 100%; max-width: 960px; background: black; }
+button { font-size: 1.2em; padding: 10px 20px; margin: 10px; }
+</style>
+</head>
+<body>
+<video id="video" autoplay playsinline></video>
+<div>
+<button id="answer" onclick="answer()">Answer</button>
+<button id="hangup" onclick="hangup()" disabled>Hang up</button>
+</div>
+<p id="status"></p>
+<script type="text/javascript">
+var pc = null;
+function status(text) {
+  document.getElementById("status").textContent = text;
+}
+function buttons(answering) {
+  document.getElementById("answer").disabled = answering;
+  document.getElementById("hangup").disabled = !answering;
+}
+function microphone() {
+  // browsers give the microphone only to pages served over HTTPS
+  if (!navigator.mediaDevices || !navigator.mediaDevices.getUserMedia) {
+    return Promise.resolve(null);
+  }
+  return navigator.mediaDevices.getUserMedia({audio: true}).catch(function() { return null; });
+}
+function gathered() {
+  return new Promise(function(resolve) {
+    if (pc.iceGatheringState == "complete") {
+      return resolve();
+    }
+    pc.addEventListener("icegatheringstatechange", function() {
+      if (pc.iceGatheringState == "complete") {
+        resolve();
+      }
+    });
+  });
+}
+function answer() {
+  buttons(true);
+  status("connecting");
+  var talking = false;
+  microphone().then(function(mic) {
+    pc = new RTCPeerConnection();
+    pc.ontrack = function(e) {
+      var video = document.getElementById("video");
+      if (!video.srcObject) {
+        video.srcObject = e.streams[0];
+      }
+    };
+    pc.onconnectionstatechange = function() {
+      if (pc.connectionState == "failed") {
+        status("connection lost");
+        hangup();
+      }
+    };
+    pc.addTransceiver("video", {direction: "recvonly"});
+    if (mic) {
+      talking = true;
+      pc.addTransceiver(mic.getAudioTracks()[0], {direction: "sendrecv", streams: [mic]});
+    } else {
+      pc.addTransceiver("audio", {direction: "recvonly"});
+    }
+    return pc.createOffer();
+  }).then(function(offer) {
+    return pc.setLocalDescription(offer);
+  }).then(gathered).then(function() {
+    return fetch("/intercom/offer", {method: "POST", body: JSON.stringify(pc.localDescription)});
+  }).then(function(r) {
+    if (!r.ok) {
+      return r.text().then(function(text) { throw new Error(text); });
+    }
+    return r.json();
+  }).then(function(answer) {
+    if (!answer.audio) {
+      status("watching; the audio is busy");
+    } else if (!talking) {
+      status("listening; talking needs HTTPS and the microphone");
+    } else {
+      status("talking");
+    }
+    return pc.setRemoteDescription({type: answer.type, sdp: answer.sdp});
+  }).catch(function(err) {
+    status(err.message);
+    hangup();
+  });
+}
+function hangup() {
+  if (pc) {
+    pc.getSenders().forEach(function(s) {
+      if (s.track) {
+        s.track.stop();
+      }
+    });
+    pc.close();
+    pc = null;
+  }
+  document.getElementById("video").srcObject = null;
+  buttons(false);
+}
+window.addEventListener("beforeunload", hangup);
+</script>
+</body>
+</html>
+`
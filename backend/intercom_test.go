@@ -0,0 +1,229 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+func TestAuthenticate(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", nil)
+	defer b.Shutdown(context.Background())
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	b.authenticate(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("without authentication: status is=%d", w.Code)
+	}
+
+	b.SetAuth("door", "secret")
+	for _, c := range []struct {
+		user, password string
+		status         int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"door", "wrong", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+		{"door", "secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		w := httptest.NewRecorder()
+		b.authenticate(ok).ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s:%s: status is=%d want=%d", c.user, c.password, w.Code, c.status)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.Contains(w.Header().Get("WWW-Authenticate"), "Basic") {
+			t.Fatalf("WWW-Authenticate is=%q", w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestIntercomNeedsAuth(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	ff := ffmpeg.NewFake()
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", ff)
+	defer b.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	b.getIntercom(w, httptest.NewRequest(http.MethodGet, "/intercom", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("page: status is=%d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	b.postIntercomOffer(w, httptest.NewRequest(http.MethodPost, "/intercom/offer", strings.NewReader("{}")))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("offer: status is=%d", w.Code)
+	}
+	if len(ff.Calls()) != 0 {
+		t.Fatalf("calls is=%v", ff.Methods())
+	}
+}
+
+// testOffer returns the offer of a browser which receives the video and talks
+func testOffer(t *testing.T) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	body, err := json.Marshal(pc.LocalDescription())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pc, string(body)
+}
+
+func TestIntercomOffer(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	ff := ffmpeg.NewFake()
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", ff)
+	b.SetAuth("door", "secret")
+
+	pc, offer := testOffer(t)
+	defer pc.Close()
+
+	w := httptest.NewRecorder()
+	b.postIntercomOffer(w, httptest.NewRequest(http.MethodPost, "/intercom/offer", strings.NewReader(offer)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status is=%d body=%s", w.Code, w.Body)
+	}
+	var answer intercomAnswer
+	if err := json.NewDecoder(w.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Type != webrtc.SDPTypeAnswer || !answer.Audio {
+		t.Fatalf("answer is=%v audio=%v", answer.Type, answer.Audio)
+	}
+	for _, s := range []string{"m=video", "H264", "m=audio", "opus"} {
+		if !strings.Contains(answer.SDP, s) {
+			t.Fatalf("answer has no %s:\n%s", s, answer.SDP)
+		}
+	}
+	if ff.Viewers != 1 {
+		t.Fatalf("viewers is=%d", ff.Viewers)
+	}
+
+	b.Shutdown(context.Background())
+
+	want := []string{"AddViewer", "StartIntercom", "WatchLiveVideo", "CloseIntercom", "RemoveViewer"}
+	if is := ff.Methods(); strings.Join(is, ",") != strings.Join(want, ",") {
+		t.Fatalf("calls is=%v want=%v", is, want)
+	}
+	if ff.Viewers != 0 {
+		t.Fatalf("viewers after shutdown is=%d", ff.Viewers)
+	}
+}
+
+func TestIntercomOfferErrors(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	ff := ffmpeg.NewFake()
+	b := InitBackend(filepath.Join(dir, "history.sqlite"), "", ff)
+	defer b.Shutdown(context.Background())
+	b.SetAuth("door", "secret")
+
+	pc, offer := testOffer(t)
+	defer pc.Close()
+
+	// the viewer watches without audio
+	ff.IntercomErr = ffmpeg.ErrAudioBusy
+	w := httptest.NewRecorder()
+	b.postIntercomOffer(w, httptest.NewRequest(http.MethodPost, "/intercom/offer", strings.NewReader(offer)))
+	var answer intercomAnswer
+	if err := json.NewDecoder(w.Body).Decode(&answer); w.Code != http.StatusOK || err != nil || answer.Audio {
+		t.Fatalf("audio busy: status is=%d err=%v audio=%v", w.Code, err, answer.Audio)
+	}
+
+	ff.SnapshotErr = ffmpeg.ErrTooManyViewers
+	w = httptest.NewRecorder()
+	b.postIntercomOffer(w, httptest.NewRequest(http.MethodPost, "/intercom/offer", strings.NewReader(offer)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("too many viewers: status is=%d", w.Code)
+	}
+
+	for _, c := range []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "nonsense", http.StatusBadRequest},
+		{http.MethodPost, `{"type":"answer","sdp":""}`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		b.postIntercomOffer(w, httptest.NewRequest(c.method, "/intercom/offer", bytes.NewBufferString(c.body)))
+		if w.Code != c.status {
+			t.Fatalf("%s %q: status is=%d want=%d", c.method, c.body, w.Code, c.status)
+		}
+	}
+}
+
+func TestRTPRewriter(t *testing.T) {
+	r := &rtpRewriter{clockRate: 90000}
+	now := time.Unix(0, 0)
+
+	for _, c := range []struct {
+		ssrc    uint32
+		seq     uint16
+		ts      uint32
+		after   time.Duration
+		seqWant uint16
+		tsWant  uint32
+	}{
+		{1, 100, 1000, 0, 100, 1000},
+		{1, 101, 4000, 0, 101, 4000},
+		// the live view restarts with a new source one second later
+		{2, 7, 50, time.Second, 102, 94000},
+		{2, 8, 3050, 0, 103, 97000},
+		// wrap around
+		{3, 65535, 0, 0, 104, 97000},
+		{3, 0, 10, 0, 105, 97010},
+	} {
+		now = now.Add(c.after)
+		p := &rtp.Packet{Header: rtp.Header{SSRC: c.ssrc, SequenceNumber: c.seq, Timestamp: c.ts}}
+		r.rewrite(p, now)
+		if p.SequenceNumber != c.seqWant || p.Timestamp != c.tsWant {
+			t.Fatalf("ssrc %d seq %d: is=%d/%d want=%d/%d", c.ssrc, c.seq, p.SequenceNumber, p.Timestamp, c.seqWant, c.tsWant)
+		}
+	}
+}
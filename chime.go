@@ -0,0 +1,96 @@
+package hkdoorbell
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+// ChimeConfig describes the sound played on the doorbell speaker when someone rings.
+type ChimeConfig struct {
+	// File is a sound file (WAV, MP3, OGG, ...); empty disables the chime
+	File string
+	// Volume of the chime; 1 keeps the volume of the file
+	Volume float64
+	// QuietStart and QuietEnd are the quiet hours as time of day,
+	// e.g. 22h and 7h; equal values disable them
+	QuietStart time.Duration
+	QuietEnd   time.Duration
+	// QuietVolume replaces Volume during the quiet hours; zero mutes the chime
+	QuietVolume float64
+}
+
+// Chime plays a sound on the doorbell speaker so that the visitor knows the doorbell rang.
+type Chime struct {
+	ff  ffmpeg.FFMPEG
+	cfg ChimeConfig
+	now func() time.Time
+}
+
+func InitChime(ff ffmpeg.FFMPEG, cfg ChimeConfig) *Chime {
+	return &Chime{
+		ff:  ff,
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// Ring plays the chime unless the audio output is used by a live session.
+func (c *Chime) Ring() {
+	if c.cfg.File == "" {
+		return
+	}
+
+	volume := c.volume(c.now())
+	if volume == 0 {
+		log.Debug.Println("chime: muted during quiet hours")
+		return
+	}
+
+	switch err := c.ff.PlaySound(c.cfg.File, volume); err {
+	case nil:
+	case ffmpeg.ErrAudioBusy:
+		log.Debug.Println("chime: skipped,", err)
+	default:
+		log.Info.Println("chime:", err)
+	}
+}
+
+// volume returns the volume of the chime at time t.
+func (c *Chime) volume(t time.Time) float64 {
+	if c.quiet(t) {
+		return c.cfg.QuietVolume
+	}
+
+	return c.cfg.Volume
+}
+
+// quiet returns true if t is within the quiet hours.
+func (c *Chime) quiet(t time.Time) bool {
+	start, end := c.cfg.QuietStart, c.cfg.QuietEnd
+	if start == end {
+		return false
+	}
+
+	h, m, s := t.Clock()
+	day := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if start < end {
+		return day >= start && day < end
+	}
+
+	// the quiet hours span midnight
+	return day >= start || day < end
+}
+
+// ParseTimeOfDay parses a time of day written as "15:04" and returns it as duration since midnight.
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
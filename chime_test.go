@@ -0,0 +1,86 @@
+package hkdoorbell
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+func at(hour, min int) func() time.Time {
+	return func() time.Time {
+		return time.Date(2020, 7, 4, hour, min, 0, 0, time.Local)
+	}
+}
+
+func TestChimeQuietHours(t *testing.T) {
+	c := InitChime(ffmpeg.NewFake(), ChimeConfig{Volume: 0.8, QuietStart: 22 * time.Hour, QuietEnd: 7 * time.Hour, QuietVolume: 0.2})
+
+	tests := []struct {
+		hour, min int
+		volume    float64
+	}{
+		{12, 0, 0.8},
+		{21, 59, 0.8},
+		{22, 0, 0.2},
+		{3, 30, 0.2},
+		{6, 59, 0.2},
+		{7, 0, 0.8},
+	}
+	for _, test := range tests {
+		if is, want := c.volume(at(test.hour, test.min)()), test.volume; is != want {
+			t.Fatalf("%02d:%02d volume is=%v want=%v", test.hour, test.min, is, want)
+		}
+	}
+
+	// quiet hours within the same day
+	c.cfg.QuietStart, c.cfg.QuietEnd = 13*time.Hour, 15*time.Hour
+	if !c.quiet(at(14, 0)()) || c.quiet(at(16, 0)()) {
+		t.Fatal("wrong quiet hours within the same day")
+	}
+
+	c.cfg.QuietStart, c.cfg.QuietEnd = 0, 0
+	if c.quiet(at(3, 0)()) {
+		t.Fatal("quiet hours are disabled")
+	}
+}
+
+func TestChimeRing(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	c := InitChime(ff, ChimeConfig{File: "chime.wav", Volume: 0.8, QuietStart: 22 * time.Hour, QuietEnd: 7 * time.Hour})
+
+	c.now = at(12, 0)
+	c.Ring()
+	// muted during the quiet hours
+	c.now = at(23, 0)
+	c.Ring()
+
+	want := []ffmpeg.Call{{Method: "PlaySound", File: "chime.wav", Volume: 0.8}}
+	if is := ff.Calls(); !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%+v want=%+v", is, want)
+	}
+}
+
+func TestChimeWithoutFile(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	InitChime(ff, ChimeConfig{Volume: 1}).Ring()
+
+	if is := ff.Calls(); len(is) != 0 {
+		t.Fatalf("calls is=%+v want none", is)
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	d, err := ParseTimeOfDay("22:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := d, 22*time.Hour+30*time.Minute; is != want {
+		t.Fatalf("time of day is=%v want=%v", is, want)
+	}
+
+	if _, err := ParseTimeOfDay("25:00"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -2,23 +2,52 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"image"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/brutella/hc"
 	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
 	"github.com/brutella/hc/log"
 
 	"github.com/ra1nb0w/hkdoorbell"
 	"github.com/ra1nb0w/hkdoorbell/backend"
 	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
 
 	"net/http"
 	_ "net/http/pprof"
 )
 
+// polygons collects the values of a repeated flag
+type polygons []ffmpeg.Polygon
+
+func (p *polygons) String() string {
+	var s []string
+	for _, polygon := range *p {
+		s = append(s, polygon.String())
+	}
+
+	return strings.Join(s, "; ")
+}
+
+func (p *polygons) Set(value string) error {
+	polygon, err := ffmpeg.ParsePolygon(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, polygon)
+
+	return nil
+}
+
 func main() {
 
 	// Platform dependent flags
@@ -30,6 +59,13 @@ func main() {
 	var h264Encoder *string
 	var h264Decoder *string
 	var buttonGPIO *int
+	var gpioChip *string
+	var buttonBias *string
+	var buttonDebounce *time.Duration
+	var simulate *bool
+	var simulateVideo *string
+	var simulateAudio *string
+	var simulateFIFO *string
 
 	// Command line arguments
 	if runtime.GOOS == "linux" {
@@ -40,7 +76,14 @@ func main() {
 		audioNameOutput = flag.String("audio_name_output", "default", "audio output name device")
 		h264Decoder = flag.String("h264_decoder", "", "h264 video decoder")
 		h264Encoder = flag.String("h264_encoder", "h264_omx", "h264 video encoder")
-		buttonGPIO = flag.Int("button_gpio", 17, "GPIO number connected to the button")
+		buttonGPIO = flag.Int("button_gpio", 17, "GPIO number connected to the button (-1 disables)")
+		gpioChip = flag.String("gpio_chip", "gpiochip0", "GPIO character device of the button and the outputs")
+		buttonBias = flag.String("button_bias", "pull-up", "bias of the button line: as-is, pull-up, pull-down or disabled")
+		buttonDebounce = flag.Duration("button_debounce", 20*time.Millisecond, "time the button line must be stable before a press is reported")
+		simulate = flag.Bool("simulate", false, "simulate the GPIO lines, the camera and the microphone; the lines are driven from stdin, the /simulator page of the backend and -simulate_fifo")
+		simulateVideo = flag.String("simulate_video", "testsrc2=size=1280x720:rate=30", "lavfi source of the simulated camera")
+		simulateAudio = flag.String("simulate_audio", "sine=frequency=440:sample_rate=48000", "lavfi source of the simulated microphone")
+		simulateFIFO = flag.String("simulate_fifo", "", "named pipe whose lines are commands of the simulator (empty disables)")
 	} else if runtime.GOOS == "darwin" { // macOS
 		videoDevice = flag.String("input_device", "avfoundation", "video input device")
 		videoFilename = flag.String("input_filename", "default", "video input device filename")
@@ -50,19 +93,112 @@ func main() {
 		h264Decoder = flag.String("h264_decoder", "", "h264 video decoder")
 		h264Encoder = flag.String("h264_encoder", "libx264", "h264 video encoder")
 		buttonGPIO = new(int)
+		gpioChip = new(string)
+		buttonBias = new(string)
+		buttonDebounce = new(time.Duration)
+		simulate = new(bool)
+		simulateVideo = new(string)
+		simulateAudio = new(string)
+		simulateFIFO = new(string)
 	} else {
 		log.Info.Fatalf("%s platform is not supported", runtime.GOOS)
 	}
 	var minVideoBitrate *int = flag.Int("min_video_bitrate", 0, "minimum video bit rate in kbps")
+	var maxRestarts *int = flag.Int("ffmpeg_max_restarts", 5, "consecutive failures before an ffmpeg process is not restarted anymore (-1 restarts forever)")
+	var stderrLines *int = flag.Int("ffmpeg_stderr_lines", 50, "stderr lines kept for every ffmpeg process; negative disables the capture")
+	var snapshotMaxAge *time.Duration = flag.Duration("snapshot_max_age", 10*time.Second, "how long a captured frame is used for snapshots")
+	var snapshotRefresh *time.Duration = flag.Duration("snapshot_refresh", 0, "interval to capture a new snapshot frame while the camera is idle (0 disables)")
+	var overlayText *string = flag.String("overlay_text", "", "text drawn on stream and snapshots; may use {{.Camera}}, {{.Timestamp}} and {{.Zone}}")
+	var overlayTimestamp *string = flag.String("overlay_timestamp_format", "%Y-%m-%d %H:%M:%S", "strftime format of {{.Timestamp}}")
+	var overlayTimeZone *string = flag.String("overlay_time_zone", "", "time zone of {{.Timestamp}}, e.g. Europe/Rome (default system time zone)")
+	var overlayLogo *string = flag.String("overlay_logo", "", "PNG image drawn in the top right corner of stream and snapshots")
+	var overlayFont *string = flag.String("overlay_font", "", "font file used to draw the overlay text")
+	var overlayFontSize *int = flag.Int("overlay_font_size", 24, "font size of the overlay text")
+	var privacyMasks polygons
+	flag.Var(&privacyMasks, "privacy_mask", "polygon \"x,y x,y x,y ...\" filled black on stream and snapshots; coordinates go from 0,0 (top left) to 1,1 (bottom right); may be repeated")
+	var dayNightInterval *time.Duration = flag.Duration("daynight_interval", 0, "interval between two brightness samples of the day/night switching (0 disables)")
+	var nightBelow *float64 = flag.Float64("night_below", 40, "brightness (0-255) under which the camera switches to night")
+	var dayAbove *float64 = flag.Float64("day_above", 90, "brightness (0-255) over which the camera switches to day; must be above the brightness with IR LEDs on")
+	var dayNightSamples *int = flag.Int("daynight_samples", 3, "consecutive samples beyond a threshold needed to switch between day and night")
+	var irCutGPIO *int = flag.Int("ir_cut_gpio", -1, "GPIO number of the IR-cut filter, high while the filter is in place (-1 disables)")
+	var irLEDGPIO *int = flag.Int("ir_led_gpio", -1, "GPIO number of the IR LEDs (-1 disables)")
+	var nightFramerate *int = flag.Int("night_framerate", 0, "maximum framerate at night (0 keeps the requested framerate)")
+	var nightMinVideoBitrate *int = flag.Int("night_min_video_bitrate", 0, "minimum video bit rate in kbps at night (0 uses min_video_bitrate)")
+	var echoCancellation *bool = flag.Bool("echo_cancellation", false, "remove the speaker audio from the microphone (needs separate audio and video devices)")
+	var echoTail *time.Duration = flag.Duration("echo_tail", 64*time.Millisecond, "longest echo removed by the echo cancellation after its estimated delay")
+	var noiseReduction *int = flag.Int("noise_reduction", 0, "noise reduction of the microphone in dB (0 disables)")
+	var automaticGain *bool = flag.Bool("automatic_gain", false, "normalize the volume of the microphone")
+	var chimeFile *string = flag.String("chime_file", "", "sound file (WAV, MP3, OGG) played on the doorbell speaker when someone rings")
+	var chimeVolume *float64 = flag.Float64("chime_volume", 1, "volume of the chime (1 keeps the volume of the file)")
+	var quietStart *string = flag.String("quiet_start", "", "start of the quiet hours, e.g. 22:00")
+	var quietEnd *string = flag.String("quiet_end", "", "end of the quiet hours, e.g. 07:00")
+	var quietVolume *float64 = flag.Float64("quiet_volume", 0, "volume of the chime during the quiet hours (0 mutes it)")
+	var messageVolume *float64 = flag.Float64("message_volume", 1, "volume of the voice messages in <data_dir>/messages")
+	var liveFramerate *int = flag.Int("live_framerate", 5, "framerate of the MJPEG live view of the backend")
+	var liveVideoBitrate *int = flag.Int("live_video_bitrate", 1000, "video bit rate in kbps of the HLS live view of the backend")
+	var liveDir *string = flag.String("live_dir", "", "directory of the HLS segments (empty uses a temporary directory)")
+	var maxViewers *int = flag.Int("max_viewers", 0, "concurrent viewers of the MJPEG live view and of the intercom (0 is unlimited)")
+	var adaptiveBitrate *bool = flag.Bool("adaptive_bitrate", false, "adapt video bit rate and framerate to the packet loss reported by the controller")
+	var adaptiveMinBitrate *int = flag.Int("adaptive_min_bitrate", 0, "lowest adaptive video bit rate in kbps (0 uses a quarter of the requested bit rate)")
+	var adaptiveMaxBitrate *int = flag.Int("adaptive_max_bitrate", 0, "highest adaptive video bit rate in kbps (0 uses the requested bit rate)")
+	var adaptiveMinFramerate *int = flag.Int("adaptive_min_framerate", 0, "lowest adaptive framerate (0 keeps the requested framerate)")
+	var adaptiveInterval *time.Duration = flag.Duration("adaptive_interval", 10*time.Second, "shortest time between two adaptations; each one restarts the encoder")
+	var ringHTTP *bool = flag.Bool("ring_http", false, "ring on POST requests to /ring of the backend")
+	var ringSocket *string = flag.String("ring_socket", "", "UNIX socket which rings for every line written to it (empty disables)")
+	var relayGPIO *int = flag.Int("relay_gpio", -1, "GPIO number of the relay of an existing chime (-1 disables)")
+	var relayPulse *time.Duration = flag.Duration("relay_pulse", 300*time.Millisecond, "length of the relay pulse for a ring")
+	var relayPatterns *string = flag.String("relay_patterns", "", "relay patterns of the ring sources replacing the pulse, e.g. mqtt=on:100ms,off:100ms,on:100ms;http=on:1s")
+	var tamperGPIO *int = flag.Int("tamper_gpio", -1, "GPIO number of the case switch of the tamper detection (-1 disables)")
+	var tamperOpenHigh *bool = flag.Bool("tamper_open_high", true, "the case switch line is high while the case is open")
+	var tamperBias *string = flag.String("tamper_bias", "pull-up", "bias of the case switch line: as-is, pull-up, pull-down or disabled")
+	var tamperInterval *time.Duration = flag.Duration("tamper_interval", 0, "interval between two frames checked by the camera tamper detection (0 disables)")
+	var tamperCoveredBelow *float64 = flag.Float64("tamper_covered_below", 4, "standard deviation of the luma (0-255) under which the lens is covered (0 disables)")
+	var tamperSamples *int = flag.Int("tamper_samples", 3, "consecutive uniform frames needed for a covered lens")
+	var tamperSceneChange *float64 = flag.Float64("tamper_scene_change", 60, "mean luma difference (0-255) of two frames over which the scene changed (0 disables)")
+	var tamperFrameTimeout *time.Duration = flag.Duration("tamper_frame_timeout", 2*time.Minute, "longest time without frames from the camera (0 disables)")
+	var tamperRecord *time.Duration = flag.Duration("tamper_record", 30*time.Second, "length of the recording started by a tamper (0 disables)")
+	var ledGPIO *int = flag.Int("led_gpio", -1, "GPIO number of the button LED or of a status LED (-1 disables)")
+	var ledIdle *string = flag.String("led_idle", "on", "LED pattern while idle, e.g. on, off or on:200ms,off:800ms")
+	var ledRing *string = flag.String("led_ring", "on:150ms,off:150ms", "LED pattern after a ring")
+	var ledStreaming *string = flag.String("led_streaming", "on:1s,off:250ms", "LED pattern while a HomeKit stream is active")
+	var ledError *string = flag.String("led_error", "on:100ms,off:100ms,on:100ms,off:1700ms", "LED pattern while ffmpeg or the camera is unhealthy")
+	var ledRingDuration *time.Duration = flag.Duration("led_ring_duration", 10*time.Second, "how long the LED shows the ring pattern after a ring")
+	var ledCameraCheck *time.Duration = flag.Duration("led_camera_check", time.Minute, "interval between two camera checks of the LED (0 checks only the streams)")
+	var ringCoalesce *time.Duration = flag.Duration("ring_coalesce", 2*time.Second, "presses within this time of the previous press are a single ring (0 disables)")
+	var ringCooldown *time.Duration = flag.Duration("ring_cooldown", 10*time.Second, "presses within this time after a ring do not ring (0 disables)")
+	var ringPerMinute *int = flag.Int("ring_per_minute", 4, "highest number of rings within a minute (0 disables)")
+	var ringPrankPerMinute *int = flag.Int("ring_prank_per_minute", 10, "presses within a minute beyond which they are flagged as prank (0 disables)")
+	var mqttBroker *string = flag.String("mqtt_broker", "", "host:port of the MQTT broker whose messages ring (empty disables)")
+	var mqttTopic *string = flag.String("mqtt_topic", "hkdoorbell/ring", "MQTT topic whose messages ring")
+	var mqttPayload *string = flag.String("mqtt_payload", "", "payload of the MQTT messages which ring (empty rings on every message)")
+	var mqttClientID *string = flag.String("mqtt_client_id", "hkdoorbell", "MQTT client identifier")
+	var mqttUsername *string = flag.String("mqtt_username", "", "MQTT username")
+	var mqttPassword *string = flag.String("mqtt_password", "", "MQTT password")
 	var verbose *bool = flag.Bool("verbose", true, "Verbose logging")
 	var dataDir *string = flag.String("data_dir", "Doorbell", "Path to data directory")
 	var pin *string = flag.String("pin", "00102003", "Pin used to associate the accesory to Homekit")
 	var profile *bool = flag.Bool("profile", false, "Enable http pprof")
 	var profile_addr *string = flag.String("profile_addr", "localhost:8383", "pprof address:port")
 	var backend_addr *string = flag.String("backend_addr", "0.0.0.0:8080", "address:port of the backend web service")
+	var backendUser *string = flag.String("backend_user", "", "user of the HTTP basic authentication of the backend (empty with -backend_password disables it)")
+	var backendPassword *string = flag.String("backend_password", "", "password of the HTTP basic authentication of the backend")
+	var backendTLSCert *string = flag.String("backend_tls_cert", "", "PEM certificate which serves the backend over HTTPS (empty serves HTTP)")
+	var backendTLSKey *string = flag.String("backend_tls_key", "", "PEM key of -backend_tls_cert")
+	var shutdownTimeout *time.Duration = flag.Duration("shutdown_timeout", 10*time.Second, "longest time to stop the streams and flush the history on exit")
 
 	flag.Parse()
 
+	if *simulate {
+		*videoDevice, *videoFilename = ffmpeg.SimulatedDevice, *simulateVideo
+		*audioDevice, *audioNameInput = ffmpeg.SimulatedDevice, *simulateAudio
+		// a development machine has no hardware encoder
+		encoderSet := false
+		flag.Visit(func(f *flag.Flag) { encoderSet = encoderSet || f.Name == "h264_encoder" })
+		if !encoderSet {
+			*h264Encoder = "libx264"
+		}
+	}
+
 	if *verbose {
 		log.Debug.Enable()
 		ffmpeg.EnableVerboseLogging()
@@ -86,10 +222,107 @@ func main() {
 		H264Decoder:     *h264Decoder,
 		H264Encoder:     *h264Encoder,
 		MinVideoBitrate: *minVideoBitrate,
+		MaxRestarts:     *maxRestarts,
+		StderrLines:     *stderrLines,
+		SnapshotMaxAge:  *snapshotMaxAge,
+		SnapshotRefresh: *snapshotRefresh,
+		Overlay: ffmpeg.Overlay{
+			Text:            *overlayText,
+			TimestampFormat: *overlayTimestamp,
+			TimeZone:        *overlayTimeZone,
+			CameraName:      accInfo.Name,
+			Logo:            *overlayLogo,
+			FontFile:        *overlayFont,
+			FontSize:        *overlayFontSize,
+		},
+		PrivacyMasks:         privacyMasks,
+		NightFramerate:       *nightFramerate,
+		NightMinVideoBitrate: *nightMinVideoBitrate,
+		AudioProcessing: ffmpeg.AudioProcessing{
+			EchoCancellation: *echoCancellation,
+			EchoTail:         *echoTail,
+			NoiseReduction:   *noiseReduction,
+			AutomaticGain:    *automaticGain,
+		},
+		LiveFramerate:    *liveFramerate,
+		LiveVideoBitrate: *liveVideoBitrate,
+		LiveDir:          *liveDir,
+		MaxViewers:       *maxViewers,
+		AdaptiveBitrate: ffmpeg.AdaptiveBitrate{
+			Enabled:      *adaptiveBitrate,
+			MinBitrate:   *adaptiveMinBitrate,
+			MaxBitrate:   *adaptiveMaxBitrate,
+			MinFramerate: *adaptiveMinFramerate,
+			Interval:     *adaptiveInterval,
+		},
 	}
 
 	ffmpeg := hkdoorbell.SetupFFMPEGStreaming(doorbell, cfg)
 
+	// pre-recorded voice messages played to the visitor
+	messages, err := hkdoorbell.LoadMessages(ffmpeg, filepath.Join(*dataDir, "messages"), *messageVolume)
+	if err != nil {
+		log.Info.Fatal(err)
+	}
+	hkdoorbell.AddMessageSwitches(doorbell, messages)
+
+	// the button and the outputs are lines of the GPIO chip on Linux
+	var chip rpi.Chip
+	var simulator *hkdoorbell.Simulator
+	if *simulate {
+		// the blinking outputs keep only their recent values
+		fake := rpi.NewFakeChip()
+		fake.KeepValues = 100
+		chip = fake
+		simulator = hkdoorbell.NewSimulator(fake)
+		for offset, name := range map[*int]string{
+			buttonGPIO: "button",
+			irCutGPIO:  "ir-cut",
+			irLEDGPIO:  "ir-led",
+			relayGPIO:  "relay",
+			tamperGPIO: "case",
+			ledGPIO:    "led",
+		} {
+			if *offset >= 0 {
+				simulator.Name(*offset, name)
+			}
+		}
+	} else if runtime.GOOS == "linux" {
+		if chip, err = rpi.OpenChip(*gpioChip); err != nil {
+			log.Info.Fatal(err)
+		}
+		defer chip.Close()
+	}
+
+	// ring an existing chime through a relay; HomeKit can mute it
+	var relay *hkdoorbell.RelayChime
+	if *relayGPIO >= 0 {
+		if chip == nil {
+			log.Info.Fatalf("%s platform doesn't support GPIO", runtime.GOOS)
+		}
+		patterns, err := hkdoorbell.ParseRelayPatterns(*relayPatterns)
+		if err != nil {
+			log.Info.Fatal(err)
+		}
+		l, err := chip.RequestOutput(*relayGPIO, rpi.LOW)
+		if err != nil {
+			log.Info.Fatal(err)
+		}
+		defer l.Close()
+
+		relay = hkdoorbell.InitRelayChime(hkdoorbell.RelayConfig{
+			Pattern:  hkdoorbell.Pattern{{Value: rpi.HIGH, Duration: *relayPulse}},
+			Patterns: patterns,
+		}, l)
+		hkdoorbell.AddRelayMuteSwitch(doorbell, relay)
+	}
+
+	// the tampered status is raised by the case switch and by the camera checks
+	var tamperStatus *characteristic.StatusTampered
+	if *tamperGPIO >= 0 || *tamperInterval > 0 {
+		tamperStatus = hkdoorbell.AddTamperStatus(doorbell)
+	}
+
 	// configure homekit
 	config := hc.Config{Pin: *pin, StoragePath: *dataDir}
 
@@ -100,34 +333,225 @@ func main() {
 
 	// start backend http web server
 	db_file := *dataDir + "/history.sqlite"
-	bk := backend.InitBackend(db_file, *backend_addr)
+	bk := backend.InitBackend(db_file, *backend_addr, ffmpeg)
+	bk.SetMessages(messages)
+	bk.SetAuth(*backendUser, *backendPassword)
+	bk.SetTLS(*backendTLSCert, *backendTLSKey)
 	go bk.StartWebService()
 
-	// save a snapshot when the button is pressed
-	onButtonPressed := func() {
-		// this is the size used by preview on IOS
-		// we hope that it doesn't change :)
-		img, err := ffmpeg.Snapshot(1280, 960)
+	// keep a summary of every stream session for diagnostics
+	ffmpeg.OnSessionEnd(bk.InsertSession)
 
-		if img != nil && err == nil {
-			bk.InsertSnapshot(img)
+	// let the visitor hear the doorbell
+	chimeCfg := hkdoorbell.ChimeConfig{
+		File:        *chimeFile,
+		Volume:      *chimeVolume,
+		QuietVolume: *quietVolume,
+	}
+	if *quietStart != "" || *quietEnd != "" {
+		if chimeCfg.QuietStart, err = hkdoorbell.ParseTimeOfDay(*quietStart); err != nil {
+			log.Info.Fatal(err)
+		}
+		if chimeCfg.QuietEnd, err = hkdoorbell.ParseTimeOfDay(*quietEnd); err != nil {
+			log.Info.Fatal(err)
 		}
 	}
+	chime := hkdoorbell.InitChime(ffmpeg, chimeCfg)
 
-	// instantiate and start the button used to activate the doorbell notification
-	b := hkdoorbell.InitButton(
-		*buttonGPIO,
-		doorbell.Control.ProgrammableSwitchEvent,
-		bufio.NewScanner(os.Stdin),
-		onButtonPressed)
+	// every ring sends the HomeKit event, plays the chime and saves a snapshot
+	ring := hkdoorbell.InitRingHandler(ffmpeg, doorbell.Control.ProgrammableSwitchEvent, chime, bk, hkdoorbell.RingLimits{
+		Coalesce:       *ringCoalesce,
+		Cooldown:       *ringCooldown,
+		PerMinute:      *ringPerMinute,
+		PrankPerMinute: *ringPrankPerMinute,
+	})
 
-	// start the button
-	if runtime.GOOS == "linux" {
-		go b.StartLinux()
-	} else if runtime.GOOS == "darwin" {
-		go b.StartMacOS()
+	if relay != nil {
+		ring.OnRing(relay.Ring)
+	}
+
+	var triggers []hkdoorbell.Trigger
+	if chip != nil {
+		if *buttonGPIO >= 0 {
+			bias, err := rpi.ParseBias(*buttonBias)
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			line, err := chip.RequestInput(*buttonGPIO, rpi.InputConfig{
+				Edge:     rpi.FallingEdge,
+				Bias:     bias,
+				Debounce: *buttonDebounce,
+			})
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			triggers = append(triggers, hkdoorbell.NewGPIOTrigger(line))
+		}
 	} else {
-		log.Info.Fatalf("%s platform doesn't support button", runtime.GOOS)
+		// write something on the terminal and press enter to ring on macOS
+		triggers = append(triggers, hkdoorbell.NewStdinTrigger(bufio.NewScanner(os.Stdin)))
+	}
+	if *ringHTTP {
+		t := hkdoorbell.NewHTTPTrigger()
+		bk.Handle("/ring", t)
+		triggers = append(triggers, t)
+	}
+	if *ringSocket != "" {
+		triggers = append(triggers, hkdoorbell.NewSocketTrigger(*ringSocket))
+	}
+	if *mqttBroker != "" {
+		triggers = append(triggers, hkdoorbell.NewMQTTTrigger(hkdoorbell.MQTTConfig{
+			Broker:   *mqttBroker,
+			Topic:    *mqttTopic,
+			Payload:  *mqttPayload,
+			ClientID: *mqttClientID,
+			Username: *mqttUsername,
+			Password: *mqttPassword,
+		}))
+	}
+	// every background loop runs until ctx is cancelled on exit
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	run := func(fn func(context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			fn(ctx)
+		}()
+	}
+
+	triggersDone := hkdoorbell.StartTriggers(ctx, ring, triggers...)
+
+	// drive the simulated lines, e.g. write "press button" on the terminal
+	if simulator != nil {
+		bk.Handle("/simulator", simulator)
+		run(func(ctx context.Context) {
+			if err := simulator.Run(ctx, os.Stdin, os.Stdout); err != nil {
+				log.Info.Println("simulator:", err)
+			}
+		})
+		if *simulateFIFO != "" {
+			run(func(ctx context.Context) {
+				if err := simulator.RunFIFO(ctx, *simulateFIFO); err != nil {
+					log.Info.Println("simulator:", err)
+				}
+			})
+		}
+	}
+
+	// switch between day and night as the light changes
+	var dayNight *hkdoorbell.DayNight
+	if *dayNightInterval > 0 {
+		var irCut, irLED hkdoorbell.Output
+		if *irCutGPIO >= 0 {
+			if chip == nil {
+				log.Info.Fatalf("%s platform doesn't support GPIO", runtime.GOOS)
+			}
+			l, err := chip.RequestOutput(*irCutGPIO, rpi.HIGH)
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			defer l.Close()
+			irCut = l
+		}
+		if *irLEDGPIO >= 0 {
+			if chip == nil {
+				log.Info.Fatalf("%s platform doesn't support GPIO", runtime.GOOS)
+			}
+			l, err := chip.RequestOutput(*irLEDGPIO, rpi.LOW)
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			defer l.Close()
+			irLED = l
+		}
+
+		dayNight = hkdoorbell.InitDayNight(ffmpeg, hkdoorbell.DayNightConfig{
+			Interval:   *dayNightInterval,
+			NightBelow: *nightBelow,
+			DayAbove:   *dayAbove,
+			Samples:    *dayNightSamples,
+		}, irCut, irLED, func(tr hkdoorbell.DayNightTransition) {
+			bk.InsertDayNight(tr.Night, tr.Brightness)
+		})
+		run(dayNight.Run)
+	}
+
+	// show the state of the doorbell on the LED
+	var indicator *hkdoorbell.Indicator
+	if *ledGPIO >= 0 {
+		if chip == nil {
+			log.Info.Fatalf("%s platform doesn't support GPIO", runtime.GOOS)
+		}
+		cfg := hkdoorbell.IndicatorConfig{
+			RingDuration: *ledRingDuration,
+			CameraCheck:  *ledCameraCheck,
+		}
+		for _, p := range []struct {
+			pattern *hkdoorbell.Pattern
+			s       string
+		}{
+			{&cfg.Idle, *ledIdle},
+			{&cfg.Ring, *ledRing},
+			{&cfg.Streaming, *ledStreaming},
+			{&cfg.Error, *ledError},
+		} {
+			if *p.pattern, err = hkdoorbell.ParsePattern(p.s); err != nil {
+				log.Info.Fatal(err)
+			}
+		}
+		l, err := chip.RequestOutput(*ledGPIO, rpi.LOW)
+		if err != nil {
+			log.Info.Fatal(err)
+		}
+		defer l.Close()
+
+		indicator = hkdoorbell.InitIndicator(ffmpeg, cfg, l)
+		ring.OnRing(func(string) { indicator.Ring() })
+		run(indicator.Run)
+	}
+
+	// detect when the doorbell is pried off or the camera is tampered with
+	var tamper *hkdoorbell.Tamper
+	if tamperStatus != nil {
+		recordDir := filepath.Join(*dataDir, "recordings")
+		bk.Handle("/recordings/", http.StripPrefix("/recordings/", http.FileServer(http.Dir(recordDir))))
+
+		tamper = hkdoorbell.InitTamper(ffmpeg, hkdoorbell.TamperConfig{
+			Interval:       *tamperInterval,
+			CoveredBelow:   *tamperCoveredBelow,
+			Samples:        *tamperSamples,
+			SceneChange:    *tamperSceneChange,
+			FrameTimeout:   *tamperFrameTimeout,
+			RecordDir:      recordDir,
+			RecordDuration: *tamperRecord,
+		}, tamperStatus, bk)
+
+		if *tamperGPIO >= 0 {
+			if chip == nil {
+				log.Info.Fatalf("%s platform doesn't support GPIO", runtime.GOOS)
+			}
+			bias, err := rpi.ParseBias(*tamperBias)
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			line, err := chip.RequestInput(*tamperGPIO, rpi.InputConfig{
+				Edge:     rpi.BothEdges,
+				Bias:     bias,
+				Debounce: *buttonDebounce,
+			})
+			if err != nil {
+				log.Info.Fatal(err)
+			}
+			defer line.Close()
+
+			open := rpi.Value(rpi.LOW)
+			if *tamperOpenHigh {
+				open = rpi.HIGH
+			}
+			run(func(ctx context.Context) { tamper.WatchCase(ctx, line, open) })
+		}
+		run(tamper.Run)
 	}
 
 	// enable pprof
@@ -143,8 +567,36 @@ func main() {
 
 	// close all connection when exit
 	hc.OnTermination(func() {
-		bk.StopWebService()
-		b.Stop()
+		// a stuck ffmpeg or client must not keep the doorbell from exiting
+		time.AfterFunc(*shutdownTimeout+time.Second, func() {
+			log.Info.Println("shutdown timed out")
+			os.Exit(1)
+		})
+
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer done()
+
+		// the streams end first so that their sessions are recorded
+		if err := ffmpeg.Shutdown(shutdownCtx); err != nil {
+			log.Info.Println("ffmpeg shutdown:", err)
+		}
+		if err := bk.Shutdown(shutdownCtx); err != nil {
+			log.Info.Println("backend shutdown:", err)
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			<-triggersDone
+			loops.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			log.Info.Println("triggers still running at shutdown")
+		}
+
 		<-t.Stop()
 	})
 
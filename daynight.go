@@ -0,0 +1,179 @@
+package hkdoorbell
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// Output is a GPIO output, e.g. a line requested with rpi.Chip.RequestOutput.
+type Output interface {
+	Write(rpi.Value) error
+}
+
+// DayNightConfig contains the thresholds of the day/night switching.
+// Brightness is the mean luma of a frame from 0 (black) to 255 (white).
+type DayNightConfig struct {
+	// Interval between two brightness samples
+	Interval time.Duration
+	// NightBelow is the brightness under which the camera switches to night
+	NightBelow float64
+	// DayAbove is the brightness over which the camera switches to day;
+	// it must be higher than the brightness of the scene lit by the IR LEDs
+	DayAbove float64
+	// Samples is the number of consecutive samples beyond a threshold
+	// which are needed to switch
+	Samples int
+}
+
+// DayNightTransition describes a switch between day and night.
+type DayNightTransition struct {
+	Night      bool
+	Brightness float64
+	Time       time.Time
+}
+
+// width of the frames used to estimate the brightness
+const brightnessWidth = 64
+
+// DayNight switches the camera, the IR-cut filter and the IR LEDs
+// between day and night mode as the brightness of the scene changes.
+type DayNight struct {
+	ff    ffmpeg.FFMPEG
+	cfg   DayNightConfig
+	irCut Output
+	irLED Output
+	// onTransition is called after every switch
+	onTransition func(DayNightTransition)
+
+	night bool
+	// consecutive samples beyond the threshold of the other mode
+	count int
+}
+
+// InitDayNight returns a controller which starts in day mode.
+// irCut and irLED may be nil if the camera has no such pin.
+func InitDayNight(ff ffmpeg.FFMPEG, cfg DayNightConfig, irCut Output, irLED Output, onTransition func(DayNightTransition)) *DayNight {
+	if cfg.Samples < 1 {
+		cfg.Samples = 1
+	}
+
+	return &DayNight{
+		ff:           ff,
+		cfg:          cfg,
+		irCut:        irCut,
+		irLED:        irLED,
+		onTransition: onTransition,
+	}
+}
+
+// Run samples the brightness every interval until ctx is done.
+func (d *DayNight) Run(ctx context.Context) {
+	d.switchPins(false)
+
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sample()
+		}
+	}
+}
+
+// sample estimates the brightness of a shared frame and switches mode if needed.
+func (d *DayNight) sample() {
+	img, err := d.ff.Snapshot(brightnessWidth, 0)
+	if err != nil || img == nil {
+		log.Debug.Println("day/night: no frame:", err)
+		return
+	}
+
+	b := brightness(*img)
+	if d.update(b) {
+		d.set(!d.night, b)
+	}
+}
+
+// update returns true if the mode has to change after a sample with brightness b.
+func (d *DayNight) update(b float64) bool {
+	beyond := b > d.cfg.DayAbove
+	if !d.night {
+		beyond = b < d.cfg.NightBelow
+	}
+
+	if !beyond {
+		d.count = 0
+		return false
+	}
+
+	d.count++
+	if d.count < d.cfg.Samples {
+		return false
+	}
+	d.count = 0
+
+	return true
+}
+
+func (d *DayNight) set(night bool, b float64) {
+	d.night = night
+	if night {
+		log.Info.Printf("day/night: switch to night (brightness %.1f)\n", b)
+	} else {
+		log.Info.Printf("day/night: switch to day (brightness %.1f)\n", b)
+	}
+
+	d.switchPins(night)
+	d.ff.SetNightMode(night)
+
+	if d.onTransition != nil {
+		d.onTransition(DayNightTransition{Night: night, Brightness: b, Time: time.Now()})
+	}
+}
+
+// switchPins removes the IR-cut filter and turns the IR LEDs on at night.
+// The IR-cut filter is in place while its pin is high.
+func (d *DayNight) switchPins(night bool) {
+	cut, led := rpi.Value(rpi.HIGH), rpi.Value(rpi.LOW)
+	if night {
+		cut, led = rpi.LOW, rpi.HIGH
+	}
+
+	if d.irCut != nil {
+		if err := d.irCut.Write(cut); err != nil {
+			log.Info.Println("day/night: IR-cut:", err)
+		}
+	}
+	if d.irLED != nil {
+		if err := d.irLED.Write(led); err != nil {
+			log.Info.Println("day/night: IR LED:", err)
+		}
+	}
+}
+
+// brightness returns the mean luma of img.
+func brightness(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+
+	var sum uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			sum += uint64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+
+	return float64(sum) / float64(b.Dx()*b.Dy())
+}
@@ -0,0 +1,111 @@
+package hkdoorbell
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// testOutput records the values written to a GPIO output.
+type testOutput struct {
+	values []rpi.Value
+}
+
+func (o *testOutput) Write(v rpi.Value) error {
+	o.values = append(o.values, v)
+	return nil
+}
+
+func uniformImage(luma uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 8, 6))
+	for i := range img.Pix {
+		img.Pix[i] = luma
+	}
+
+	return img
+}
+
+func TestBrightness(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 2, 1))
+	img.SetGray(0, 0, color.Gray{Y: 100})
+	img.SetGray(1, 0, color.Gray{Y: 200})
+
+	if is, want := brightness(img), 150.0; is != want {
+		t.Fatalf("brightness is=%v want=%v", is, want)
+	}
+}
+
+func TestDayNightHysteresis(t *testing.T) {
+	d := InitDayNight(ffmpeg.NewFake(), DayNightConfig{NightBelow: 40, DayAbove: 90, Samples: 2}, nil, nil, nil)
+
+	// a single dark sample does not switch
+	for _, b := range []float64{30, 50, 30} {
+		if d.update(b) {
+			t.Fatalf("switch after %v", b)
+		}
+	}
+	if !d.update(30) {
+		t.Fatal("no switch to night after two dark samples")
+	}
+	d.night = true
+
+	// between the thresholds the camera stays in night mode
+	for _, b := range []float64{60, 80, 95, 60, 95} {
+		if d.update(b) {
+			t.Fatalf("switch after %v", b)
+		}
+	}
+	if !d.update(100) {
+		t.Fatal("no switch to day after two bright samples")
+	}
+}
+
+func TestDayNightTransitions(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	irCut, irLED := &testOutput{}, &testOutput{}
+	var transitions []DayNightTransition
+	d := InitDayNight(ff, DayNightConfig{NightBelow: 40, DayAbove: 90, Samples: 1}, irCut, irLED, func(tr DayNightTransition) {
+		transitions = append(transitions, tr)
+	})
+
+	ff.Image = uniformImage(20)
+	d.sample()
+	ff.Image = uniformImage(60)
+	d.sample()
+	ff.Image = uniformImage(120)
+	d.sample()
+
+	if is, want := len(transitions), 2; is != want {
+		t.Fatalf("transitions is=%v want=%v", is, want)
+	}
+	if tr := transitions[0]; !tr.Night || tr.Brightness != 20 {
+		t.Fatalf("first transition is=%+v", tr)
+	}
+	if tr := transitions[1]; tr.Night || tr.Brightness != 120 {
+		t.Fatalf("second transition is=%+v", tr)
+	}
+
+	if is, want := irCut.values, []rpi.Value{rpi.LOW, rpi.HIGH}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("IR-cut is=%v want=%v", is, want)
+	}
+	if is, want := irLED.values, []rpi.Value{rpi.HIGH, rpi.LOW}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("IR LED is=%v want=%v", is, want)
+	}
+
+	var modes []bool
+	for _, c := range ff.Calls() {
+		if c.Method == "SetNightMode" {
+			modes = append(modes, c.Night)
+		}
+	}
+	if is, want := modes, []bool{true, false}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("night modes is=%v want=%v", is, want)
+	}
+	if is, want := ff.Calls()[0], (ffmpeg.Call{Method: "Snapshot", Width: brightnessWidth}); !reflect.DeepEqual(is, want) {
+		t.Fatalf("snapshot call is=%+v want=%+v", is, want)
+	}
+}
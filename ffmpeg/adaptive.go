@@ -0,0 +1,135 @@
+package ffmpeg
+
+import (
+	"time"
+)
+
+const (
+	// a report with at least congestionLoss packets lost, congestionJitter or
+	// congestionRTT lowers the video quality
+	congestionLoss   = 0.1
+	congestionJitter = 50 * time.Millisecond
+	congestionRTT    = 400 * time.Millisecond
+	// cleanReports reports in a row with at most cleanLoss packets lost raise the video quality
+	cleanLoss    = 0.02
+	cleanReports = 5
+
+	defaultAdaptiveInterval = 10 * time.Second
+)
+
+// rateController adapts bitrate and framerate of a stream to the reception reports of the controller.
+// On congestion it lowers the bitrate and, once the bitrate is at its minimum, the framerate;
+// after clean reports it raises them again in reverse order.
+type rateController struct {
+	// interval is the shortest time between two changes
+	interval     time.Duration
+	minBitrate   int
+	maxBitrate   int
+	minFramerate int
+	maxFramerate int
+
+	bitrate   int
+	framerate int
+	// clean is the number of clean reports in a row
+	clean int
+	// changed is when bitrate or framerate changed last
+	changed time.Time
+}
+
+// newRateController returns a controller for a stream which starts at bitrate and framerate at time now.
+// The bounds which are not configured are derived from the start values.
+func newRateController(cfg AdaptiveBitrate, bitrate int, framerate int, now time.Time) *rateController {
+	c := &rateController{
+		interval:     cfg.Interval,
+		minBitrate:   cfg.MinBitrate,
+		maxBitrate:   cfg.MaxBitrate,
+		minFramerate: cfg.MinFramerate,
+		maxFramerate: framerate,
+		framerate:    framerate,
+		changed:      now,
+	}
+
+	if c.interval == 0 {
+		c.interval = defaultAdaptiveInterval
+	}
+	if c.maxBitrate == 0 {
+		c.maxBitrate = bitrate
+	}
+	if c.minBitrate == 0 {
+		c.minBitrate = bitrate / 4
+	}
+	if c.minBitrate > c.maxBitrate {
+		c.minBitrate = c.maxBitrate
+	}
+	if c.minFramerate == 0 || c.minFramerate > framerate {
+		c.minFramerate = framerate
+	}
+
+	c.bitrate = clamp(bitrate, c.minBitrate, c.maxBitrate)
+
+	return c
+}
+
+// update takes the report r received at t and returns true if bitrate or framerate changed.
+func (c *rateController) update(r receptionReport, t time.Time) bool {
+	loss := r.loss()
+	if loss >= congestionLoss || r.jitter() >= congestionJitter || r.roundTrip(t) >= congestionRTT {
+		c.clean = 0
+		if t.Sub(c.changed) < c.interval {
+			return false
+		}
+		return c.decrease(t)
+	}
+
+	if loss > cleanLoss {
+		c.clean = 0
+		return false
+	}
+
+	c.clean++
+	if c.clean < cleanReports || t.Sub(c.changed) < c.interval {
+		return false
+	}
+	c.clean = 0
+
+	return c.increase(t)
+}
+
+func (c *rateController) decrease(t time.Time) bool {
+	switch {
+	case c.bitrate > c.minBitrate:
+		c.bitrate = clamp(c.bitrate*3/4, c.minBitrate, c.maxBitrate)
+	case c.framerate > c.minFramerate:
+		c.framerate = clamp(c.framerate*2/3, c.minFramerate, c.maxFramerate)
+	default:
+		return false
+	}
+	c.changed = t
+
+	return true
+}
+
+func (c *rateController) increase(t time.Time) bool {
+	switch {
+	case c.framerate < c.maxFramerate:
+		c.framerate = clamp(c.framerate*3/2+1, c.minFramerate, c.maxFramerate)
+	case c.bitrate < c.maxBitrate:
+		c.bitrate = clamp(c.bitrate*11/10+1, c.minBitrate, c.maxBitrate)
+	default:
+		return false
+	}
+	c.changed = t
+
+	return true
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+
+	return v
+}
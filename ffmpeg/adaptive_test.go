@@ -0,0 +1,111 @@
+package ffmpeg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+)
+
+func TestRateControllerBounds(t *testing.T) {
+	now := time.Now()
+
+	c := newRateController(AdaptiveBitrate{}, 800, 24, now)
+	if c.minBitrate != 200 || c.maxBitrate != 800 || c.minFramerate != 24 || c.interval != defaultAdaptiveInterval {
+		t.Fatalf("derived bounds are %+v", c)
+	}
+
+	c = newRateController(AdaptiveBitrate{MinBitrate: 100, MaxBitrate: 500, MinFramerate: 30}, 800, 24, now)
+	if c.bitrate != 500 || c.minFramerate != 24 {
+		t.Fatalf("bitrate is=%d min framerate is=%d", c.bitrate, c.minFramerate)
+	}
+}
+
+func TestRateControllerAdapts(t *testing.T) {
+	start := time.Now()
+	c := newRateController(AdaptiveBitrate{MinBitrate: 200, MinFramerate: 10, Interval: time.Second}, 400, 24, start)
+
+	congested := receptionReport{FractionLost: 64}
+	clean := receptionReport{}
+
+	// the encoder is given interval to settle
+	if c.update(congested, start.Add(500*time.Millisecond)) {
+		t.Fatal("changed within interval")
+	}
+
+	// bitrate first, then framerate
+	steps := []struct{ bitrate, framerate int }{{300, 24}, {225, 24}, {200, 24}, {200, 16}, {200, 10}}
+	now := start
+	for _, step := range steps {
+		now = now.Add(time.Second)
+		if !c.update(congested, now) {
+			t.Fatalf("no change at %+v", step)
+		}
+		if c.bitrate != step.bitrate || c.framerate != step.framerate {
+			t.Fatalf("is=%dk %dfps want=%dk %dfps", c.bitrate, c.framerate, step.bitrate, step.framerate)
+		}
+	}
+	now = now.Add(time.Second)
+	if c.update(congested, now) {
+		t.Fatal("changed below the bounds")
+	}
+
+	// a series of clean reports restores the framerate first
+	for i := 1; i < cleanReports; i++ {
+		now = now.Add(time.Second)
+		if c.update(clean, now) {
+			t.Fatalf("changed after %d clean reports", i)
+		}
+	}
+	now = now.Add(time.Second)
+	if !c.update(clean, now) || c.framerate != 16 || c.bitrate != 200 {
+		t.Fatalf("is=%dk %dfps want=200k 16fps", c.bitrate, c.framerate)
+	}
+
+	// jitter counts as congestion
+	now = now.Add(time.Second)
+	if !c.update(receptionReport{Jitter: videoClockRate / 10}, now) || c.framerate != 10 {
+		t.Fatalf("is=%dfps want=10fps", c.framerate)
+	}
+}
+
+func TestStreamCommandsWithAdaptiveBitrate(t *testing.T) {
+	s := testStream("linux", "h264_omx", "")
+	s.adaptive = AdaptiveBitrate{Enabled: true, MinBitrate: 100}
+	video := testVideo()
+	audio := testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)
+
+	s.startRTCP(video)
+	s.rate.bitrate, s.rate.framerate = 150, 15
+	checkGolden(t, "stream_linux_adaptive", s.captureCommand("linux", video, audio).Args())
+}
+
+func TestStreamReceiveRTCP(t *testing.T) {
+	s := testStream("linux", "h264_omx", "")
+	s.adaptive = AdaptiveBitrate{Enabled: true, Interval: time.Nanosecond}
+	s.video = testVideo()
+	s.startRTCP(s.video)
+	s.capture = &process{}
+
+	// reports of other streams are ignored
+	other := receiverReport(receptionReport{SSRC: 3333, FractionLost: 128})
+	s.receiveRTCP(protectSRTCP(t, s.req.Video, other, 1))
+	if is, want := s.rate.bitrate, 300; is != want {
+		t.Fatalf("bitrate is=%d want=%d", is, want)
+	}
+
+	// the stream uses the key of the controller
+	lossy := receiverReport(receptionReport{SSRC: uint32(s.resp.SsrcVideo), FractionLost: 128})
+	s.receiveRTCP(protectSRTCP(t, s.req.Audio, lossy, 2))
+	if is, want := s.rate.bitrate, 300; is != want {
+		t.Fatalf("bitrate is=%d want=%d", is, want)
+	}
+
+	s.receiveRTCP(protectSRTCP(t, s.req.Video, lossy, 3))
+	if is, want := s.rate.bitrate, 225; is != want {
+		t.Fatalf("bitrate is=%d want=%d", is, want)
+	}
+	if is, want := s.videoBitrate(s.video), 225; is != want {
+		t.Fatalf("encoder bitrate is=%d want=%d", is, want)
+	}
+}
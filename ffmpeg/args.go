@@ -0,0 +1,237 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Option is a single ffmpeg option, e.g. `-b:v 299k` or `-an`.
+type Option struct {
+	Name  string
+	Value string
+	// Flag marks options without value
+	Flag bool
+}
+
+// Opt returns an option with a value.
+// The option is left out of the command line when value is empty.
+func Opt(name, value string) Option {
+	return Option{Name: name, Value: value}
+}
+
+// Optf returns an option whose value is formatted with fmt.Sprintf.
+func Optf(name, format string, a ...interface{}) Option {
+	return Opt(name, fmt.Sprintf(format, a...))
+}
+
+// Flag returns an option without value.
+func Flag(name string) Option {
+	return Option{Name: name, Flag: true}
+}
+
+func (o Option) args() []string {
+	switch {
+	case o.Flag:
+		return []string{"-" + o.Name}
+	case o.Value == "":
+		return nil
+	}
+
+	return []string{"-" + o.Name, o.Value}
+}
+
+func optionArgs(opts []Option) []string {
+	var args []string
+	for _, o := range opts {
+		args = append(args, o.args()...)
+	}
+
+	return args
+}
+
+// Filter is a single ffmpeg filter, e.g. `scale=1280:-2`.
+type Filter struct {
+	Name string
+	Args []string
+	// Sources are chains whose outputs are additional inputs of the filter,
+	// e.g. the image drawn by `overlay`
+	Sources []FilterChain
+}
+
+func (f Filter) String() string {
+	if len(f.Args) == 0 {
+		return f.Name
+	}
+
+	return f.Name + "=" + strings.Join(f.Args, ":")
+}
+
+// FilterChain is a list of filters which are applied one after another.
+type FilterChain []Filter
+
+// String returns the chain as filtergraph.
+// Filters with sources turn the chain into a graph with labeled links,
+// e.g. `movie=logo.png[s0];[in][s0]overlay=10:10[out]`.
+func (c FilterChain) String() string {
+	var sources []string
+	chain := ""
+	for _, f := range c {
+		if len(f.Sources) == 0 {
+			if chain != "" {
+				chain += ","
+			}
+			chain += f.String()
+			continue
+		}
+
+		if chain != "" {
+			chain += fmt.Sprintf("[l%d];[l%d]", len(sources), len(sources))
+		} else if len(sources) == 0 {
+			chain = "[in]"
+		}
+		for _, src := range f.Sources {
+			label := fmt.Sprintf("[s%d]", len(sources))
+			sources = append(sources, src.String()+label)
+			chain += label
+		}
+		chain += f.String()
+	}
+
+	if len(sources) == 0 {
+		return chain
+	}
+	if !strings.HasPrefix(chain, "[in]") {
+		chain = "[in]" + chain
+	}
+
+	return strings.Join(append(sources, chain+"[out]"), ";")
+}
+
+// EscapeFilterArg escapes the value of a filter option so that it may contain
+// characters with a special meaning for the option parser and the filtergraph parser.
+func EscapeFilterArg(v string) string {
+	// option level
+	v = escape(v, `\':`)
+	// filtergraph level
+	return escape(v, `\'[],;`)
+}
+
+// teeSlave returns a slave of the tee muxer which writes format with options to url,
+// e.g. `[f=hls:hls_time=2]live.m3u8`. The slave is split from the list of slaves
+// before its options are parsed, therefore the option values are escaped twice.
+func teeSlave(format, url string, options []Option) string {
+	opts := []string{"f=" + format}
+	for _, o := range options {
+		if o.Flag || o.Value == "" {
+			continue
+		}
+		opts = append(opts, o.Name+"="+escape(o.Value, `\':]`))
+	}
+
+	return escape("["+strings.Join(opts, ":")+"]"+url, `\'|`)
+}
+
+func escape(v string, special string) string {
+	var b strings.Builder
+	for _, r := range v {
+		if strings.ContainsRune(special, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// Input is an ffmpeg input, e.g. `-f v4l2 -framerate 30 -i /dev/video0`.
+type Input struct {
+	// options which apply to the input (demuxer and decoder)
+	Options []Option
+	Format  string
+	URL     string
+}
+
+func (i Input) args() []string {
+	args := optionArgs(i.Options)
+	args = append(args, Opt("f", i.Format).args()...)
+
+	return append(args, "-i", i.URL)
+}
+
+// Encoder selects the codec of an output stream and its options.
+type Encoder struct {
+	Codec   string
+	Options []Option
+}
+
+func (e *Encoder) args(stream string) []string {
+	if e == nil {
+		return nil
+	}
+	args := Opt("codec:"+stream, e.Codec).args()
+
+	return append(args, optionArgs(e.Options)...)
+}
+
+// Output is an ffmpeg output with its encoders and filters.
+// Video and audio are left out when the encoder is nil and the stream is disabled
+// with NoVideo or NoAudio.
+type Output struct {
+	Maps         []string
+	NoVideo      bool
+	NoAudio      bool
+	Video        *Encoder
+	VideoFilters FilterChain
+	Audio        *Encoder
+	AudioFilters FilterChain
+	// options which apply to the output (muxer)
+	Options []Option
+	Format  string
+	URL     string
+}
+
+func (o Output) args() []string {
+	var args []string
+	for _, m := range o.Maps {
+		args = append(args, "-map", m)
+	}
+	if o.NoVideo {
+		args = append(args, "-vn")
+	}
+	if o.NoAudio {
+		args = append(args, "-an")
+	}
+	args = append(args, o.Video.args("v")...)
+	if len(o.VideoFilters) > 0 {
+		args = append(args, "-vf", o.VideoFilters.String())
+	}
+	args = append(args, o.Audio.args("a")...)
+	if len(o.AudioFilters) > 0 {
+		args = append(args, "-af", o.AudioFilters.String())
+	}
+	args = append(args, optionArgs(o.Options)...)
+	args = append(args, Opt("f", o.Format).args()...)
+
+	return append(args, o.URL)
+}
+
+// Command is an ffmpeg command line.
+// Inputs and outputs keep their order; every input is placed before the outputs.
+type Command struct {
+	Global  []Option
+	Inputs  []Input
+	Outputs []Output
+}
+
+// Args returns the arguments of the command without the executable name.
+func (c Command) Args() []string {
+	args := optionArgs(c.Global)
+	for _, i := range c.Inputs {
+		args = append(args, i.args()...)
+	}
+	for _, o := range c.Outputs {
+		args = append(args, o.args()...)
+	}
+
+	return args
+}
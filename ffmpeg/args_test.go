@@ -0,0 +1,86 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandArgs(t *testing.T) {
+	cmd := Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{{
+			Options: []Option{Opt("framerate", "30"), Opt("codec:v", "")},
+			Format:  "avfoundation",
+			URL:     "FaceTime HD Camera:default",
+		}},
+		Outputs: []Output{{
+			Maps:         []string{"0:v"},
+			NoAudio:      true,
+			Video:        &Encoder{Codec: "libx264", Options: []Option{Opt("preset", "ultrafast"), Opt("profile:v", "")}},
+			VideoFilters: FilterChain{{Name: "scale", Args: []string{"640", "-2"}}, {Name: "format", Args: []string{"yuv420p"}}},
+			Options:      []Option{Optf("b:v", "%dk", 299)},
+			Format:       "rtp",
+			URL:          "srtp://127.0.0.1:5000",
+		}},
+	}
+
+	want := []string{
+		"-hide_banner",
+		"-framerate", "30", "-f", "avfoundation", "-i", "FaceTime HD Camera:default",
+		"-map", "0:v", "-an", "-codec:v", "libx264", "-preset", "ultrafast", "-vf", "scale=640:-2,format=yuv420p",
+		"-b:v", "299k", "-f", "rtp", "srtp://127.0.0.1:5000",
+	}
+	if is := cmd.Args(); !reflect.DeepEqual(is, want) {
+		t.Fatalf("args\nis=  %q\nwant=%q", is, want)
+	}
+}
+
+func TestOutputWithoutEncoders(t *testing.T) {
+	o := Output{Format: "alsa", URL: "default"}
+
+	if is, want := o.args(), []string{"-f", "alsa", "default"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("args is=%q want=%q", is, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	if is, want := (Filter{Name: "hflip"}).String(), "hflip"; is != want {
+		t.Fatalf("filter is=%v want=%v", is, want)
+	}
+	if is, want := (FilterChain{}).String(), ""; is != want {
+		t.Fatalf("chain is=%v want=%v", is, want)
+	}
+}
+
+func TestFilterChainWithSources(t *testing.T) {
+	logo := FilterChain{{Name: "movie", Args: []string{"logo.png"}}}
+	c := FilterChain{
+		{Name: "fps", Args: []string{"1"}},
+		{Name: "overlay", Args: []string{"10", "10"}, Sources: []FilterChain{logo}},
+		{Name: "drawtext", Args: []string{"text=hello"}},
+	}
+
+	want := "movie=logo.png[s0];[in]fps=1[l0];[l0][s0]overlay=10:10,drawtext=text=hello[out]"
+	if is := c.String(); is != want {
+		t.Fatalf("graph is=%v want=%v", is, want)
+	}
+
+	c = FilterChain{{Name: "overlay", Sources: []FilterChain{logo}}}
+	want = "movie=logo.png[s0];[in][s0]overlay[out]"
+	if is := c.String(); is != want {
+		t.Fatalf("graph is=%v want=%v", is, want)
+	}
+}
+
+func TestEscapeFilterArg(t *testing.T) {
+	if is, want := EscapeFilterArg(`it's 10:30, [ok]`), `it\\\'s 10\\:30\, \[ok\]`; is != want {
+		t.Fatalf("escaped is=%v want=%v", is, want)
+	}
+}
+
+func TestTeeSlave(t *testing.T) {
+	slave := teeSlave("hls", "/tmp/a|b.m3u8", []Option{Opt("hls_time", "2"), Opt("empty", ""), Opt("hls_segment_filename", `C:\live[1].ts`)})
+	if want := `[f=hls:hls_time=2:hls_segment_filename=C\\:\\\\live[1\\].ts]/tmp/a\|b.m3u8`; slave != want {
+		t.Fatalf("slave is=%v want=%v", slave, want)
+	}
+}
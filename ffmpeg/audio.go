@@ -0,0 +1,200 @@
+package ffmpeg
+
+import (
+	"fmt"
+
+	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/rtp"
+)
+
+// AAC-ELD sampling frequency indices (ISO/IEC 14496-3 1.6.3.4)
+var aacSamplingIndex = map[int]byte{
+	8000:  11,
+	16000: 8,
+	24000: 6,
+}
+
+// https://trac.ffmpeg.org/wiki/audio%20types
+func audioEncoder(param rtp.AudioParameters) *Encoder {
+	switch param.CodecType {
+	case rtp.AudioCodecType_PCMU:
+		return &Encoder{Codec: "pcm_mulaw"}
+	case rtp.AudioCodecType_PCMA:
+		return &Encoder{Codec: "pcm_alaw"}
+	case rtp.AudioCodecType_AAC_ELD:
+		// requires ffmpeg built with --enable-libfdk-aac
+		return &Encoder{Codec: "libfdk_aac", Options: []Option{
+			Opt("aprofile", "aac_eld"),
+			Opt("vbr", aacVariableBitrate(param)),
+		}}
+	case rtp.AudioCodecType_Opus:
+		return &Encoder{Codec: "libopus", Options: []Option{
+			Opt("application", "lowdelay"),
+			Opt("vbr", audioVariableBitrate(param)),
+			// HomeKit sends and expects packets of 20ms
+			Opt("frame_duration", "20"),
+		}}
+	case rtp.AudioCodecType_MSBC:
+		log.Debug.Println("audioCodec(MSBC) not supported")
+	case rtp.AudioCodecType_AMR:
+		// requires ffmpeg built with --enable-libopencore-amrnb
+		return &Encoder{Codec: "libopencore_amrnb"}
+	case rtp.AudioCodecType_ARM_WB:
+		// requires ffmpeg built with --enable-libvo-amrwbenc
+		return &Encoder{Codec: "libvo_amrwbenc"}
+	}
+
+	return nil
+}
+
+// audioDecoder returns the decoder of the audio coming from the controller.
+func audioDecoder(param rtp.AudioParameters) string {
+	switch param.CodecType {
+	case rtp.AudioCodecType_AAC_ELD:
+		return "libfdk_aac"
+	case rtp.AudioCodecType_AMR:
+		return "amrnb"
+	case rtp.AudioCodecType_ARM_WB:
+		return "amrwb"
+	}
+
+	if e := audioEncoder(param); e != nil {
+		return e.Codec
+	}
+
+	return ""
+}
+
+// audioVariableBitrate returns the value of the libopus vbr option; empty keeps the default.
+func audioVariableBitrate(param rtp.AudioParameters) string {
+	switch param.CodecParams.Bitrate {
+	case rtp.AudioCodecBitrateVariable:
+		return "on"
+	case rtp.AudioCodecBitrateConstant:
+		return "off"
+	default:
+		log.Info.Println("variableBitrate() undefined bitrate", param.CodecParams.Bitrate)
+		break
+	}
+
+	return ""
+}
+
+// aacVariableBitrate returns the value of the libfdk_aac vbr option: the lowest VBR mode,
+// which fits the bitrates negotiated by HomeKit, or 0 for the constant bitrate b:a;
+// empty keeps the default.
+func aacVariableBitrate(param rtp.AudioParameters) string {
+	switch audioVariableBitrate(param) {
+	case "on":
+		return "1"
+	case "off":
+		return "0"
+	}
+
+	return ""
+}
+
+// audioSampleRate returns the negotiated sample rate in Hz.
+// AMR and AMR-WB are only defined at 8kHz and 16kHz.
+func audioSampleRate(param rtp.AudioParameters) int {
+	switch param.CodecType {
+	case rtp.AudioCodecType_AMR:
+		return 8000
+	case rtp.AudioCodecType_ARM_WB:
+		return 16000
+	}
+
+	switch param.CodecParams.Samplerate {
+	case rtp.AudioCodecSampleRate8Khz:
+		return 8000
+	case rtp.AudioCodecSampleRate16Khz:
+		return 16000
+	case rtp.AudioCodecSampleRate24Khz:
+		return 24000
+	default:
+		log.Info.Println("audioSampleRate() undefined samplerate", param.CodecParams.Samplerate)
+		break
+	}
+
+	return 0
+}
+
+func audioSamplingRate(param rtp.AudioParameters) string {
+	if rate := audioSampleRate(param); rate > 0 {
+		return fmt.Sprintf("%dk", rate/1000)
+	}
+
+	return ""
+}
+
+// audioChannels returns the number of negotiated audio channels.
+func audioChannels(param rtp.AudioParameters) int {
+	if param.CodecParams.Channels == 0 {
+		return 1
+	}
+
+	return int(param.CodecParams.Channels)
+}
+
+// audioRTPMap returns the encoding and its parameters of the rtpmap attribute
+// and the format parameters of the fmtp attribute of the audio coming from the controller.
+func audioRTPMap(param rtp.AudioParameters) (string, string) {
+	rate := audioSampleRate(param)
+	channels := audioChannels(param)
+
+	switch param.CodecType {
+	case rtp.AudioCodecType_PCMU:
+		return fmt.Sprintf("PCMU/%d/%d", rate, channels), ""
+	case rtp.AudioCodecType_PCMA:
+		return fmt.Sprintf("PCMA/%d/%d", rate, channels), ""
+	case rtp.AudioCodecType_AAC_ELD:
+		return fmt.Sprintf("MPEG4-GENERIC/%d/%d", rate, channels),
+			"profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=" + aacEldConfig(rate, channels)
+	case rtp.AudioCodecType_Opus:
+		// RFC 7587: the clock rate is always 48kHz with two channels
+		return "opus/48000/2", ""
+	case rtp.AudioCodecType_AMR:
+		return fmt.Sprintf("AMR/%d/%d", rate, channels), "octet-align=1"
+	case rtp.AudioCodecType_ARM_WB:
+		return fmt.Sprintf("AMR-WB/%d/%d", rate, channels), "octet-align=1"
+	}
+
+	return "", ""
+}
+
+// aacEldConfig returns the hex encoded AudioSpecificConfig of the AAC-ELD audio of the controller.
+// The ELDSpecificConfig which follows sampling frequency and channels is the one sent by iOS.
+func aacEldConfig(rate int, channels int) string {
+	index, ok := aacSamplingIndex[rate]
+	if !ok {
+		index = aacSamplingIndex[16000]
+	}
+
+	// audio object type 39 (5 bits escape and 6 bits), 4 bits frequency index, 4 bits channels
+	b0 := byte(0xf8)
+	b1 := byte(0xe0) | index<<1 | byte(channels>>3)&0x01
+	b2 := byte(channels&0x07)<<5 | 0x01
+
+	return fmt.Sprintf("%02X%02X%02X2C00BC00", b0, b1, b2)
+}
+
+// playbackSDP describes the audio stream coming from the controller.
+func (s *stream) playbackSDP(audio rtp.AudioParameters) string {
+	pt := audio.RTP.PayloadType
+	rtpmap, fmtp := audioRTPMap(audio)
+
+	sdp := "v=0\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\n" +
+		"s=No Name\n" +
+		"c=IN IP4 127.0.0.1\n" +
+		"t=0 0\n" +
+		"a=tool:libavformat 58.29.100\n" +
+		fmt.Sprintf("m=audio %d RTP/AVP %d\n", s.rtpProxyPort2, pt) +
+		fmt.Sprintf("b=AS:%d\n", audio.RTP.Bitrate) +
+		fmt.Sprintf("a=rtpmap:%d %s\n", pt, rtpmap)
+	if fmtp != "" {
+		sdp += fmt.Sprintf("a=fmtp:%d %s\n", pt, fmtp)
+	}
+
+	return sdp + fmt.Sprintf("a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:%s", s.req.Audio.SrtpKey())
+}
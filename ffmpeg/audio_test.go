@@ -0,0 +1,99 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/rtp"
+)
+
+func TestAudioCodecs(t *testing.T) {
+	tests := []struct {
+		codec      byte
+		samplerate byte
+		encoder    string
+		decoder    string
+		rate       string
+		rtpmap     string
+	}{
+		{rtp.AudioCodecType_PCMU, rtp.AudioCodecSampleRate8Khz, "pcm_mulaw", "pcm_mulaw", "8k", "PCMU/8000/1"},
+		{rtp.AudioCodecType_PCMA, rtp.AudioCodecSampleRate16Khz, "pcm_alaw", "pcm_alaw", "16k", "PCMA/16000/1"},
+		{rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate24Khz, "libfdk_aac", "libfdk_aac", "24k", "MPEG4-GENERIC/24000/1"},
+		{rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate16Khz, "libopus", "libopus", "16k", "opus/48000/2"},
+		// AMR is defined at a single sample rate
+		{rtp.AudioCodecType_AMR, rtp.AudioCodecSampleRate16Khz, "libopencore_amrnb", "amrnb", "8k", "AMR/8000/1"},
+		{rtp.AudioCodecType_ARM_WB, rtp.AudioCodecSampleRate8Khz, "libvo_amrwbenc", "amrwb", "16k", "AMR-WB/16000/1"},
+	}
+	for _, test := range tests {
+		audio := testAudio(test.codec, test.samplerate)
+		if is := audioEncoder(audio); is == nil || is.Codec != test.encoder {
+			t.Fatalf("codec %d encoder is=%+v want=%v", test.codec, is, test.encoder)
+		}
+		if is := audioDecoder(audio); is != test.decoder {
+			t.Fatalf("codec %d decoder is=%v want=%v", test.codec, is, test.decoder)
+		}
+		if is := audioSamplingRate(audio); is != test.rate {
+			t.Fatalf("codec %d sampling rate is=%v want=%v", test.codec, is, test.rate)
+		}
+		if is, _ := audioRTPMap(audio); is != test.rtpmap {
+			t.Fatalf("codec %d rtpmap is=%v want=%v", test.codec, is, test.rtpmap)
+		}
+	}
+
+	if is := audioEncoder(testAudio(rtp.AudioCodecType_MSBC, rtp.AudioCodecSampleRate16Khz)); is != nil {
+		t.Fatalf("encoder of msbc is=%+v want=nil", is)
+	}
+}
+
+func TestAudioVariableBitrate(t *testing.T) {
+	audio := testAudio(rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate24Khz)
+	if is := audioEncoder(audio).args("a"); !strings.Contains(strings.Join(is, " "), "-vbr on") {
+		t.Fatalf("variable bitrate missing in %q", is)
+	}
+
+	audio.CodecParams.Bitrate = rtp.AudioCodecBitrateConstant
+	if is := audioEncoder(audio).args("a"); !strings.Contains(strings.Join(is, " "), "-vbr off") {
+		t.Fatalf("constant bitrate missing in %q", is)
+	}
+
+	audio = testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)
+	if is := audioEncoder(audio).args("a"); !strings.Contains(strings.Join(is, " "), "-vbr 1") {
+		t.Fatalf("variable bitrate missing in %q", is)
+	}
+
+	audio.CodecParams.Bitrate = rtp.AudioCodecBitrateConstant
+	s := testStream("linux", "h264_omx", "")
+	checkGolden(t, "stream_linux_aac-eld_constant_bitrate", s.captureCommand("linux", testVideo(), audio).Args())
+}
+
+func TestAacEldConfig(t *testing.T) {
+	tests := map[int]string{
+		8000:  "F8F6212C00BC00",
+		16000: "F8F0212C00BC00",
+		24000: "F8EC212C00BC00",
+	}
+	for rate, want := range tests {
+		if is := aacEldConfig(rate, 1); is != want {
+			t.Fatalf("config at %d is=%v want=%v", rate, is, want)
+		}
+	}
+}
+
+func TestPlaybackSDP(t *testing.T) {
+	codecs := []struct {
+		name       string
+		codec      byte
+		samplerate byte
+	}{
+		{"aac-eld", rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz},
+		{"opus", rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate24Khz},
+		{"pcmu", rtp.AudioCodecType_PCMU, rtp.AudioCodecSampleRate8Khz},
+		{"amr-wb", rtp.AudioCodecType_ARM_WB, rtp.AudioCodecSampleRate16Khz},
+	}
+	s := testStream("linux", "h264_omx", "")
+	for _, c := range codecs {
+		audio := testAudio(c.codec, c.samplerate)
+		audio.RTP.PayloadType = 101
+		checkGolden(t, "sdp_"+c.name, strings.Split(s.playbackSDP(audio), "\n"))
+	}
+}
@@ -1,5 +1,9 @@
 package ffmpeg
 
+import (
+	"time"
+)
+
 // Config contains ffmpeg parameters
 type Config struct {
 	VideoDevice      string
@@ -10,4 +14,69 @@ type Config struct {
 	H264Decoder      string
 	H264Encoder      string
 	MinVideoBitrate  int
+	// MaxRestarts is the number of consecutive failures after which
+	// an ffmpeg process is not restarted anymore; negative means forever
+	MaxRestarts int
+	// StderrLines is the number of stderr lines kept for every ffmpeg process;
+	// zero keeps 50 and negative disables the capture
+	StderrLines int
+	// SnapshotMaxAge is how long a captured frame is used for snapshots
+	SnapshotMaxAge time.Duration
+	// SnapshotRefresh is the interval at which a new frame is captured
+	// while the camera is idle; zero captures frames only on request
+	SnapshotRefresh time.Duration
+	// Overlay is drawn on streams and snapshots
+	Overlay Overlay
+	// PrivacyMasks are filled black on streams and snapshots before the overlay
+	PrivacyMasks []Polygon
+	// NightFramerate caps the framerate in night mode so that the camera
+	// may expose longer; zero keeps the requested framerate
+	NightFramerate int
+	// NightMinVideoBitrate replaces MinVideoBitrate in night mode
+	// since noisy night frames need more bits; zero keeps MinVideoBitrate
+	NightMinVideoBitrate int
+	// AudioProcessing cleans the microphone audio sent to the controller
+	AudioProcessing AudioProcessing
+	// LiveFramerate is the framerate of the MJPEG live view; zero uses 5
+	LiveFramerate int
+	// LiveVideoBitrate is the bitrate of the HLS live view in kbit/s; zero uses 1000
+	LiveVideoBitrate int
+	// LiveDir receives the HLS playlist and its segments; empty uses a temporary directory
+	LiveDir string
+	// MaxViewers limits the concurrent viewers of the MJPEG live view and of the intercom; zero is unlimited
+	MaxViewers int
+	// AdaptiveBitrate adapts the video of a stream to the packet loss reported by the controller
+	AdaptiveBitrate AdaptiveBitrate
+}
+
+// AudioProcessing describes the processing of the microphone audio.
+type AudioProcessing struct {
+	// EchoCancellation removes the audio played by the speaker from the
+	// microphone; it needs separate audio and video devices (linux)
+	EchoCancellation bool
+	// EchoTail is the longest echo which is cancelled after its estimated delay; zero uses 64ms
+	EchoTail time.Duration
+	// NoiseReduction is the noise reduction in dB; zero disables it
+	NoiseReduction int
+	// AutomaticGain normalizes the volume of the microphone
+	AutomaticGain bool
 }
+
+// AdaptiveBitrate describes how the video of a stream follows the reception reports of the controller.
+// The encoder cannot change its bitrate while running, therefore every change restarts the capture process.
+type AdaptiveBitrate struct {
+	Enabled bool
+	// MinBitrate is the lowest video bitrate in kbit/s; zero uses a quarter of the start bitrate
+	MinBitrate int
+	// MaxBitrate is the highest video bitrate in kbit/s; zero uses the start bitrate
+	MaxBitrate int
+	// MinFramerate is the lowest framerate once the bitrate is at MinBitrate; zero keeps the framerate
+	MinFramerate int
+	// Interval is the shortest time between two changes; zero uses 10s
+	Interval time.Duration
+}
+
+const (
+	defaultStderrLines    = 50
+	defaultSnapshotMaxAge = 10 * time.Second
+)
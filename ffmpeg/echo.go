@@ -0,0 +1,346 @@
+package ffmpeg
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// microphone and speaker audio are exchanged with the echo canceller
+// as signed 16 bit little endian mono samples at echoSampleRate
+const echoSampleRate = 16000
+
+const (
+	defaultEchoTail = 64 * time.Millisecond
+	// step size of the adaptive filter
+	echoStep = 0.2
+	// the reference is pulled back when it is ahead of the microphone by more than maxEchoLag
+	maxEchoLag = 500 * time.Millisecond
+	// longest delay between the reference and its echo in the microphone
+	maxEchoDelay = 500 * time.Millisecond
+	// the delay is estimated on the last echoEstimateWindow of audio, every echoEstimateWindow
+	echoEstimateWindow = 500 * time.Millisecond
+	// the delay is estimated on averages of echoDecimation samples
+	echoDecimation = 8
+	// the correlation between reference and microphone which reveals an echo
+	echoMinCorrelation = 0.3
+	// reference below this level in the estimation window is too quiet to estimate the delay
+	echoMinLevel = 100
+)
+
+// echoCanceller removes the audio played by the speaker from the microphone audio.
+// It is a normalized least mean squares adaptive filter which learns the echo path
+// between the reference (the audio sent to the speaker) and the microphone.
+//
+// Playback and microphone are separate processes with their own pipes, so the reference
+// is aligned with the microphone in two steps. The reference is placed on the timeline
+// of the microphone samples when it arrives: a pause of the controller audio becomes
+// silence and a reference which runs ahead, e.g. with a faster clock, is pulled back.
+// The delay of the echo on this timeline, the latencies of speaker and microphone,
+// is estimated from the cross-correlation of reference and microphone, and the filter
+// covers the echo tail which follows the delay.
+type echoCanceller struct {
+	// mutex guards the reference timeline; the filtering does not hold it
+	mutex sync.Mutex
+	// ref holds the reference at the positions of the microphone samples,
+	// the sample at position p in ref[p % len(ref)]
+	ref []int16
+	// refEnd follows the last reference sample; micPos is the position of the next microphone sample
+	refEnd     int64
+	micPos     int64
+	maxLag     int
+	refPartial []byte
+
+	// filterMutex guards the filter, which only the microphone writes use
+	filterMutex sync.Mutex
+	// weights of the filter, one per sample of the echo tail, the oldest sample first
+	weights []float64
+	// delay is the estimated delay of the echo in samples
+	delay    int
+	maxDelay int
+	// mic keeps the last estimation window of the microphone, the sample at position p in mic[p % len(mic)]
+	mic []int16
+	// sinceEstimate counts the microphone samples since the last estimation of the delay
+	sinceEstimate int
+	micPartial    []byte
+
+	out io.Writer
+}
+
+// newEchoCanceller returns a canceller which writes the cleaned microphone audio to out.
+func newEchoCanceller(tail time.Duration, out io.Writer) *echoCanceller {
+	if tail <= 0 {
+		tail = defaultEchoTail
+	}
+	taps := int(tail.Seconds() * echoSampleRate)
+	maxLag := int(maxEchoLag.Seconds() * echoSampleRate)
+	maxDelay := int(maxEchoDelay.Seconds() * echoSampleRate)
+	window := int(echoEstimateWindow.Seconds() * echoSampleRate)
+
+	return &echoCanceller{
+		// the oldest reference used by the estimation and the newest one ahead of the microphone
+		ref:      make([]int16, window+maxDelay+taps+maxLag),
+		maxLag:   maxLag,
+		weights:  make([]float64, taps),
+		maxDelay: maxDelay,
+		mic:      make([]int16, window),
+		out:      out,
+	}
+}
+
+// referenceWriter returns the writer which receives the audio sent to the speaker.
+func (e *echoCanceller) referenceWriter() io.Writer {
+	return writerFunc(e.writeReference)
+}
+
+func (e *echoCanceller) writeReference(p []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var samples []int16
+	e.refPartial, samples = decodeSamples(e.refPartial, p)
+	if len(samples) > e.maxLag {
+		samples = samples[len(samples)-e.maxLag:]
+	}
+
+	// the reference which follows a pause is played from now on
+	start := e.refEnd
+	if start < e.micPos {
+		e.clearReference(start, e.micPos)
+		start = e.micPos
+	}
+	// the reference is at most maxLag ahead of the microphone
+	if limit := e.micPos + int64(e.maxLag-len(samples)); start > limit {
+		start = limit
+	}
+
+	n := int64(len(e.ref))
+	for i, s := range samples {
+		e.ref[(start+int64(i))%n] = s
+	}
+	e.refEnd = start + int64(len(samples))
+
+	return len(p), nil
+}
+
+// clearReference silences the reference at the positions [from, to). The caller must hold the mutex.
+func (e *echoCanceller) clearReference(from, to int64) {
+	n := int64(len(e.ref))
+	if to-from > n {
+		from = to - n
+	}
+	for p := from; p < to; p++ {
+		e.ref[p%n] = 0
+	}
+}
+
+// reference returns the reference at the positions [from, from+count);
+// silence where it has not arrived or has been overwritten. The caller must hold the mutex.
+func (e *echoCanceller) reference(from int64, count int) []float64 {
+	out := make([]float64, count)
+	n := int64(len(e.ref))
+	for i := range out {
+		p := from + int64(i)
+		if p >= 0 && p < e.refEnd && p >= e.refEnd-n {
+			out[i] = float64(e.ref[p%n])
+		}
+	}
+
+	return out
+}
+
+// Write receives the microphone audio and writes it without echo to out.
+func (e *echoCanceller) Write(p []byte) (int, error) {
+	e.filterMutex.Lock()
+	defer e.filterMutex.Unlock()
+
+	var samples []int16
+	e.micPartial, samples = decodeSamples(e.micPartial, p)
+	if len(samples) == 0 {
+		return len(p), nil
+	}
+
+	taps := len(e.weights)
+	window := len(e.mic)
+	e.sinceEstimate += len(samples)
+	estimate := e.sinceEstimate >= window
+
+	// only the reference is copied under the mutex; the playback keeps writing meanwhile
+	e.mutex.Lock()
+	pos := e.micPos
+	e.micPos += int64(len(samples))
+	from := pos - int64(e.offset()) - int64(taps-1)
+	ref := e.reference(from, len(samples)+taps-1)
+	var estimation []float64
+	if estimate {
+		end := pos + int64(len(samples))
+		estimation = e.reference(end-int64(window+e.maxDelay), window+e.maxDelay)
+	}
+	e.mutex.Unlock()
+
+	for i, s := range samples {
+		e.mic[(pos+int64(i))%int64(window)] = s
+	}
+
+	buf := make([]byte, 2*len(samples))
+	e.filter(samples, ref, buf)
+	if _, err := e.out.Write(buf); err != nil {
+		return 0, err
+	}
+
+	if estimate {
+		e.sinceEstimate = 0
+		e.estimateDelay(pos+int64(len(samples)), estimation)
+	}
+
+	return len(p), nil
+}
+
+// offset returns how far the filter window trails the microphone: the delay
+// without a margin for the echo which the estimation places too late.
+func (e *echoCanceller) offset() int {
+	if margin := len(e.weights) / 8; e.delay > margin {
+		return e.delay - margin
+	}
+
+	return 0
+}
+
+// filter writes the microphone samples without the estimated echo to buf.
+// ref is the reference of the filter window of the first sample followed
+// by the reference of the other samples. Without reference the speaker is silent.
+func (e *echoCanceller) filter(mic []int16, ref []float64, buf []byte) {
+	taps := len(e.weights)
+
+	var energy float64
+	for _, x := range ref[:taps] {
+		energy += x * x
+	}
+
+	for i, s := range mic {
+		window := ref[i : i+taps]
+		if i > 0 {
+			oldest, newest := ref[i-1], window[taps-1]
+			energy += newest*newest - oldest*oldest
+			if energy < 0 {
+				energy = 0
+			}
+		}
+
+		// estimated echo
+		var echo float64
+		for j, w := range e.weights {
+			echo += w * window[j]
+		}
+		err := float64(s) - echo
+
+		if energy > 0 {
+			step := echoStep * err / (energy + 1)
+			for j, x := range window {
+				e.weights[j] += step * x
+			}
+		}
+
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(clip16(err)))
+	}
+}
+
+// estimateDelay estimates the delay of the echo from the microphone before the position end
+// and the reference before it, which starts maxDelay earlier. The filter restarts when the
+// delay moves out of its margin.
+func (e *echoCanceller) estimateDelay(end int64, ref []float64) {
+	window := len(e.mic)
+	mic := make([]float64, window)
+	for i := range mic {
+		mic[i] = float64(e.mic[(end-int64(window)+int64(i))%int64(window)])
+	}
+
+	m := decimate(mic)
+	r := decimate(ref)
+	lags := len(r) - len(m)
+
+	var micEnergy float64
+	for _, x := range m {
+		micEnergy += x * x
+	}
+	var refEnergy float64
+	for _, x := range r[lags:] {
+		refEnergy += x * x
+	}
+	if refEnergy/float64(len(m)) < echoMinLevel*echoMinLevel/echoDecimation || micEnergy == 0 {
+		return
+	}
+
+	// the reference at lag l is the one which was played l samples before the microphone
+	best, bestLag := echoMinCorrelation, -1
+	for l := 0; l <= lags; l++ {
+		x := r[lags-l : lags-l+len(m)]
+		var corr, energy float64
+		for i, v := range m {
+			corr += v * x[i]
+			energy += x[i] * x[i]
+		}
+		if energy == 0 {
+			continue
+		}
+		if c := corr / math.Sqrt(micEnergy*energy); c > best {
+			best, bestLag = c, l
+		}
+	}
+	if bestLag < 0 {
+		return
+	}
+
+	delay := bestLag * echoDecimation
+	if margin := len(e.weights) / 8; delay < e.delay-margin || delay > e.delay+margin {
+		e.delay = delay
+		for i := range e.weights {
+			e.weights[i] = 0
+		}
+	}
+}
+
+// decimate returns the averages of echoDecimation samples of x.
+func decimate(x []float64) []float64 {
+	out := make([]float64, len(x)/echoDecimation)
+	for i := range out {
+		var sum float64
+		for _, v := range x[i*echoDecimation : (i+1)*echoDecimation] {
+			sum += v
+		}
+		out[i] = sum / echoDecimation
+	}
+
+	return out
+}
+
+// decodeSamples returns the samples of partial followed by p
+// and the bytes left over for the next call.
+func decodeSamples(partial, p []byte) ([]byte, []int16) {
+	buf := append(partial, p...)
+	samples := make([]int16, len(buf)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(buf[2*i:]))
+	}
+
+	return append([]byte{}, buf[2*len(samples):]...), samples
+}
+
+func clip16(v float64) int16 {
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	}
+
+	return int16(math.Round(v))
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
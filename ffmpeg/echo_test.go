@@ -0,0 +1,140 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func encodeSamples(samples []int16) []byte {
+	buf := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(buf[2*i:], uint16(s))
+	}
+
+	return buf
+}
+
+func energy(samples []int16) float64 {
+	var e float64
+	for _, s := range samples {
+		e += float64(s) * float64(s)
+	}
+
+	return e
+}
+
+func TestEchoCanceller(t *testing.T) {
+	var out bytes.Buffer
+	e := newEchoCanceller(4*time.Millisecond, &out)
+
+	// the microphone picks up the speaker attenuated and delayed by 20 samples
+	rnd := rand.New(rand.NewSource(1))
+	const block, blocks, delay = 160, 100, 20
+	ref := make([]int16, block*blocks)
+	mic := make([]int16, len(ref))
+	for i := range ref {
+		ref[i] = int16(rnd.Intn(16000) - 8000)
+		if i >= delay {
+			mic[i] = ref[i-delay] / 2
+		}
+	}
+
+	for i := 0; i < blocks; i++ {
+		e.referenceWriter().Write(encodeSamples(ref[i*block : (i+1)*block]))
+		// split a sample between two writes
+		b := encodeSamples(mic[i*block : (i+1)*block])
+		e.Write(b[:3])
+		e.Write(b[3:])
+	}
+
+	if is, want := out.Len(), 2*len(mic); is != want {
+		t.Fatalf("output is=%v want=%v", is, want)
+	}
+	_, cleaned := decodeSamples(nil, out.Bytes())
+
+	// after the filter has converged the echo is at least 20 dB lower
+	last := len(mic) - 10*block
+	if in, out := energy(mic[last:]), energy(cleaned[last:]); out > in/100 {
+		t.Fatalf("echo energy is=%v want<%v", out, in/100)
+	}
+}
+
+func TestEchoCancellerWithoutReference(t *testing.T) {
+	var out bytes.Buffer
+	e := newEchoCanceller(0, &out)
+
+	mic := []int16{100, -200, 300, 32767, -32768}
+	e.Write(encodeSamples(mic))
+
+	if is, want := out.Bytes(), encodeSamples(mic); !bytes.Equal(is, want) {
+		t.Fatalf("output is=%v want=%v", is, want)
+	}
+}
+
+func TestEchoCancellerEstimatesDelay(t *testing.T) {
+	var out bytes.Buffer
+	e := newEchoCanceller(4*time.Millisecond, &out)
+
+	// the echo comes 200ms after the reference, far beyond the tail of the filter,
+	// and the playback writes the reference in bursts of three microphone blocks
+	rnd := rand.New(rand.NewSource(1))
+	const block, blocks, delay = 160, 300, 3200
+	ref := make([]int16, block*blocks)
+	mic := make([]int16, len(ref))
+	for i := range ref {
+		ref[i] = int16(rnd.Intn(16000) - 8000)
+		if i >= delay {
+			mic[i] = ref[i-delay] / 2
+		}
+	}
+
+	for i := 0; i < blocks; i++ {
+		if i%3 == 0 {
+			e.referenceWriter().Write(encodeSamples(ref[i*block : (i+3)*block]))
+		}
+		e.Write(encodeSamples(mic[i*block : (i+1)*block]))
+	}
+
+	if is, want := e.delay, delay; is < want-echoDecimation || is > want+echoDecimation {
+		t.Fatalf("delay is=%v want=%v", is, want)
+	}
+
+	_, cleaned := decodeSamples(nil, out.Bytes())
+	last := len(mic) - 10*block
+	if in, out := energy(mic[last:]), energy(cleaned[last:]); out > in/100 {
+		t.Fatalf("echo energy is=%v want<%v", out, in/100)
+	}
+}
+
+func TestEchoCancellerReferenceDuringFilter(t *testing.T) {
+	e := newEchoCanceller(0, &bytes.Buffer{})
+
+	// the playback keeps writing while the microphone filters
+	e.filterMutex.Lock()
+	defer e.filterMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.referenceWriter().Write(make([]byte, 320))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reference waits for the filter")
+	}
+}
+
+func TestEchoCancellerPullsBackReference(t *testing.T) {
+	e := newEchoCanceller(0, &bytes.Buffer{})
+	e.referenceWriter().Write(make([]byte, 4*e.maxLag))
+	e.referenceWriter().Write(make([]byte, 320))
+
+	if is, want := e.refEnd-e.micPos, int64(e.maxLag); is != want {
+		t.Fatalf("lead is=%v want=%v", is, want)
+	}
+}
@@ -0,0 +1,406 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+)
+
+// Call describes one invocation of an FFMPEG method on a Fake.
+type Call struct {
+	Method   string
+	ID       StreamID
+	Video    rtp.VideoParameters
+	Audio    rtp.AudioParameters
+	Width    uint
+	Height   uint
+	Night    bool
+	File     string
+	Volume   float64
+	Duration time.Duration
+}
+
+// Fake is an in-memory FFMPEG implementation which records every call.
+// It never starts a process and is meant to be used in tests.
+type Fake struct {
+	// Image is returned by Snapshot
+	Image image.Image
+	// Processes is reported by Status for every started stream
+	Processes []ProcessStatus
+	// errors returned by the corresponding methods
+	StartErr       error
+	ReconfigureErr error
+	SnapshotErr    error
+	PlaySoundErr   error
+	RecordErr      error
+	IntercomErr    error
+	// Night is the last mode set with SetNightMode
+	Night bool
+	// Viewers is the number of viewers added and not removed
+	Viewers int
+	// LiveDir is returned by WatchHLS
+	LiveDir string
+	// Speaker receives the packets written to the intercom
+	Speaker [][]byte
+	// Session is reported by Stats for every started stream
+	// and passed to the OnSessionEnd function when it stops
+	Session SessionStats
+
+	mutex      sync.Mutex
+	calls      []Call
+	streams    map[StreamID]bool
+	sessionEnd func(SessionStats)
+}
+
+var _ FFMPEG = &Fake{}
+
+// NewFake returns a Fake without streams.
+func NewFake() *Fake {
+	return &Fake{
+		streams: make(map[StreamID]bool, 0),
+	}
+}
+
+// Calls returns a copy of the recorded calls in invocation order.
+func (f *Fake) Calls() []Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	calls := make([]Call, len(f.calls))
+	copy(calls, f.calls)
+
+	return calls
+}
+
+// Methods returns the names of the recorded calls in invocation order.
+func (f *Fake) Methods() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	methods := make([]string, len(f.calls))
+	for i, c := range f.calls {
+		methods[i] = c.Method
+	}
+
+	return methods
+}
+
+// Running returns true if the stream has been started and not stopped.
+func (f *Fake) Running(id StreamID) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.streams[id]
+}
+
+func (f *Fake) record(c Call) {
+	f.calls = append(f.calls, c)
+}
+
+func (f *Fake) PrepareNewStream(req rtp.SetupEndpoints, resp rtp.SetupEndpointsResponse) StreamID {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	id := StreamID(req.SessionId)
+	f.record(Call{Method: "PrepareNewStream", ID: id})
+	f.streams[id] = false
+
+	return id
+}
+
+func (f *Fake) Start(id StreamID, video rtp.VideoParameters, audio rtp.AudioParameters) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Start", ID: id, Video: video, Audio: audio})
+	if _, ok := f.streams[id]; !ok {
+		return &StreamNotFoundError{id}
+	}
+	if f.StartErr != nil {
+		return f.StartErr
+	}
+	f.streams[id] = true
+
+	return nil
+}
+
+func (f *Fake) Stop(id StreamID) {
+	f.mutex.Lock()
+	f.record(Call{Method: "Stop", ID: id})
+	running := f.streams[id]
+	delete(f.streams, id)
+	st := f.Session
+	st.ID = id
+	sessionEnd := f.sessionEnd
+	f.mutex.Unlock()
+
+	if running && sessionEnd != nil {
+		sessionEnd(st)
+	}
+}
+
+// Shutdown stops every stream like Stop.
+func (f *Fake) Shutdown(ctx context.Context) error {
+	f.mutex.Lock()
+	f.record(Call{Method: "Shutdown"})
+	var ids []StreamID
+	for id := range f.streams {
+		ids = append(ids, id)
+	}
+	f.mutex.Unlock()
+
+	for _, id := range ids {
+		f.Stop(id)
+	}
+
+	return nil
+}
+
+func (f *Fake) Suspend(id StreamID) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Suspend", ID: id})
+}
+
+func (f *Fake) Resume(id StreamID) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Resume", ID: id})
+}
+
+func (f *Fake) ActiveStreams() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.streams)
+}
+
+func (f *Fake) Reconfigure(id StreamID, video rtp.VideoParameters, audio rtp.AudioParameters) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Reconfigure", ID: id, Video: video, Audio: audio})
+	if _, ok := f.streams[id]; !ok {
+		return &StreamNotFoundError{id}
+	}
+
+	return f.ReconfigureErr
+}
+
+func (f *Fake) Snapshot(width, height uint) (*image.Image, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Snapshot", Width: width, Height: height})
+	if f.SnapshotErr != nil {
+		return nil, f.SnapshotErr
+	}
+	if f.Image == nil {
+		return nil, nil
+	}
+	img := f.Image
+
+	return &img, nil
+}
+
+func (f *Fake) Status() []StreamStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var st []StreamStatus
+	for id, running := range f.streams {
+		if running {
+			st = append(st, StreamStatus{id, f.Processes})
+		}
+	}
+
+	return st
+}
+
+func (f *Fake) MaskPreview() (*image.Image, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "MaskPreview"})
+	if f.SnapshotErr != nil {
+		return nil, f.SnapshotErr
+	}
+	if f.Image == nil {
+		return nil, nil
+	}
+	img := f.Image
+
+	return &img, nil
+}
+
+func (f *Fake) SetNightMode(night bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "SetNightMode", Night: night})
+	f.Night = night
+}
+
+func (f *Fake) PlaySound(file string, volume float64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "PlaySound", File: file, Volume: volume})
+	for _, running := range f.streams {
+		if running {
+			return ErrAudioBusy
+		}
+	}
+
+	return f.PlaySoundErr
+}
+
+func (f *Fake) MixSound(file string, volume float64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "MixSound", File: file, Volume: volume})
+
+	return f.PlaySoundErr
+}
+
+func (f *Fake) Record(file string, d time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "Record", File: file, Duration: d})
+
+	return f.RecordErr
+}
+
+func (f *Fake) AddViewer() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "AddViewer"})
+	if f.SnapshotErr != nil {
+		return f.SnapshotErr
+	}
+	f.Viewers++
+
+	return nil
+}
+
+func (f *Fake) RemoveViewer() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "RemoveViewer"})
+	f.Viewers--
+}
+
+// LiveFrame returns Image encoded as jpeg as the frame which follows after.
+func (f *Fake) LiveFrame(after uint64, timeout time.Duration) ([]byte, uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.SnapshotErr != nil {
+		return nil, after, f.SnapshotErr
+	}
+	if f.Image == nil {
+		return nil, after, ErrNoLiveView
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, f.Image, nil); err != nil {
+		return nil, after, err
+	}
+
+	return buf.Bytes(), after + 1, nil
+}
+
+// WatchLiveVideo never passes a packet to fn.
+func (f *Fake) WatchLiveVideo(fn func(pkt []byte)) (func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "WatchLiveVideo"})
+	if f.SnapshotErr != nil {
+		return nil, f.SnapshotErr
+	}
+
+	return func() {}, nil
+}
+
+// StartIntercom returns an intercom which appends the written packets to Speaker.
+func (f *Fake) StartIntercom(microphone func(pkt []byte)) (io.WriteCloser, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "StartIntercom"})
+	if f.IntercomErr != nil {
+		return nil, f.IntercomErr
+	}
+
+	return fakeIntercom{f}, nil
+}
+
+type fakeIntercom struct {
+	f *Fake
+}
+
+func (i fakeIntercom) Write(pkt []byte) (int, error) {
+	i.f.mutex.Lock()
+	defer i.f.mutex.Unlock()
+
+	i.f.Speaker = append(i.f.Speaker, append([]byte{}, pkt...))
+
+	return len(pkt), nil
+}
+
+func (i fakeIntercom) Close() error {
+	i.f.mutex.Lock()
+	defer i.f.mutex.Unlock()
+
+	i.f.record(Call{Method: "CloseIntercom"})
+
+	return nil
+}
+
+func (f *Fake) WatchHLS() (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record(Call{Method: "WatchHLS"})
+	if f.SnapshotErr != nil {
+		return "", f.SnapshotErr
+	}
+
+	return f.LiveDir, nil
+}
+
+func (f *Fake) Stats() []SessionStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var st []SessionStats
+	for id, running := range f.streams {
+		if running {
+			s := f.Session
+			s.ID = id
+			st = append(st, s)
+		}
+	}
+
+	return st
+}
+
+func (f *Fake) OnSessionEnd(fn func(SessionStats)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.sessionEnd = fn
+}
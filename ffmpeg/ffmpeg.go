@@ -1,18 +1,20 @@
 package ffmpeg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/brutella/hc/log"
 	"github.com/brutella/hc/rtp"
-
-	"github.com/patrickmn/go-cache"
 )
 
 // StreamID is the type of the stream identifier
@@ -28,6 +30,56 @@ type FFMPEG interface {
 	ActiveStreams() int
 	Reconfigure(StreamID, rtp.VideoParameters, rtp.AudioParameters) error
 	Snapshot(width, height uint) (*image.Image, error)
+	Status() []StreamStatus
+	// MaskPreview returns a frame with the outlines of the privacy masks.
+	MaskPreview() (*image.Image, error)
+	// SetNightMode switches streams and snapshots between day and night settings.
+	SetNightMode(night bool)
+	// PlaySound plays a sound file on the audio output while no stream uses it.
+	PlaySound(file string, volume float64) error
+	// MixSound plays a sound file on the audio output; during a stream
+	// it is mixed into the audio coming from the controller.
+	MixSound(file string, volume float64) error
+	// AddViewer starts the live view for a viewer of the MJPEG stream or of the intercom; RemoveViewer removes it.
+	AddViewer() error
+	RemoveViewer()
+	// LiveFrame returns the jpeg frame of the live view which follows the frame with sequence number after.
+	LiveFrame(after uint64, timeout time.Duration) ([]byte, uint64, error)
+	// WatchLiveVideo passes the H.264 RTP packets of the live view to fn until the returned function is called.
+	WatchLiveVideo(fn func(pkt []byte)) (func(), error)
+	// StartIntercom starts the two-way Opus audio with a viewer of the live view.
+	StartIntercom(microphone func(pkt []byte)) (io.WriteCloser, error)
+	// Record records the live view for a while into an mp4 file and waits for the end.
+	Record(file string, d time.Duration) error
+	// WatchHLS keeps the live view running for a while and returns the directory of its HLS playlist.
+	WatchHLS() (string, error)
+	// Stats returns the statistics of the running stream sessions.
+	Stats() []SessionStats
+	// OnSessionEnd sets the function which receives the statistics of every stream session when it ends.
+	OnSessionEnd(fn func(SessionStats))
+	// Shutdown stops every stream, the live view and the sounds; no stream starts afterwards.
+	// It returns the error of ctx if ctx is done before.
+	Shutdown(ctx context.Context) error
+}
+
+// ErrShutdown is returned by the methods which start a process after Shutdown.
+var ErrShutdown = errors.New("ffmpeg is shut down")
+
+// StreamStatus describes the health of the processes of a stream.
+type StreamStatus struct {
+	ID        StreamID
+	Processes []ProcessStatus
+}
+
+// Healthy returns true if every process of the stream is healthy.
+func (s StreamStatus) Healthy() bool {
+	for _, p := range s.Processes {
+		if !p.Healthy() {
+			return false
+		}
+	}
+
+	return true
 }
 
 var Stdout = ioutil.Discard
@@ -44,19 +96,56 @@ type ffmpeg struct {
 	mutex      *sync.Mutex
 	streams    map[StreamID]*stream
 	rtpProxies map[StreamID]*rtpProxy
-	snapCache  *cache.Cache
+	frames     *frameCache
+	// mask is nil without privacy masks
+	mask *privacyMask
+	// overlay and env are shared by every ffmpeg process which captures video
+	overlay FilterChain
+	env     []string
+	// night is true while the camera is in night mode
+	night bool
+	// sound is playing on the audio output
+	sound *sound
+	// intercom holds the audio output and the microphone for a viewer of the live view
+	intercom *intercom
+	// live feeds the live view endpoints while no stream uses the camera
+	live liveView
+	// starting counts the streams which wait for the live view and the sound to stop
+	starting int
+	// sessionEnd receives the statistics of the ended sessions; it may be nil
+	sessionEnd func(SessionStats)
+	// ctx is cancelled by Shutdown; the proxies and the snapshot refresh stop with it
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // New returns a new ffmpeg handle to start and stop video streams and to make snapshots.
 func New(cfg Config) *ffmpeg {
-	return &ffmpeg{
+	f := &ffmpeg{
 		cfg:        cfg,
 		mutex:      &sync.Mutex{},
 		streams:    make(map[StreamID]*stream, 0),
 		rtpProxies: make(map[StreamID]*rtpProxy, 0),
-		// how many milliseconds that the snapshot will be cached
-		snapCache: cache.New(10000*time.Millisecond, 10000*time.Millisecond),
+		mask:       newPrivacyMask(cfg.PrivacyMasks),
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+	f.frames = newFrameCache(f.snapshotMaxAge(), f.captureFrame)
+
+	if cfg.Overlay.Enabled() {
+		var err error
+		if f.overlay, err = cfg.Overlay.Filters(); err != nil {
+			log.Info.Println("overlay disabled:", err)
+		} else if f.env, err = cfg.Overlay.Env(); err != nil {
+			log.Info.Println("overlay disabled:", err)
+			f.overlay = nil
+		}
+	}
+
+	if cfg.SnapshotRefresh > 0 {
+		go f.refreshSnapshots(cfg.SnapshotRefresh)
 	}
+
+	return f
 }
 
 func (f *ffmpeg) PrepareNewStream(req rtp.SetupEndpoints, resp rtp.SetupEndpointsResponse) StreamID {
@@ -68,15 +157,60 @@ func (f *ffmpeg) PrepareNewStream(req rtp.SetupEndpoints, resp rtp.SetupEndpoint
 	// TODO check if they are different for every other stream
 	rtpp1 := uint16(rand.Intn(1000) + 3000)
 	rtpp2 := uint16(rand.Intn(1000) + 4000)
+	rtpp3 := uint16(rand.Intn(1000) + 5000)
+	rtpp4 := uint16(rand.Intn(1000) + 6000)
+	rtpp5 := uint16(rand.Intn(1000) + 7000)
 
 	id := StreamID(req.SessionId)
-	s := &stream{f.videoInputDevice(), f.videoInputFilename(), f.audioDevice(), f.audioInputName(), f.audioOutputName(),
-		f.cfg.H264Decoder, f.cfg.H264Encoder, f.cfg.MinVideoBitrate, req, resp, nil, nil, rtpp1, rtpp2}
+	s := &stream{
+		videoDevice:     f.videoInputDevice(),
+		videoFilename:   f.videoInputFilename(),
+		audioDevice:     f.audioDevice(),
+		audioInputName:  f.audioInputName(),
+		audioOutputName: f.audioOutputName(),
+		h264Decoder:     f.cfg.H264Decoder,
+		h264Encoder:     f.cfg.H264Encoder,
+		minVideoBitrate: f.cfg.MinVideoBitrate,
+		nightFramerate:  f.cfg.NightFramerate,
+		nightMinBitrate: f.cfg.NightMinVideoBitrate,
+		req:             req,
+		resp:            resp,
+		rtpProxyPort1:   rtpp1,
+		rtpProxyPort2:   rtpp2,
+		rtpProxyPort3:   rtpp3,
+		rtpProxyPort4:   rtpp4,
+		rtpProxyPort5:   rtpp5,
+		audioProcessing: f.cfg.AudioProcessing,
+		adaptive:        f.cfg.AdaptiveBitrate,
+		maxRestarts:     f.cfg.MaxRestarts,
+		stderrLines:     f.stderrLines(),
+		filters:         f.overlay,
+		env:             f.env,
+	}
 	f.streams[id] = s
 
-	c := &rtpProxy{false, req.ControllerAddr.IPAddr, req.ControllerAddr.AudioRtpPort, rtpp1, rtpp2}
+	c := &rtpProxy{
+		controllerIPAddr: req.ControllerAddr.IPAddr,
+		bindPort:         req.ControllerAddr.AudioRtpPort,
+		localRTPPort1:    rtpp1,
+		localRTPPort2:    rtpp2,
+		srtpPort:         rtpp4,
+		crypto:           req.Audio,
+	}
 	f.rtpProxies[id] = c
 
+	// the video passes the proxy too so that we can count its packets and read the reception reports
+	s.videoProxy = &rtpProxy{
+		controllerIPAddr: req.ControllerAddr.IPAddr,
+		bindPort:         req.ControllerAddr.VideoRtpPort,
+		localRTPPort1:    rtpp3,
+		srtpPort:         rtpp5,
+		crypto:           req.Video,
+		receive: func(packet []byte) {
+			f.receiveRTCP(id, packet)
+		},
+	}
+
 	return id
 }
 
@@ -88,48 +222,192 @@ func (f *ffmpeg) ActiveStreams() int {
 }
 
 func (f *ffmpeg) Start(id StreamID, video rtp.VideoParameters, audio rtp.AudioParameters) error {
+	size, err := f.probeSize()
+	if err != nil {
+		log.Info.Println("start: privacy mask:", err)
+		return err
+	}
+
+	// the stream needs the audio output and the camera; in the meantime
+	// starting keeps the live view, the sounds and the intercom from starting again
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
+	f.starting++
+	snd, live, ic := f.detachSound(), f.detachLive(), f.detachIntercom()
+	f.mutex.Unlock()
+
+	// the processes and the proxies are stopped without the mutex, see Stop
+	snd.stop()
+	live.stop()
+	ic.stop()
+
+	f.mutex.Lock()
+	f.starting--
+	started, err := f.start(id, size, video, audio)
+	if err != nil && !f.streaming() {
+		f.resumeLive()
+	}
+	f.mutex.Unlock()
+
+	if err != nil {
+		for _, p := range started {
+			p.stop()
+		}
+	}
+
+	return err
+}
+
+// start starts the stream with id; on failure it returns the started proxies
+// which the caller must stop. It must be called with the mutex held.
+func (f *ffmpeg) start(id StreamID, size image.Point, video rtp.VideoParameters, audio rtp.AudioParameters) ([]*rtpProxy, error) {
+	if f.ctx.Err() != nil {
+		return nil, ErrShutdown
+	}
 
 	s, err := f.getStream(id)
 	if err != nil {
 		log.Info.Println("start:", err)
-		return err
+		return nil, err
+	}
+
+	filters, err := f.videoFilters(size, f.night)
+	if err != nil {
+		log.Info.Println("start: privacy mask:", err)
+		return nil, err
 	}
+	s.filters = filters
+	s.videoSize = size
+	s.night = f.night
 
 	c, err := f.getRtpProxy(id)
 	if err != nil {
 		log.Info.Println("start:", err)
-		return err
+		return nil, err
 	}
 
-	// we use goroutine to run the threaded RTP proxy
-	go c.start()
+	// the proxies forward the packets in the background until the stream stops
+	if err := c.start(f.ctx); err != nil {
+		log.Info.Println("start: audio proxy:", err)
+		return nil, err
+	}
+	if err := s.videoProxy.start(f.ctx); err != nil {
+		log.Info.Println("start: video proxy:", err)
+		return []*rtpProxy{c}, err
+	}
 
 	// run the stream
-	return s.start(video, audio)
+	if err := s.start(video, audio); err != nil {
+		return []*rtpProxy{c, s.videoProxy}, err
+	}
+
+	return nil, nil
 }
 
+// Stop stops the stream with id and passes the statistics of the session
+// to the function set with OnSessionEnd if the stream was started.
 func (f *ffmpeg) Stop(id StreamID) {
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
+	s, c, st, err := f.detach(id)
+	sessionEnd := f.sessionEnd
+	f.mutex.Unlock()
 
-	s, err := f.getStream(id)
 	if err != nil {
 		log.Info.Println("stop:", err)
 		return
 	}
 
+	// the proxies and the processes are stopped without the mutex: the video proxy
+	// may be waiting for it to pass a reception report and a process may take seconds to exit
+	c.stop()
+	s.videoProxy.stop()
+	s.stop()
+
+	f.mutex.Lock()
+	if !f.streaming() {
+		f.resumeLive()
+	}
+	f.mutex.Unlock()
+
+	// a stream which was prepared but never started has no session
+	if st.Started.IsZero() {
+		return
+	}
+	log.Info.Printf("session ended after %s: %d video packets, %.0fk, %.1f fps, %.0f%% loss",
+		st.Duration, st.VideoPackets, st.Bitrate, st.Framerate, st.Loss*100)
+	if sessionEnd != nil {
+		sessionEnd(st)
+	}
+}
+
+// Shutdown stops every stream like Stop, the live view, the sounds and the intercom.
+func (f *ffmpeg) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		f.mutex.Lock()
+		f.cancel()
+		ids := make([]StreamID, 0, len(f.streams))
+		for id := range f.streams {
+			ids = append(ids, id)
+		}
+		f.mutex.Unlock()
+
+		for _, id := range ids {
+			f.Stop(id)
+		}
+
+		f.mutex.Lock()
+		if f.live.hlsTimer != nil {
+			f.live.hlsTimer.Stop()
+			f.live.hlsTimer = nil
+		}
+		f.live.viewers = 0
+		f.live.hlsUntil = time.Time{}
+		live, snd, ic := f.detachLive(), f.detachSound(), f.detachIntercom()
+		video := f.live.video
+		f.live.video = nil
+		f.mutex.Unlock()
+
+		live.stop()
+		snd.stop()
+		ic.stop()
+		if video != nil {
+			video.close()
+		}
+		// no process draws the mask anymore
+		f.mask.removeFiles()
+	}()
+
+	select {
+	case <-done:
+		log.Debug.Println("ffmpeg shut down")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detach removes the stream with id and returns it with its audio proxy and the
+// statistics of its session; the caller stops them. It must be called with the mutex held.
+func (f *ffmpeg) detach(id StreamID) (*stream, *rtpProxy, SessionStats, error) {
+	s, err := f.getStream(id)
+	if err != nil {
+		return nil, nil, SessionStats{}, err
+	}
+
 	c, err := f.getRtpProxy(id)
 	if err != nil {
-		log.Info.Println("stop:", err)
-		return
+		return nil, nil, SessionStats{}, err
 	}
 
-	c.stop()
+	// the counters are read before the processes stop
+	st := f.sessionStats(id, s, c, time.Now())
+
 	delete(f.rtpProxies, id)
-	s.stop()
 	delete(f.streams, id)
+
+	return s, c, st, nil
 }
 
 func (f *ffmpeg) Suspend(id StreamID) {
@@ -167,6 +445,113 @@ func (f *ffmpeg) Reconfigure(id StreamID, video rtp.VideoParameters, audio rtp.A
 	return s.reconfigure(video, audio)
 }
 
+// SetNightMode switches to grayscale and to the night encoder settings.
+// Running streams restart their capture process with the new settings.
+func (f *ffmpeg) SetNightMode(night bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.night == night {
+		return
+	}
+	f.night = night
+
+	for _, s := range f.streams {
+		if !s.isActive() {
+			continue
+		}
+		filters, err := f.videoFilters(s.videoSize, night)
+		if err != nil {
+			log.Info.Println("night mode:", err)
+			continue
+		}
+		s.setNight(night, filters)
+	}
+
+	if f.live.process != nil {
+		filters, err := f.videoFilters(f.live.size, night)
+		if err != nil {
+			log.Info.Println("night mode:", err)
+			return
+		}
+		log.Debug.Println("switch live view to night mode:", night)
+		args := f.liveCommand(runtime.GOOS, f.live.dir, f.live.video.port(), f.live.size, filters).Args()
+		f.live.process.reload(f.liveProcess(args, f.live.tap))
+	}
+}
+
+// receiveRTCP passes an RTCP packet of the controller to the stream with id.
+func (f *ffmpeg) receiveRTCP(id StreamID, packet []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if s, ok := f.streams[id]; ok {
+		s.receiveRTCP(packet)
+	}
+}
+
+func (f *ffmpeg) isNight() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.night
+}
+
+// Status returns the health of the processes of all started streams
+// and of the live view which is reported as stream "live".
+func (f *ffmpeg) Status() []StreamStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var st []StreamStatus
+	for id, s := range f.streams {
+		if s.isActive() {
+			st = append(st, StreamStatus{id, s.status()})
+		}
+	}
+	if f.live.process != nil {
+		st = append(st, StreamStatus{"live", []ProcessStatus{f.live.process.status()}})
+	}
+
+	return st
+}
+
+// Stats returns the statistics of the started streams.
+func (f *ffmpeg) Stats() []SessionStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	var st []SessionStats
+	for id, s := range f.streams {
+		if !s.isActive() {
+			continue
+		}
+		st = append(st, f.sessionStats(id, s, f.rtpProxies[id], now))
+	}
+
+	return st
+}
+
+// OnSessionEnd sets the function which receives the statistics of the ended sessions.
+// The function is called after the stream stopped.
+func (f *ffmpeg) OnSessionEnd(fn func(SessionStats)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.sessionEnd = fn
+}
+
+// sessionStats returns the statistics of stream s with audio proxy c at now.
+func (f *ffmpeg) sessionStats(id StreamID, s *stream, c *rtpProxy, now time.Time) SessionStats {
+	st := s.stats(id, now)
+	if c != nil {
+		st.AudioPackets, st.AudioBytes = c.sent.get()
+	}
+
+	return st
+}
+
 func (f *ffmpeg) getStream(id StreamID) (*stream, error) {
 	if s, ok := f.streams[id]; ok {
 		return s, nil
@@ -183,24 +568,148 @@ func (f *ffmpeg) getRtpProxy(id StreamID) (*rtpProxy, error) {
 	return nil, &StreamNotFoundError{id}
 }
 
+// Snapshot returns a frame of the camera resized to width keeping the aspect ratio.
+// The frame is shared by all requests until it is older than Config.SnapshotMaxAge.
 func (f *ffmpeg) Snapshot(width, height uint) (*image.Image, error) {
+	img, err := f.frames.snapshot(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return &img, nil
+}
+
+// MaskPreview returns a frame at full resolution with the outlines of the privacy masks.
+// The frame is masked like every other snapshot.
+func (f *ffmpeg) MaskPreview() (*image.Image, error) {
+	img, _, err := f.frames.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if f.mask != nil {
+		img = f.mask.outline(img)
+	}
+
+	return &img, nil
+}
+
+// refreshSnapshots captures a new frame every interval while no stream uses the camera.
+// It returns after Shutdown.
+func (f *ffmpeg) refreshSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if f.ActiveStreams() > 0 {
+			continue
+		}
+
+		if req := f.frames.refresh(); req.err != nil {
+			log.Info.Println("snapshot:", req.err)
+		}
+	}
+}
+
+// captureFrame takes a frame from a running stream or from the live view since the camera is busy;
+// it opens the camera only if neither is running.
+func (f *ffmpeg) captureFrame() (image.Image, error) {
+	if tap := f.activeTap(); tap != nil {
+		log.Debug.Println("take snapshot from the stream or the live view")
+		return tap.frame(time.Second/tapFramerate, 3*time.Second)
+	}
 
-	img, found := f.snapCache.Get(string(width) + string(height))
-	if found {
-		log.Info.Println("Return a cached snapshot")
-		return img.(*image.Image), nil
+	var size image.Point
+	if f.mask != nil {
+		// the mask is rendered in the size of the frames
+		size = f.frames.size()
 	}
 
+	filters, err := f.videoFilters(size, f.isNight())
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := snapshot(f.videoInputDevice(), f.videoInputFilename(), size, filters, f.env)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.mask != nil && size == (image.Point{}) {
+		// the mask is drawn in process until we know the size of the frames
+		img = f.mask.apply(img)
+	}
+
+	return img, nil
+}
+
+// videoFilters returns the filters applied to the video at full resolution:
+// grayscale at night, the privacy mask for frames of size and the overlay.
+// The mask is left out while size is unknown.
+func (f *ffmpeg) videoFilters(size image.Point, night bool) (FilterChain, error) {
+	var chain FilterChain
+	if night {
+		chain = append(chain, Filter{Name: "hue", Args: []string{"s=0"}})
+	}
+
+	if f.mask != nil && size != (image.Point{}) {
+		mask, err := f.mask.filters(size)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, mask...)
+	}
+
+	return append(chain, f.overlay...), nil
+}
+
+// probeSize returns the size of the camera frames if the privacy mask needs it.
+// The size is learnt from a snapshot, therefore it must be called without the mutex held.
+func (f *ffmpeg) probeSize() (image.Point, error) {
+	if f.mask == nil {
+		return image.Point{}, nil
+	}
+
+	frame, _, err := f.frames.get()
+	if err != nil {
+		return image.Point{}, err
+	}
+
+	return frame.Bounds().Size(), nil
+}
+
+// activeTap returns the tap of a running stream, or of the live view while no stream is running.
+func (f *ffmpeg) activeTap() *frameTap {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	shot, err := snapshot(width, height, f.videoInputDevice(), f.videoInputFilename())
+	for _, s := range f.streams {
+		if s.isActive() {
+			return s.tap
+		}
+	}
+
+	return f.live.tap
+}
 
-	if shot != nil {
-		f.snapCache.Set(string(width)+string(height), shot, cache.DefaultExpiration)
+// streaming returns true if a stream uses the camera. It must be called with the mutex held.
+func (f *ffmpeg) streaming() bool {
+	if f.starting > 0 {
+		return true
+	}
+	for _, s := range f.streams {
+		if s.isActive() {
+			return true
+		}
 	}
 
-	return shot, err
+	return false
 }
 
 func (f *ffmpeg) videoInputDevice() string {
@@ -223,6 +732,25 @@ func (f *ffmpeg) audioOutputName() string {
 	return f.cfg.AudioNameOutput
 }
 
+func (f *ffmpeg) snapshotMaxAge() time.Duration {
+	if f.cfg.SnapshotMaxAge == 0 {
+		return defaultSnapshotMaxAge
+	}
+
+	return f.cfg.SnapshotMaxAge
+}
+
+func (f *ffmpeg) stderrLines() int {
+	switch {
+	case f.cfg.StderrLines == 0:
+		return defaultStderrLines
+	case f.cfg.StderrLines < 0:
+		return 0
+	}
+
+	return f.cfg.StderrLines
+}
+
 type StreamNotFoundError struct {
 	id StreamID
 }
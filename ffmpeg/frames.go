@@ -0,0 +1,142 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/log"
+	"github.com/nfnt/resize"
+)
+
+// frameCache keeps the last full resolution frame of the camera
+// and serves resized copies of it.
+// Concurrent requests for a new frame share a single capture.
+type frameCache struct {
+	maxAge  time.Duration
+	capture func() (image.Image, error)
+	now     func() time.Time
+
+	mutex sync.Mutex
+	frame image.Image
+	taken time.Time
+	// generation changes every time the frame is replaced
+	generation uint64
+	resized    map[string]image.Image
+	pending    *frameRequest
+}
+
+// frameRequest is a capture in progress.
+type frameRequest struct {
+	done       chan struct{}
+	frame      image.Image
+	generation uint64
+	err        error
+}
+
+func newFrameCache(maxAge time.Duration, capture func() (image.Image, error)) *frameCache {
+	return &frameCache{
+		maxAge:  maxAge,
+		capture: capture,
+		now:     time.Now,
+		resized: make(map[string]image.Image, 0),
+	}
+}
+
+// get returns the cached frame and its generation if the frame is younger than maxAge
+// and captures a new frame otherwise.
+func (c *frameCache) get() (image.Image, uint64, error) {
+	c.mutex.Lock()
+	if c.frame != nil && c.now().Sub(c.taken) < c.maxAge {
+		frame, generation := c.frame, c.generation
+		c.mutex.Unlock()
+		return frame, generation, nil
+	}
+	c.mutex.Unlock()
+
+	req := c.refresh()
+
+	return req.frame, req.generation, req.err
+}
+
+// size returns the resolution of the last frame; zero if no frame has been captured yet.
+func (c *frameCache) size() image.Point {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.frame == nil {
+		return image.Point{}
+	}
+
+	return c.frame.Bounds().Size()
+}
+
+// refresh captures a new frame.
+// If a capture is already in progress it waits for its result instead.
+func (c *frameCache) refresh() *frameRequest {
+	c.mutex.Lock()
+	req := c.pending
+	if req == nil {
+		req = &frameRequest{done: make(chan struct{})}
+		c.pending = req
+		c.mutex.Unlock()
+
+		req.frame, req.err = c.capture()
+
+		c.mutex.Lock()
+		if req.err == nil && req.frame != nil {
+			c.set(req.frame)
+			req.generation = c.generation
+		}
+		c.pending = nil
+		close(req.done)
+	}
+	c.mutex.Unlock()
+
+	<-req.done
+
+	return req
+}
+
+// set must be called with the mutex held.
+func (c *frameCache) set(frame image.Image) {
+	c.frame = frame
+	c.taken = c.now()
+	c.generation++
+	c.resized = make(map[string]image.Image, 0)
+}
+
+// snapshot returns the frame resized to width keeping the aspect ratio.
+// The frame is never scaled up.
+func (c *frameCache) snapshot(width, height uint) (image.Image, error) {
+	frame, generation, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	if width == 0 || int(width) >= frame.Bounds().Dx() {
+		return frame, nil
+	}
+
+	key := fmt.Sprintf("%dx%d", width, height)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation != generation {
+		// the frame has been replaced in the meantime; don't cache the resized copy
+		return resize.Resize(width, 0, frame, resize.Bilinear), nil
+	}
+
+	if img, ok := c.resized[key]; ok {
+		log.Debug.Println("Return a cached snapshot", key)
+		return img, nil
+	}
+
+	// height 0 keeps the aspect ratio
+	img := resize.Resize(width, 0, frame, resize.Bilinear)
+	c.resized[key] = img
+
+	return img, nil
+}
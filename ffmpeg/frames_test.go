@@ -0,0 +1,123 @@
+package ffmpeg
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countingCapture(count *int32, release <-chan struct{}) func() (image.Image, error) {
+	return func() (image.Image, error) {
+		atomic.AddInt32(count, 1)
+		if release != nil {
+			<-release
+		}
+		return image.NewRGBA(image.Rect(0, 0, 1920, 1080)), nil
+	}
+}
+
+func TestFrameCacheResize(t *testing.T) {
+	var count int32
+	c := newFrameCache(time.Minute, countingCapture(&count, nil))
+
+	for _, size := range []struct{ width, height, wantHeight int }{
+		{1280, 960, 720},
+		{640, 480, 360},
+		{1920, 1080, 1080},
+		{3840, 2160, 1080},
+	} {
+		img, err := c.snapshot(uint(size.width), uint(size.height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := size.width
+		if want > 1920 {
+			want = 1920
+		}
+		if is := img.Bounds().Dx(); is != want {
+			t.Fatalf("%dx%d: width is=%v want=%v", size.width, size.height, is, want)
+		}
+		if is := img.Bounds().Dy(); is != size.wantHeight {
+			t.Fatalf("%dx%d: height is=%v want=%v", size.width, size.height, is, size.wantHeight)
+		}
+	}
+
+	if is, want := atomic.LoadInt32(&count), int32(1); is != want {
+		t.Fatalf("captures is=%v want=%v", is, want)
+	}
+}
+
+func TestFrameCacheKeepsResizedCopies(t *testing.T) {
+	var count int32
+	c := newFrameCache(time.Minute, countingCapture(&count, nil))
+
+	a, _ := c.snapshot(1280, 960)
+	b, _ := c.snapshot(1280, 960)
+	if a != b {
+		t.Fatal("resized frame not cached")
+	}
+
+	d, _ := c.snapshot(1280, 720)
+	if a == d {
+		t.Fatal("different sizes share the cached frame")
+	}
+}
+
+func TestFrameCacheMaxAge(t *testing.T) {
+	var count int32
+	c := newFrameCache(500*time.Millisecond, countingCapture(&count, nil))
+	// resizing is slow under the race detector; the clock only moves when we say so
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.snapshot(640, 480)
+	c.snapshot(640, 480)
+	now = now.Add(600 * time.Millisecond)
+	c.snapshot(640, 480)
+
+	if is, want := atomic.LoadInt32(&count), int32(2); is != want {
+		t.Fatalf("captures is=%v want=%v", is, want)
+	}
+}
+
+func TestFrameCacheSharesCapture(t *testing.T) {
+	var count int32
+	release := make(chan struct{})
+	c := newFrameCache(time.Minute, countingCapture(&count, release))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(width uint) {
+			defer wg.Done()
+			if _, err := c.snapshot(width, 0); err != nil {
+				t.Error(err)
+			}
+		}(uint(320 + i*10))
+	}
+
+	// wait until the first request captures
+	for atomic.LoadInt32(&count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if is, want := atomic.LoadInt32(&count), int32(1); is != want {
+		t.Fatalf("captures is=%v want=%v", is, want)
+	}
+}
+
+func TestFrameCacheError(t *testing.T) {
+	c := newFrameCache(time.Minute, func() (image.Image, error) {
+		return nil, errors.New("camera busy")
+	})
+
+	if _, err := c.snapshot(640, 480); err == nil || err.Error() != "camera busy" {
+		t.Fatalf("error is=%v", err)
+	}
+}
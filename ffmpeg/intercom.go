@@ -0,0 +1,396 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/brutella/hc/log"
+)
+
+// IntercomPayloadType is the payload type of the Opus RTP packets of the intercom.
+// Opus is always sent at 48kHz (RFC 7587).
+const IntercomPayloadType = 111
+
+// bitrate of the microphone audio of the intercom in kbit/s
+const intercomBitrate = 32
+
+// intercom is the two-way audio between the doorbell and a viewer of the live view.
+// The capture process sends the microphone as Opus RTP packets to feed;
+// the playback process plays the packets written to speaker.
+type intercom struct {
+	f *ffmpeg
+	// capture encodes the microphone, playback plays the audio of the viewer
+	capture  *process
+	playback *process
+	// microphone captures the microphone for the echo canceller; nil without echo cancellation
+	microphone *process
+	// micReader and micWriter carry the microphone audio from the echo canceller to the capture process
+	micReader *os.File
+	micWriter *os.File
+	feed      *rtpFeed
+	speaker   *net.UDPConn
+	stopOnce  sync.Once
+}
+
+// StartIntercom starts the two-way audio with a viewer of the live view. microphone receives
+// the Opus RTP packets of the microphone and the Opus RTP packets written to the returned
+// intercom are played on the speaker until it is closed.
+// A stream, a sound or another intercom hold the audio; StartIntercom returns ErrAudioBusy
+// in the meantime. A stream which starts later takes the audio from the intercom.
+func (f *ffmpeg) StartIntercom(microphone func(pkt []byte)) (io.WriteCloser, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.ctx.Err() != nil {
+		return nil, ErrShutdown
+	}
+	if f.sound != nil || f.intercom != nil || f.streaming() {
+		return nil, ErrAudioBusy
+	}
+
+	i, err := f.startIntercom(runtime.GOOS, microphone)
+	if err != nil {
+		return nil, err
+	}
+	f.intercom = i
+
+	return i, nil
+}
+
+// startIntercom starts the processes of an intercom; the caller must hold the mutex.
+func (f *ffmpeg) startIntercom(goos string, microphone func(pkt []byte)) (*intercom, error) {
+	feed, err := newRTPFeed()
+	if err != nil {
+		return nil, err
+	}
+	feed.subscribe(microphone)
+
+	// even port; the playback process receives the RTCP on the next one
+	port := 2*rand.Intn(500) + 9000
+	speaker, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		feed.close()
+		return nil, err
+	}
+
+	i := &intercom{f: f, feed: feed, speaker: speaker}
+
+	var canceller *echoCanceller
+	if f.cfg.AudioProcessing.echoCancellation(goos) {
+		if i.micReader, i.micWriter, err = os.Pipe(); err != nil {
+			i.stop()
+			return nil, err
+		}
+		canceller = newEchoCanceller(f.cfg.AudioProcessing.EchoTail, i.micWriter)
+	}
+
+	captureArgs := f.intercomCaptureCommand(goos, feed.port()).Args()
+	micReader := i.micReader
+	i.capture = newProcess("intercom", func() *exec.Cmd {
+		cmd := exec.Command("ffmpeg", captureArgs...)
+		cmd.Stdout = Stdout
+		if micReader != nil {
+			// microphone audio without echo
+			cmd.Stdin = micReader
+		}
+		return cmd
+	}, f.cfg.MaxRestarts, f.stderrLines())
+
+	exe, playback := f.intercomPlaybackCommand(goos)
+	playbackArgs := playback.Args()
+	sdp := intercomSDP(port)
+	i.playback = newProcess("intercom playback", func() *exec.Cmd {
+		cmd := exec.Command(exe, playbackArgs...)
+		cmd.Stdout = Stdout
+		if canceller != nil {
+			// the audio played by the speaker is the reference of the echo canceller
+			cmd.Stdout = canceller.referenceWriter()
+		}
+		cmd.Stdin = strings.NewReader(sdp)
+		return cmd
+	}, f.cfg.MaxRestarts, f.stderrLines())
+
+	if canceller != nil {
+		microphoneArgs := f.intercomMicrophoneCommand().Args()
+		i.microphone = newProcess("intercom microphone", func() *exec.Cmd {
+			cmd := exec.Command("ffmpeg", microphoneArgs...)
+			cmd.Stdout = canceller
+			return cmd
+		}, f.cfg.MaxRestarts, f.stderrLines())
+	}
+
+	log.Debug.Println("start intercom")
+	for _, p := range i.processes() {
+		if err := p.start(); err != nil {
+			i.stop()
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+// Write plays the Opus RTP packet pkt of the viewer on the speaker.
+func (i *intercom) Write(pkt []byte) (int, error) {
+	if len(pkt) < rtpHeaderLength {
+		return 0, errors.New("short rtp packet")
+	}
+
+	// the payload type of the viewer is the one of the SDP of the playback process
+	buf := append([]byte{}, pkt...)
+	buf[1] = buf[1]&0x80 | IntercomPayloadType
+
+	return i.speaker.Write(buf)
+}
+
+// Close stops the intercom unless a stream has already taken the audio.
+func (i *intercom) Close() error {
+	i.f.mutex.Lock()
+	if i.f.intercom == i {
+		i.f.intercom = nil
+	}
+	i.f.mutex.Unlock()
+
+	// the processes are stopped without the mutex, see detachIntercom
+	i.stop()
+
+	return nil
+}
+
+// detachIntercom removes the intercom, if any; the caller stops it with stop
+// after releasing the mutex. It must be called with the mutex held.
+func (f *ffmpeg) detachIntercom() *intercom {
+	i := f.intercom
+	f.intercom = nil
+
+	return i
+}
+
+// stop stops the processes of the intercom; a nil intercom is ignored.
+func (i *intercom) stop() {
+	if i == nil {
+		return
+	}
+
+	i.stopOnce.Do(func() {
+		log.Debug.Println("stop intercom")
+		for _, p := range i.processes() {
+			p.stop()
+		}
+
+		if i.micWriter != nil {
+			i.micWriter.Close()
+		}
+		if i.micReader != nil {
+			i.micReader.Close()
+		}
+		i.feed.close()
+		i.speaker.Close()
+	})
+}
+
+// processes returns the processes of the intercom.
+func (i *intercom) processes() []*process {
+	var ps []*process
+	for _, p := range []*process{i.microphone, i.capture, i.playback} {
+		if p != nil {
+			ps = append(ps, p)
+		}
+	}
+
+	return ps
+}
+
+// intercomCaptureCommand returns the ffmpeg command which sends the microphone as Opus RTP packets to port.
+// With echo cancellation the microphone comes from the echo canceller on stdin.
+func (f *ffmpeg) intercomCaptureCommand(goos string, port int) Command {
+	input := f.microphoneInput(goos)
+	if f.cfg.AudioProcessing.echoCancellation(goos) {
+		input = Input{
+			Options: echoAudioOptions(),
+			Format:  "s16le",
+			URL:     "pipe:0",
+		}
+	}
+
+	return Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{input},
+		Outputs: []Output{{
+			NoVideo: true,
+			Audio: &Encoder{Codec: "libopus", Options: []Option{
+				Opt("application", "voip"),
+				Opt("frame_duration", "20"),
+			}},
+			AudioFilters: f.cfg.AudioProcessing.filters(),
+			Options: []Option{
+				Opt("ar", "48k"),
+				Opt("ac", "1"),
+				Optf("b:a", "%dk", intercomBitrate),
+				Optf("payload_type", "%d", IntercomPayloadType),
+			},
+			Format: "rtp",
+			URL:    fmt.Sprintf("rtp://127.0.0.1:%d?rtcpport=%d&pkt_size=%d", port, port, livePacketSize),
+		}},
+	}
+}
+
+// intercomPlaybackCommand returns the executable and the command which plays the audio of the viewer.
+// The command reads the SDP returned by intercomSDP from stdin.
+func (f *ffmpeg) intercomPlaybackCommand(goos string) (string, Command) {
+	input := Input{
+		Options: append(lowLatencyInputOptions(),
+			Opt("protocol_whitelist", "rtp,file,udp,pipe"),
+			Flag("vn"),
+			Opt("codec:a", "libopus"),
+		),
+		Format: "sdp",
+		URL:    "pipe:",
+	}
+
+	if goos == "darwin" {
+		// see playbackCommand
+		return "ffplay", Command{
+			Global: []Option{Flag("hide_banner"), Flag("nodisp"), Opt("sync", "ext")},
+			Inputs: []Input{input},
+		}
+	}
+
+	format, url := deviceOutput(f.audioDevice(), f.audioOutputName())
+	cmd := Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{input},
+		Outputs: []Output{{
+			Format: format,
+			URL:    url,
+		}},
+	}
+	if f.cfg.AudioProcessing.echoCancellation(goos) {
+		// reference of the echo canceller
+		cmd.Outputs = append(cmd.Outputs, Output{
+			Options: echoAudioOptions(),
+			Format:  "s16le",
+			URL:     "pipe:1",
+		})
+	}
+
+	return "ffmpeg", cmd
+}
+
+// intercomMicrophoneCommand returns the ffmpeg command which writes the microphone audio
+// for the echo canceller to stdout.
+func (f *ffmpeg) intercomMicrophoneCommand() Command {
+	return Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{f.microphoneInput("linux")},
+		Outputs: []Output{{
+			NoVideo: true,
+			Options: echoAudioOptions(),
+			Format:  "s16le",
+			URL:     "pipe:1",
+		}},
+	}
+}
+
+// microphoneInput returns the input of the microphone without the camera.
+func (f *ffmpeg) microphoneInput(goos string) Input {
+	if goos == "darwin" {
+		// avfoundation selects the audio device after the colon
+		return deviceInput(f.audioDevice(), ":"+f.audioInputName(), nil)
+	}
+
+	return deviceInput(f.audioDevice(), f.audioInputName(), lowLatencyInputOptions())
+}
+
+// intercomSDP describes the audio of the viewer which is sent to port.
+func intercomSDP(port int) string {
+	return "v=0\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\n" +
+		"s=No Name\n" +
+		"c=IN IP4 127.0.0.1\n" +
+		"t=0 0\n" +
+		fmt.Sprintf("m=audio %d RTP/AVP %d\n", port, IntercomPayloadType) +
+		fmt.Sprintf("a=rtpmap:%d opus/48000/2", IntercomPayloadType)
+}
+
+// rtpFeed receives the RTP packets which an ffmpeg process sends to a local port
+// and passes them to its subscribers. The RTCP packets of the muxer share the port
+// and are dropped.
+type rtpFeed struct {
+	conn        *net.UDPConn
+	mutex       sync.Mutex
+	subscribers map[int]func([]byte)
+	next        int
+}
+
+// newRTPFeed returns a feed which listens on a free port of the loopback interface.
+func newRTPFeed() (*rtpFeed, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rtpFeed{conn: conn, subscribers: make(map[int]func([]byte), 0)}
+	go r.receive()
+
+	return r, nil
+}
+
+func (r *rtpFeed) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// subscribe passes every packet to fn until the returned function is called.
+// fn receives a copy of the packet and must not block.
+func (r *rtpFeed) subscribe(fn func(pkt []byte)) func() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	id := r.next
+	r.next++
+	r.subscribers[id] = fn
+
+	return func() {
+		r.mutex.Lock()
+		delete(r.subscribers, id)
+		r.mutex.Unlock()
+	}
+}
+
+func (r *rtpFeed) close() {
+	r.conn.Close()
+}
+
+func (r *rtpFeed) receive() {
+	buf := make([]byte, 1500)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			// closed
+			return
+		}
+		pkt := buf[:n]
+		if n < rtpHeaderLength || isRTCP(pkt) {
+			continue
+		}
+
+		r.mutex.Lock()
+		fns := make([]func([]byte), 0, len(r.subscribers))
+		for _, fn := range r.subscribers {
+			fns = append(fns, fn)
+		}
+		r.mutex.Unlock()
+
+		for _, fn := range fns {
+			fn(append([]byte{}, pkt...))
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package ffmpeg
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+)
+
+func TestIntercomCommands(t *testing.T) {
+	f := New(Config{AudioDevice: "alsa", AudioNameInput: "default", AudioNameOutput: "default",
+		AudioProcessing: AudioProcessing{NoiseReduction: 12}})
+	exe, playback := f.intercomPlaybackCommand("linux")
+	if exe != "ffmpeg" {
+		t.Fatalf("executable is=%v want=ffmpeg", exe)
+	}
+	checkGolden(t, "intercom_linux", f.intercomCaptureCommand("linux", 5006).Args(), playback.Args(),
+		strings.Split(intercomSDP(9000), "\n"))
+
+	// the microphone comes from the echo canceller which receives the reference from the playback
+	f = New(Config{AudioDevice: "alsa", AudioNameInput: "default", AudioNameOutput: "default",
+		AudioProcessing: AudioProcessing{EchoCancellation: true}})
+	_, playback = f.intercomPlaybackCommand("linux")
+	checkGolden(t, "intercom_linux_echo_cancellation", f.intercomCaptureCommand("linux", 5006).Args(), playback.Args(),
+		f.intercomMicrophoneCommand().Args())
+
+	f = New(Config{AudioDevice: "avfoundation", AudioNameInput: "default", AudioNameOutput: "default",
+		AudioProcessing: AudioProcessing{EchoCancellation: true}})
+	exe, playback = f.intercomPlaybackCommand("darwin")
+	if exe != "ffplay" {
+		t.Fatalf("executable is=%v want=ffplay", exe)
+	}
+	checkGolden(t, "intercom_darwin", f.intercomCaptureCommand("darwin", 5006).Args(), playback.Args())
+}
+
+func TestIntercomAudioBusy(t *testing.T) {
+	f := New(Config{})
+	defer f.Shutdown(context.Background())
+
+	f.sound = &sound{}
+	if _, err := f.StartIntercom(func([]byte) {}); err != ErrAudioBusy {
+		t.Fatalf("error with sound is=%v want=%v", err, ErrAudioBusy)
+	}
+	f.sound = nil
+
+	f.streams["session"] = &stream{capture: &process{}}
+	if _, err := f.StartIntercom(func([]byte) {}); err != ErrAudioBusy {
+		t.Fatalf("error with stream is=%v want=%v", err, ErrAudioBusy)
+	}
+	delete(f.streams, "session")
+
+	// the intercom holds the audio output
+	f.intercom = &intercom{f: f}
+	if err := f.PlaySound("chime.wav", 1); err != ErrAudioBusy {
+		t.Fatalf("sound error is=%v want=%v", err, ErrAudioBusy)
+	}
+	if _, err := f.StartIntercom(func([]byte) {}); err != ErrAudioBusy {
+		t.Fatalf("error with intercom is=%v want=%v", err, ErrAudioBusy)
+	}
+	f.intercom = nil
+}
+
+func TestIntercomWrite(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	speaker, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := newRTPFeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(Config{})
+	i := &intercom{f: f, feed: feed, speaker: speaker}
+	f.intercom = i
+
+	// the payload type of the viewer is replaced, the marker is kept
+	pkt := []byte{0x80, 0x80 | 109, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0xfc}
+	if _, err := i.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := buf[1], byte(0x80|IntercomPayloadType); n != len(pkt) || is != want {
+		t.Fatalf("second byte is=%#x want=%#x", is, want)
+	}
+	if pkt[1] != 0x80|109 {
+		t.Fatal("the packet of the caller has been changed")
+	}
+
+	if _, err := i.Write(pkt[:4]); err == nil {
+		t.Fatal("expected error for a short packet")
+	}
+
+	i.Close()
+	if f.intercom != nil {
+		t.Fatal("intercom still holds the audio")
+	}
+	if _, err := i.Write(pkt); err == nil {
+		t.Fatal("expected error after close")
+	}
+}
+
+func TestIntercomStopsForStream(t *testing.T) {
+	f := New(Config{})
+	defer f.Shutdown(context.Background())
+
+	p := newProcess("intercom", shell("sleep 10"), -1, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := newRTPFeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	speaker, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(freePort(t))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &intercom{f: f, capture: p, feed: feed, speaker: speaker}
+	f.intercom = i
+
+	// the stream takes the audio; it fails since the stream has not been prepared
+	if err := f.Start("session", testVideo(), testAudio(rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate16Khz)); err == nil {
+		t.Fatal("expected error for an unknown stream")
+	}
+	if f.intercom != nil {
+		t.Fatal("intercom still holds the audio")
+	}
+	if is := p.status().State; is != ProcessStopped {
+		t.Fatalf("intercom state is=%v want=%v", is, ProcessStopped)
+	}
+
+	// closing it afterwards is harmless
+	i.Close()
+}
+
+func TestRTPFeed(t *testing.T) {
+	feed, err := newRTPFeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.close()
+
+	a, b := make(chan []byte, 10), make(chan []byte, 10)
+	feed.subscribe(func(pkt []byte) { a <- pkt })
+	unsubscribe := feed.subscribe(func(pkt []byte) { b <- pkt })
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: feed.port()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rtp := []byte{0x80, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0x65}
+	// sender report of the muxer
+	rtcp := []byte{0x80, 200, 0, 6, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	conn.Write(rtcp)
+	conn.Write(rtp)
+	for _, c := range []chan []byte{a, b} {
+		select {
+		case pkt := <-c:
+			if string(pkt) != string(rtp) {
+				t.Fatalf("packet is=%v want=%v", pkt, rtp)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no packet")
+		}
+	}
+
+	unsubscribe()
+	conn.Write(rtp)
+	select {
+	case <-a:
+	case <-time.After(time.Second):
+		t.Fatal("no packet")
+	}
+	select {
+	case pkt := <-b:
+		t.Fatalf("unsubscribed function received %v", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,378 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/brutella/hc/log"
+)
+
+// HLSPlaylist is the name of the HLS playlist in the directory returned by WatchHLS.
+const HLSPlaylist = "live.m3u8"
+
+// ErrNoLiveView is returned by LiveFrame while neither the live view nor a stream captures the camera.
+var ErrNoLiveView = errors.New("live view is not running")
+
+// ErrTooManyViewers is returned by AddViewer once Config.MaxViewers watch the live view.
+var ErrTooManyViewers = errors.New("too many viewers")
+
+var (
+	// the live view keeps running hlsIdle after the last request of the HLS playlist
+	hlsIdle = 30 * time.Second
+	// length of an HLS segment; every segment starts with a keyframe
+	hlsSegment = 2 * time.Second
+)
+
+const (
+	defaultLiveFramerate    = 5
+	defaultLiveVideoBitrate = 1000
+	// the camera delivers liveInputFramerate frames per second to the live view
+	liveInputFramerate = 30
+	// payload type and packet size of the H.264 RTP packets of the live view, see WatchLiveVideo
+	livePayloadType = 96
+	livePacketSize  = 1200
+)
+
+// liveView is the capture process which feeds the MJPEG and the HLS endpoints.
+// It runs while someone watches and no stream uses the camera.
+type liveView struct {
+	process *process
+	// tap receives the jpeg frames of the MJPEG endpoint
+	tap *frameTap
+	// dir contains the HLS playlist and its segments
+	dir string
+	// video receives the H.264 of the HLS playlist as RTP packets for WatchLiveVideo
+	video *rtpFeed
+	// temporary is true if dir has been created by the live view; it is removed with the live view
+	temporary bool
+	// size is the resolution requested from the camera; zero keeps its default
+	size image.Point
+	// viewers of the MJPEG endpoint
+	viewers int
+	// the HLS viewers are gone at hlsUntil unless they request the playlist again
+	hlsUntil time.Time
+	hlsTimer *time.Timer
+}
+
+// watched returns true if someone watches the live view.
+func (l *liveView) watched() bool {
+	return l.viewers > 0 || time.Now().Before(l.hlsUntil)
+}
+
+// AddViewer starts the live view for a viewer of the MJPEG endpoint or of the intercom.
+// The live view runs until every viewer has been removed with RemoveViewer.
+// It returns ErrTooManyViewers once Config.MaxViewers watch the live view.
+func (f *ffmpeg) AddViewer() error {
+	size, err := f.probeSize()
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.cfg.MaxViewers > 0 && f.live.viewers >= f.cfg.MaxViewers {
+		return ErrTooManyViewers
+	}
+	if err := f.startLive(size); err != nil {
+		return err
+	}
+	f.live.viewers++
+
+	return nil
+}
+
+// RemoveViewer removes a viewer added with AddViewer.
+func (f *ffmpeg) RemoveViewer() {
+	f.mutex.Lock()
+
+	if f.live.viewers > 0 {
+		f.live.viewers--
+	}
+	var live detachedLive
+	if !f.live.watched() {
+		live = f.detachLive()
+	}
+	f.mutex.Unlock()
+
+	live.stop()
+}
+
+// WatchHLS starts the live view, or keeps it running, for hlsIdle and returns
+// the directory which contains the HLS playlist and its segments.
+func (f *ffmpeg) WatchHLS() (string, error) {
+	size, err := f.probeSize()
+	if err != nil {
+		return "", err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.startLive(size); err != nil {
+		return "", err
+	}
+
+	f.live.hlsUntil = time.Now().Add(hlsIdle)
+	if f.live.hlsTimer == nil {
+		f.live.hlsTimer = time.AfterFunc(hlsIdle, f.hlsExpired)
+	}
+
+	return f.live.dir, nil
+}
+
+// hlsExpired stops the live view once the HLS viewers are gone.
+func (f *ffmpeg) hlsExpired() {
+	f.mutex.Lock()
+	if d := time.Until(f.live.hlsUntil); d > 0 {
+		f.live.hlsTimer = time.AfterFunc(d, f.hlsExpired)
+		f.mutex.Unlock()
+		return
+	}
+	f.live.hlsTimer = nil
+
+	var live detachedLive
+	if !f.live.watched() {
+		live = f.detachLive()
+	}
+	f.mutex.Unlock()
+
+	live.stop()
+}
+
+// WatchLiveVideo passes the H.264 RTP packets of the live view to fn until the returned
+// function is called. The live view runs only while it is watched, e.g. by a viewer added
+// with AddViewer, and pauses while a stream uses the camera; every restart of the live view
+// starts with a new SSRC.
+func (f *ffmpeg) WatchLiveVideo(fn func(pkt []byte)) (func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.ctx.Err() != nil {
+		return nil, ErrShutdown
+	}
+	feed, err := f.liveVideo()
+	if err != nil {
+		return nil, err
+	}
+
+	return feed.subscribe(fn), nil
+}
+
+// liveVideo returns the feed of the RTP packets of the live view; it is opened once
+// and closed by Shutdown. It must be called with the mutex held.
+func (f *ffmpeg) liveVideo() (*rtpFeed, error) {
+	if f.live.video == nil {
+		feed, err := newRTPFeed()
+		if err != nil {
+			return nil, err
+		}
+		f.live.video = feed
+	}
+
+	return f.live.video, nil
+}
+
+// LiveFrame returns the jpeg frame of the live view which follows the frame with sequence number after
+// and its sequence number. It waits at most timeout for a new frame.
+// During a stream the frames come from the stream at its snapshot framerate.
+func (f *ffmpeg) LiveFrame(after uint64, timeout time.Duration) ([]byte, uint64, error) {
+	tap := f.activeTap()
+	if tap == nil {
+		return nil, 0, ErrNoLiveView
+	}
+
+	return tap.nextFrame(after, timeout)
+}
+
+// startLive starts the live view for frames of size unless it is running
+// or a stream uses the camera. It must be called with the mutex held.
+func (f *ffmpeg) startLive(size image.Point) error {
+	f.live.size = size
+	if f.ctx.Err() != nil {
+		return ErrShutdown
+	}
+
+	// the HLS viewers wait in the directory while a stream uses the camera
+	if f.live.dir == "" {
+		dir, temporary, err := f.liveDir()
+		if err != nil {
+			return err
+		}
+		f.live.dir, f.live.temporary = dir, temporary
+	}
+
+	if f.live.process != nil || f.streaming() {
+		return nil
+	}
+
+	filters, err := f.videoFilters(size, f.night)
+	if err != nil {
+		return err
+	}
+	feed, err := f.liveVideo()
+	if err != nil {
+		return err
+	}
+
+	tap := newFrameTap()
+	args := f.liveCommand(runtime.GOOS, f.live.dir, feed.port(), size, filters).Args()
+	p := newProcess("live", f.liveProcess(args, tap), f.cfg.MaxRestarts, f.stderrLines())
+
+	log.Debug.Println("start live view")
+	if err := p.start(); err != nil {
+		return err
+	}
+	f.live.process = p
+	f.live.tap = tap
+
+	return nil
+}
+
+// detachedLive is a live view removed by detachLive which has yet to be stopped.
+type detachedLive struct {
+	process   *process
+	dir       string
+	temporary bool
+}
+
+// detachLive removes the live view; the caller stops it with stop after releasing the mutex
+// since the process may take seconds to exit. It must be called with the mutex held.
+func (f *ffmpeg) detachLive() detachedLive {
+	l := detachedLive{process: f.live.process, dir: f.live.dir, temporary: f.live.temporary}
+	f.live.process = nil
+	f.live.tap = nil
+	if f.live.temporary {
+		// the next live view creates a new directory
+		f.live.dir, f.live.temporary = "", false
+	}
+
+	return l
+}
+
+// stop stops the live view and removes its HLS playlist, or its whole directory if it is temporary.
+func (l detachedLive) stop() {
+	if l.process != nil {
+		log.Debug.Println("stop live view")
+		l.process.stop()
+	}
+
+	if l.dir == "" {
+		return
+	}
+	if l.temporary {
+		if err := os.RemoveAll(l.dir); err != nil {
+			log.Info.Println("live view:", err)
+		}
+		return
+	}
+
+	// players wait for the playlist of the next live view
+	os.Remove(filepath.Join(l.dir, HLSPlaylist))
+}
+
+// resumeLive restarts the live view after a stream has released the camera.
+// It must be called with the mutex held.
+func (f *ffmpeg) resumeLive() {
+	if !f.live.watched() {
+		return
+	}
+
+	if err := f.startLive(f.live.size); err != nil {
+		log.Info.Println("live view:", err)
+	}
+}
+
+// liveDir returns the directory of the HLS playlist; a temporary one if none is configured.
+func (f *ffmpeg) liveDir() (string, bool, error) {
+	if f.cfg.LiveDir == "" {
+		dir, err := ioutil.TempDir("", "hkdoorbell-live")
+		return dir, true, err
+	}
+
+	return f.cfg.LiveDir, false, os.MkdirAll(f.cfg.LiveDir, 0755)
+}
+
+// liveProcess returns the command of the live view process which writes its frames to tap.
+func (f *ffmpeg) liveProcess(args []string, tap *frameTap) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		cmd := exec.Command("ffmpeg", args...)
+		cmd.Env = f.env
+		cmd.Stdout = tap
+		return cmd
+	}
+}
+
+// liveCommand returns the ffmpeg command of the live view which writes jpeg frames to stdout
+// and the HLS playlist with its segments to dir. The tee muxer sends the same H.264
+// as RTP packets to videoPort.
+func (f *ffmpeg) liveCommand(goos string, dir string, videoPort int, size image.Point, filters FilterChain) Command {
+	videoOpts := []Option{
+		Opt("preset", "ultrafast"),
+		Opt("tune", "zerolatency"),
+	}
+	if goos == "darwin" {
+		videoOpts = append(videoOpts, Opt("pix_fmt", "yuv420p"))
+	}
+
+	return Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{deviceInput(f.videoInputDevice(), f.videoInputFilename(), []Option{
+			Optf("framerate", "%d", liveInputFramerate),
+			Opt("codec:v", f.cfg.H264Decoder),
+			Opt("video_size", videoSize(size)),
+		})},
+		Outputs: []Output{
+			{
+				Maps:         []string{"0:v"},
+				NoAudio:      true,
+				Video:        &Encoder{Codec: "mjpeg", Options: []Option{Opt("q:v", "5")}},
+				VideoFilters: append(FilterChain{{Name: "fps", Args: []string{fmt.Sprintf("%d", f.liveFramerate())}}}, filters...),
+				Format:       "image2pipe",
+				URL:          "pipe:1",
+			},
+			{
+				Maps:         []string{"0:v"},
+				NoAudio:      true,
+				Video:        &Encoder{Codec: f.cfg.H264Encoder, Options: videoOpts},
+				VideoFilters: filters,
+				Options: []Option{
+					Optf("b:v", "%dk", f.liveVideoBitrate()),
+					Optf("g", "%d", int(hlsSegment.Seconds())*liveInputFramerate),
+				},
+				Format: "tee",
+				URL: teeSlave("hls", filepath.Join(dir, HLSPlaylist), []Option{
+					Optf("hls_time", "%d", int(hlsSegment.Seconds())),
+					Opt("hls_list_size", "5"),
+					Opt("hls_flags", "delete_segments"),
+					Opt("hls_segment_filename", filepath.Join(dir, "live%d.ts")),
+				}) + "|" + teeSlave("rtp", fmt.Sprintf("rtp://127.0.0.1:%d?rtcpport=%d&pkt_size=%d", videoPort, videoPort, livePacketSize), []Option{
+					Optf("payload_type", "%d", livePayloadType),
+				}),
+			},
+		},
+	}
+}
+
+func (f *ffmpeg) liveFramerate() int {
+	if f.cfg.LiveFramerate == 0 {
+		return defaultLiveFramerate
+	}
+
+	return f.cfg.LiveFramerate
+}
+
+func (f *ffmpeg) liveVideoBitrate() int {
+	if f.cfg.LiveVideoBitrate == 0 {
+		return defaultLiveVideoBitrate
+	}
+
+	return f.cfg.LiveVideoBitrate
+}
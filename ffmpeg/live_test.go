@@ -0,0 +1,177 @@
+package ffmpeg
+
+import (
+	"context"
+	"image"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLiveCommands(t *testing.T) {
+	f := New(Config{VideoDevice: "v4l2", VideoFilename: "/dev/video0", H264Encoder: "h264_omx", LiveFramerate: 10})
+	cmd := f.liveCommand("linux", "/tmp/live", 5004, image.Point{}, nil)
+	checkGolden(t, "live_linux", cmd.Args())
+
+	// mask and overlay are drawn on both outputs
+	filters := FilterChain{{Name: "hue", Args: []string{"s=0"}}}
+	cmd = f.liveCommand("linux", "/tmp/live", 5004, image.Point{X: 1280, Y: 720}, filters)
+	checkGolden(t, "live_linux_filters", cmd.Args())
+
+	f = New(Config{VideoDevice: "avfoundation", VideoFilename: "FaceTime HD Camera", H264Encoder: "h264_videotoolbox"})
+	cmd = f.liveCommand("darwin", "/tmp/live", 5004, image.Point{}, nil)
+	checkGolden(t, "live_darwin", cmd.Args())
+}
+
+func TestLiveFrameFromStream(t *testing.T) {
+	f := New(Config{})
+	if _, _, err := f.LiveFrame(0, time.Millisecond); err != ErrNoLiveView {
+		t.Fatalf("error is=%v want=%v", err, ErrNoLiveView)
+	}
+
+	// a running stream holds the camera; the live view uses its frames
+	tap := newFrameTap()
+	f.streams["session"] = &stream{capture: &process{}, tap: tap}
+	if err := f.AddViewer(); err != nil {
+		t.Fatal(err)
+	}
+	if f.live.process != nil {
+		t.Fatal("live view started while a stream uses the camera")
+	}
+
+	tap.Write(testJPEG(t, 16, 16))
+	frame, seq, err := f.LiveFrame(0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) == 0 || seq != 1 {
+		t.Fatalf("frame is=%d bytes seq=%d", len(frame), seq)
+	}
+
+	f.RemoveViewer()
+	if f.live.watched() {
+		t.Fatal("live view is still watched")
+	}
+}
+
+func TestFrameTapNextFrame(t *testing.T) {
+	tap := newFrameTap()
+	tap.Write(testJPEG(t, 16, 16))
+
+	_, seq, err := tap.nextFrame(0, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same frame is not returned twice
+	if _, _, err := tap.nextFrame(seq, 10*time.Millisecond); err == nil {
+		t.Fatal("expected timeout")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tap.Write(testJPEG(t, 32, 32))
+	}()
+	_, next, err := tap.nextFrame(seq, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != seq+1 {
+		t.Fatalf("seq is=%d want=%d", next, seq+1)
+	}
+}
+
+func TestRecordCommand(t *testing.T) {
+	f := New(Config{H264Encoder: "h264_omx"})
+	checkGolden(t, "record_linux", f.recordCommand("/data/recordings/tamper.mp4").Args())
+}
+
+func TestLiveAfterShutdown(t *testing.T) {
+	f := New(Config{})
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.AddViewer(); err != ErrShutdown {
+		t.Fatalf("error is=%v want=%v", err, ErrShutdown)
+	}
+	if _, err := f.WatchHLS(); err != ErrShutdown {
+		t.Fatalf("error is=%v want=%v", err, ErrShutdown)
+	}
+	if _, err := f.WatchLiveVideo(func([]byte) {}); err != ErrShutdown {
+		t.Fatalf("error is=%v want=%v", err, ErrShutdown)
+	}
+}
+
+func TestMaxViewers(t *testing.T) {
+	f := New(Config{MaxViewers: 2})
+	defer f.Shutdown(context.Background())
+
+	// a running stream keeps the live view from starting ffmpeg
+	f.streams["session"] = &stream{capture: &process{}, tap: newFrameTap()}
+	for i := 0; i < 2; i++ {
+		if err := f.AddViewer(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.AddViewer(); err != ErrTooManyViewers {
+		t.Fatalf("error is=%v want=%v", err, ErrTooManyViewers)
+	}
+
+	f.RemoveViewer()
+	if err := f.AddViewer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiveTemporaryDir(t *testing.T) {
+	f := New(Config{})
+
+	// the directory is created even if ffmpeg cannot be started
+	f.mutex.Lock()
+	f.startLive(image.Point{})
+	dir := f.live.dir
+	f.mutex.Unlock()
+	if _, err := os.Stat(dir); dir == "" || err != nil {
+		t.Fatalf("live directory %q: %v", dir, err)
+	}
+
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("live directory not removed: %v", err)
+	}
+}
+
+func TestRemoveViewerWithoutMutex(t *testing.T) {
+	f := New(Config{})
+	defer f.Shutdown(context.Background())
+
+	// the live view ignores SIGINT and is killed after stopTimeout
+	p := newProcess("live", shell("trap '' INT; echo ready >&2; while true; do sleep 0.01; done"), -1, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	for len(p.status().Stderr) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.mutex.Lock()
+	f.live.process = p
+	f.live.viewers = 1
+	f.mutex.Unlock()
+
+	removed := make(chan struct{})
+	go func() {
+		f.RemoveViewer()
+		close(removed)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	f.ActiveStreams()
+	if d := time.Since(start); d > stopTimeout/2 {
+		t.Fatalf("ffmpeg blocked for %s while the live view stops", d)
+	}
+	<-removed
+}
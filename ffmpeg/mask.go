@@ -0,0 +1,259 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brutella/hc/log"
+)
+
+// Point is a corner of a privacy mask relative to the frame size:
+// (0,0) is the top left and (1,1) the bottom right corner.
+type Point struct {
+	X, Y float64
+}
+
+// Polygon is a privacy mask which is filled black on every frame.
+type Polygon []Point
+
+// ParsePolygon parses a polygon written as "x,y x,y x,y ...",
+// e.g. "0.6,0 1,0 1,0.4 0.6,0.4" masks the top right corner.
+func ParsePolygon(s string) (Polygon, error) {
+	var p Polygon
+	for _, field := range strings.Fields(s) {
+		xy := strings.Split(field, ",")
+		if len(xy) != 2 {
+			return nil, fmt.Errorf("invalid point %q", field)
+		}
+		x, err := strconv.ParseFloat(xy[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		y, err := strconv.ParseFloat(xy[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		if x < 0 || x > 1 || y < 0 || y > 1 {
+			return nil, fmt.Errorf("point %q is outside of the frame", field)
+		}
+		p = append(p, Point{x, y})
+	}
+
+	if len(p) < 3 {
+		return nil, fmt.Errorf("a polygon needs at least 3 points")
+	}
+
+	return p, nil
+}
+
+func (p Polygon) String() string {
+	points := make([]string, len(p))
+	for i, pt := range p {
+		points[i] = strconv.FormatFloat(pt.X, 'f', -1, 64) + "," + strconv.FormatFloat(pt.Y, 'f', -1, 64)
+	}
+
+	return strings.Join(points, " ")
+}
+
+// pixels returns the corners of the polygon in a frame of size.
+func (p Polygon) pixels(size image.Point) []image.Point {
+	pts := make([]image.Point, len(p))
+	for i, pt := range p {
+		pts[i] = image.Pt(int(pt.X*float64(size.X)+0.5), int(pt.Y*float64(size.Y)+0.5))
+	}
+
+	return pts
+}
+
+// fill sets every pixel of img inside the polygon to c.
+// It uses the even-odd rule and samples the center of each pixel.
+func (p Polygon) fill(img draw.Image, c color.Color) {
+	b := img.Bounds()
+	size := b.Size()
+	xs := make([]float64, 0, len(p))
+
+	for y := 0; y < size.Y; y++ {
+		cy := (float64(y) + 0.5) / float64(size.Y)
+
+		xs = xs[:0]
+		for i := range p {
+			a, z := p[i], p[(i+1)%len(p)]
+			if (a.Y <= cy) == (z.Y <= cy) {
+				continue
+			}
+			xs = append(xs, a.X+(cy-a.Y)*(z.X-a.X)/(z.Y-a.Y))
+		}
+		sort.Float64s(xs)
+
+		for i := 0; i+1 < len(xs); i += 2 {
+			// pixels whose center is in [xs[i], xs[i+1])
+			from := int(math.Ceil(xs[i]*float64(size.X) - 0.5))
+			to := int(math.Ceil(xs[i+1]*float64(size.X) - 0.5))
+			for x := from; x < to; x++ {
+				img.Set(b.Min.X+x, b.Min.Y+y, c)
+			}
+		}
+	}
+}
+
+// outline draws the edges of the polygon on img.
+func (p Polygon) outline(img draw.Image, c color.Color) {
+	b := img.Bounds()
+	pts := p.pixels(b.Size())
+	for i := range pts {
+		line(img, pts[i].Add(b.Min), pts[(i+1)%len(pts)].Add(b.Min), c)
+	}
+}
+
+// line draws a line with a width of 3 pixels using Bresenham's algorithm.
+func line(img draw.Image, a, z image.Point, c color.Color) {
+	dx, dy := abs(z.X-a.X), -abs(z.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > z.X {
+		sx = -1
+	}
+	if a.Y > z.Y {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		for ox := -1; ox <= 1; ox++ {
+			for oy := -1; oy <= 1; oy++ {
+				img.Set(a.X+ox, a.Y+oy, c)
+			}
+		}
+		if a == z {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			a.X += sx
+		}
+		if e2 <= dx {
+			err += dx
+			a.Y += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
+
+// privacyMask hides the polygons on every frame.
+// ffmpeg draws the mask as PNG image which is rendered in the size of the camera frames.
+type privacyMask struct {
+	polygons []Polygon
+
+	mutex sync.Mutex
+	// PNG files of the mask by frame size
+	files map[image.Point]string
+}
+
+func newPrivacyMask(polygons []Polygon) *privacyMask {
+	if len(polygons) == 0 {
+		return nil
+	}
+
+	return &privacyMask{
+		polygons: polygons,
+		files:    make(map[image.Point]string, 0),
+	}
+}
+
+// filters returns the filters which draw the mask on frames of size.
+func (m *privacyMask) filters(size image.Point) (FilterChain, error) {
+	file, err := m.file(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return FilterChain{{
+		Name:    "overlay",
+		Sources: []FilterChain{{{Name: "movie", Args: []string{EscapeFilterArg(file)}}}},
+	}}, nil
+}
+
+// file returns the PNG file of the mask for frames of size.
+func (m *privacyMask) file(size image.Point) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if file, ok := m.files[size]; ok {
+		return file, nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+	for _, p := range m.polygons {
+		p.fill(img, color.Black)
+	}
+
+	f, err := ioutil.TempFile("", fmt.Sprintf("hkdoorbell-mask-%dx%d-*.png", size.X, size.Y))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	m.files[size] = f.Name()
+
+	return f.Name(), nil
+}
+
+// removeFiles removes the PNG files of the mask; they are written again when needed.
+func (m *privacyMask) removeFiles() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for size, file := range m.files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Info.Println("privacy mask:", err)
+		}
+		delete(m.files, size)
+	}
+}
+
+// apply returns a copy of img with the mask drawn on it.
+func (m *privacyMask) apply(img image.Image) image.Image {
+	masked := image.NewRGBA(img.Bounds())
+	draw.Draw(masked, masked.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, p := range m.polygons {
+		p.fill(masked, color.Black)
+	}
+
+	return masked
+}
+
+// outline returns a copy of img with the outlines of the mask.
+func (m *privacyMask) outline(img image.Image) image.Image {
+	outlined := image.NewRGBA(img.Bounds())
+	draw.Draw(outlined, outlined.Bounds(), img, img.Bounds().Min, draw.Src)
+	for _, p := range m.polygons {
+		p.outline(outlined, color.RGBA{0xff, 0, 0, 0xff})
+	}
+
+	return outlined
+}
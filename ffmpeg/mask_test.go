@@ -0,0 +1,146 @@
+package ffmpeg
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePolygon(t *testing.T) {
+	p, err := ParsePolygon("0.5,0 1,0 1,0.25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(p), 3; is != want {
+		t.Fatalf("points is=%v want=%v", is, want)
+	}
+	if is, want := p.String(), "0.5,0 1,0 1,0.25"; is != want {
+		t.Fatalf("string is=%v want=%v", is, want)
+	}
+
+	for _, s := range []string{"", "0,0 1,1", "0,0 1 1,1", "0,0 1,x 1,1", "0,0 1.5,0 1,1"} {
+		if _, err := ParsePolygon(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
+
+func TestPrivacyMaskApply(t *testing.T) {
+	// left half of the frame
+	p, _ := ParsePolygon("0,0 0.5,0 0.5,1 0,1")
+	m := newPrivacyMask([]Polygon{p})
+
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 50; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	masked := m.apply(img)
+	if is, want := masked.Bounds(), img.Bounds(); is != want {
+		t.Fatalf("bounds is=%v want=%v", is, want)
+	}
+	for _, pt := range []image.Point{{0, 0}, {49, 25}, {49, 49}} {
+		if r, g, b, _ := masked.At(pt.X, pt.Y).RGBA(); r|g|b != 0 {
+			t.Fatalf("%v is not masked", pt)
+		}
+	}
+	for _, pt := range []image.Point{{50, 0}, {99, 49}} {
+		if r, _, _, _ := masked.At(pt.X, pt.Y).RGBA(); r == 0 {
+			t.Fatalf("%v is masked", pt)
+		}
+	}
+	// the original frame is left untouched
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Fatal("original frame is masked")
+	}
+}
+
+func TestPrivacyMaskTriangle(t *testing.T) {
+	p, _ := ParsePolygon("0,0 1,0 0,1")
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	p.fill(img, color.White)
+
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			if x+y == 9 {
+				// the center of the pixel is on the edge
+				continue
+			}
+			if is, want := img.GrayAt(x, y).Y != 0, x+y < 9; is != want {
+				t.Fatalf("(%d,%d) filled is=%v want=%v", x, y, is, want)
+			}
+		}
+	}
+}
+
+func TestPrivacyMaskFile(t *testing.T) {
+	p, _ := ParsePolygon("0,0 0.5,0 0.5,0.5 0,0.5")
+	m := newPrivacyMask([]Polygon{p})
+
+	file, err := m.file(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+
+	if again, _ := m.file(image.Pt(64, 48)); again != file {
+		t.Fatalf("file is=%v want=%v", again, file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := img.Bounds().Size(), image.Pt(64, 48); is != want {
+		t.Fatalf("size is=%v want=%v", is, want)
+	}
+	// masked pixels are opaque, the rest is transparent
+	if _, _, _, a := img.At(10, 10).RGBA(); a != 0xffff {
+		t.Fatalf("alpha at (10,10) is=%v want=%v", a, 0xffff)
+	}
+	if _, _, _, a := img.At(40, 30).RGBA(); a != 0 {
+		t.Fatalf("alpha at (40,30) is=%v want=%v", a, 0)
+	}
+
+	chain, err := m.filters(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := chain.String(); !strings.HasPrefix(s, "movie=") || !strings.HasSuffix(s, "[in][s0]overlay[out]") {
+		t.Fatalf("filters is=%v", s)
+	}
+
+	m.removeFiles()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("file not removed: %v", err)
+	}
+}
+
+func TestPrivacyMaskOutline(t *testing.T) {
+	p, _ := ParsePolygon("0.2,0.2 0.8,0.2 0.8,0.8 0.2,0.8")
+	m := newPrivacyMask([]Polygon{p})
+
+	outlined := m.outline(image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	if r, _, _, _ := outlined.At(20, 50).RGBA(); r != 0xffff {
+		t.Fatal("missing outline at (20,50)")
+	}
+	if r, _, _, _ := outlined.At(50, 50).RGBA(); r != 0 {
+		t.Fatal("unexpected outline at (50,50)")
+	}
+}
+
+func TestNoPrivacyMask(t *testing.T) {
+	if m := newPrivacyMask(nil); m != nil {
+		t.Fatalf("mask is=%v want=nil", m)
+	}
+}
@@ -0,0 +1,146 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Overlay describes the text and the logo burned into streams and snapshots.
+type Overlay struct {
+	// Text is a text/template which may use {{.Camera}}, {{.Timestamp}} and
+	// {{.Zone}}, e.g. "{{.Camera}} {{.Timestamp}} {{.Zone}}"; empty disables the text.
+	// Timestamp and zone are updated on every frame.
+	Text string
+	// TimestampFormat is the strftime format of {{.Timestamp}}
+	TimestampFormat string
+	// TimeZone is the IANA time zone of {{.Timestamp}}, e.g. "Europe/Rome";
+	// empty uses the time zone of the system
+	TimeZone string
+	// CameraName is the value of {{.Camera}}
+	CameraName string
+	// Logo is the path of a PNG image drawn in the top right corner
+	Logo string
+	// FontFile is the path of the font; ffmpeg needs it when built without fontconfig
+	FontFile string
+	FontSize int
+}
+
+const (
+	defaultTimestampFormat = "%Y-%m-%d %H:%M:%S"
+	defaultFontSize        = 24
+	// placeholders for {{.Timestamp}} and {{.Zone}} while the template is escaped
+	timestampPlaceholder = "\x00timestamp\x00"
+	zonePlaceholder      = "\x00zone\x00"
+)
+
+// overlayText contains the values available in Overlay.Text.
+type overlayText struct {
+	Camera    string
+	Zone      string
+	Timestamp string
+}
+
+// Enabled returns true if the overlay draws something.
+func (o Overlay) Enabled() bool {
+	return o.Text != "" || o.Logo != ""
+}
+
+// Filters returns the filters which draw the overlay on a video at full resolution.
+// Every pipeline (stream, snapshot or recording) uses the same filters so that
+// the overlay looks the same everywhere.
+func (o Overlay) Filters() (FilterChain, error) {
+	var chain FilterChain
+
+	if o.Logo != "" {
+		if _, err := os.Stat(o.Logo); err != nil {
+			return nil, err
+		}
+		chain = append(chain, Filter{
+			Name:    "overlay",
+			Args:    []string{"main_w-overlay_w-10", "10"},
+			Sources: []FilterChain{{{Name: "movie", Args: []string{EscapeFilterArg(o.Logo)}}}},
+		})
+	}
+
+	if o.Text != "" {
+		text, err := o.drawtext()
+		if err != nil {
+			return nil, err
+		}
+
+		args := []string{"text=" + EscapeFilterArg(text)}
+		if o.FontFile != "" {
+			args = append(args, "fontfile="+EscapeFilterArg(o.FontFile))
+		}
+		args = append(args,
+			fmt.Sprintf("fontsize=%d", o.fontSize()),
+			"fontcolor=white",
+			"box=1",
+			"boxcolor=black@0.5",
+			"boxborderw=5",
+			"x=10",
+			"y=h-th-10")
+		chain = append(chain, Filter{Name: "drawtext", Args: args})
+	}
+
+	return chain, nil
+}
+
+// Env returns the environment of the ffmpeg processes which draw the overlay.
+// drawtext formats the timestamp in the time zone taken from TZ.
+func (o Overlay) Env() ([]string, error) {
+	if o.TimeZone == "" {
+		return nil, nil
+	}
+
+	if _, err := time.LoadLocation(o.TimeZone); err != nil {
+		return nil, err
+	}
+
+	return append(os.Environ(), "TZ="+o.TimeZone), nil
+}
+
+// drawtext returns the text expanded by the drawtext filter.
+func (o Overlay) drawtext() (string, error) {
+	tmpl, err := template.New("overlay").Parse(o.Text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, overlayText{
+		Camera:    o.CameraName,
+		Zone:      zonePlaceholder,
+		Timestamp: timestampPlaceholder,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// a literal backslash or percent sign would start an escape or an expansion
+	text := escape(buf.String(), `\%`)
+	format := o.TimestampFormat
+	if format == "" {
+		format = defaultTimestampFormat
+	}
+	text = strings.Replace(text, timestampPlaceholder, localtime(format), -1)
+
+	return strings.Replace(text, zonePlaceholder, localtime("%Z"), -1), nil
+}
+
+// localtime returns the drawtext expansion of the current time in strftime format.
+func localtime(format string) string {
+	return "%{localtime:" + escape(format, `\':}`) + "}"
+}
+
+func (o Overlay) fontSize() int {
+	if o.FontSize == 0 {
+		return defaultFontSize
+	}
+
+	return o.FontSize
+}
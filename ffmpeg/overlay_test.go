@@ -0,0 +1,83 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverlayDrawtext(t *testing.T) {
+	o := Overlay{
+		Text:            "{{.Camera}} 100% {{.Timestamp}} {{.Zone}}",
+		TimestampFormat: "%d/%m/%Y %H:%M",
+		CameraName:      `Front\Door`,
+	}
+
+	text, err := o.drawtext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := text, `Front\\Door 100\% %{localtime:%d/%m/%Y %H\:%M} %{localtime:%Z}`; is != want {
+		t.Fatalf("text is=%v want=%v", is, want)
+	}
+}
+
+func TestOverlayFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	if err := ioutil.WriteFile(logo, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := Overlay{Text: "{{.Timestamp}}", Logo: logo, FontFile: "/usr/share/fonts/DejaVuSans.ttf", FontSize: 32}
+	chain, err := o.Filters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph := chain.String()
+	for _, want := range []string{
+		"movie=" + logo + "[s0];[in][s0]overlay=main_w-overlay_w-10:10,drawtext=",
+		`text=%{localtime\\:%Y-%m-%d %H\\\\\\:%M\\\\\\:%S}`,
+		"fontfile=/usr/share/fonts/DejaVuSans.ttf:fontsize=32:",
+	} {
+		if !strings.Contains(graph, want) {
+			t.Fatalf("graph %q does not contain %q", graph, want)
+		}
+	}
+	if !strings.HasSuffix(graph, "[out]") {
+		t.Fatalf("graph %q is not terminated", graph)
+	}
+}
+
+func TestOverlayErrors(t *testing.T) {
+	if _, err := (Overlay{Logo: "/nonexistent/logo.png"}).Filters(); err == nil {
+		t.Fatal("expected error for missing logo")
+	}
+	if _, err := (Overlay{Text: "{{.Camera"}).Filters(); err == nil {
+		t.Fatal("expected error for invalid template")
+	}
+	if _, err := (Overlay{TimeZone: "Mars/Olympus_Mons"}).Env(); err == nil {
+		t.Fatal("expected error for unknown time zone")
+	}
+}
+
+func TestOverlayEnv(t *testing.T) {
+	env, err := (Overlay{TimeZone: "Europe/Rome"}).Env()
+	if err != nil {
+		t.Skip("missing time zone database:", err)
+	}
+	if is, want := env[len(env)-1], "TZ=Europe/Rome"; is != want {
+		t.Fatalf("env is=%v want=%v", is, want)
+	}
+
+	if env, _ := (Overlay{}).Env(); env != nil {
+		t.Fatalf("env is=%v want=nil", env)
+	}
+}
@@ -0,0 +1,357 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brutella/hc/log"
+)
+
+// ProcessState is the state of a supervised ffmpeg process.
+type ProcessState int
+
+const (
+	ProcessStarting   ProcessState = iota // the process has not been started yet
+	ProcessRunning                        // the process is running
+	ProcessRestarting                     // the process exited and waits to be restarted
+	ProcessFailed                         // the process exited too often and is not restarted anymore
+	ProcessStopped                        // the process was stopped on request
+)
+
+func (s ProcessState) String() string {
+	switch s {
+	case ProcessStarting:
+		return "starting"
+	case ProcessRunning:
+		return "running"
+	case ProcessRestarting:
+		return "restarting"
+	case ProcessFailed:
+		return "failed"
+	case ProcessStopped:
+		return "stopped"
+	}
+
+	return "unknown"
+}
+
+// MarshalText lets the state be encoded as a string in JSON.
+func (s ProcessState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ProcessStatus describes the health of a supervised ffmpeg process.
+type ProcessStatus struct {
+	Name     string
+	State    ProcessState
+	Pid      int
+	Restarts int
+	Started  time.Time
+	LastErr  string
+	// last lines written by the process to stderr
+	Stderr []string
+}
+
+// Healthy returns true if the process is running or still starting.
+func (s ProcessStatus) Healthy() bool {
+	return s.State == ProcessStarting || s.State == ProcessRunning
+}
+
+var (
+	// the first restart is delayed by restartBackoff; every further consecutive
+	// failure doubles the delay up to maxRestartBackoff
+	restartBackoff    = 1 * time.Second
+	maxRestartBackoff = 30 * time.Second
+	// a process which runs at least stableAfter resets the failure counter
+	stableAfter = 30 * time.Second
+	// how long stop waits after SIGINT before it kills the process
+	stopTimeout = 5 * time.Second
+)
+
+// process supervises a single ffmpeg child.
+// The child is restarted with an exponential backoff when it exits unexpectedly.
+type process struct {
+	name        string
+	command     func() *exec.Cmd
+	maxRestarts int
+	stderr      *lineBuffer
+
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	state    ProcessState
+	restarts int
+	failures int
+	started  time.Time
+	lastErr  error
+	// reloading is set while the child is interrupted to restart it with a new command
+	reloading bool
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// newProcess returns a process which uses command to create the child on every (re)start.
+// A negative maxRestarts restarts the child forever.
+func newProcess(name string, command func() *exec.Cmd, maxRestarts int, stderrLines int) *process {
+	return &process{
+		name:        name,
+		command:     command,
+		maxRestarts: maxRestarts,
+		stderr:      newLineBuffer(stderrLines),
+		state:       ProcessStarting,
+		quit:        make(chan struct{}),
+	}
+}
+
+// start runs the child and supervises it until stop is called.
+func (p *process) start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.run(); err != nil {
+		p.state = ProcessFailed
+		p.lastErr = err
+		return err
+	}
+
+	p.done = make(chan struct{})
+	go p.supervise(p.cmd)
+
+	return nil
+}
+
+// run starts a new child; the caller must hold the mutex.
+func (p *process) run() error {
+	cmd := p.command()
+	cmd.Stderr = io.MultiWriter(Stderr, p.stderr)
+	log.Debug.Println(p.name, cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	p.cmd = cmd
+	p.state = ProcessRunning
+	p.started = time.Now()
+
+	return nil
+}
+
+func (p *process) supervise(cmd *exec.Cmd) {
+	defer close(p.done)
+
+	for {
+		err := cmd.Wait()
+
+		p.mutex.Lock()
+		select {
+		case <-p.quit:
+			p.state = ProcessStopped
+			p.mutex.Unlock()
+			return
+		default:
+		}
+
+		if p.reloading {
+			p.reloading = false
+			p.restarts++
+			if err = p.run(); err == nil {
+				cmd = p.cmd
+				p.mutex.Unlock()
+				continue
+			}
+		}
+
+		if err == nil {
+			err = fmt.Errorf("exited")
+		}
+		p.lastErr = err
+		if time.Since(p.started) >= stableAfter {
+			p.failures = 0
+		}
+		p.failures++
+		log.Info.Printf("%s (pid %d): %s\n", p.name, cmd.Process.Pid, err)
+
+		cmd = nil
+		for cmd == nil {
+			if p.maxRestarts >= 0 && p.failures > p.maxRestarts {
+				log.Info.Printf("%s: giving up after %d failures\n", p.name, p.failures)
+				p.state = ProcessFailed
+				p.mutex.Unlock()
+				return
+			}
+
+			p.state = ProcessRestarting
+			delay := backoff(p.failures)
+			p.mutex.Unlock()
+
+			select {
+			case <-p.quit:
+				p.mutex.Lock()
+				p.state = ProcessStopped
+				p.mutex.Unlock()
+				return
+			case <-time.After(delay):
+			}
+
+			p.mutex.Lock()
+			p.restarts++
+			if err := p.run(); err != nil {
+				p.lastErr = err
+				p.failures++
+				continue
+			}
+			cmd = p.cmd
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// stop interrupts the child and waits until it has exited.
+func (p *process) stop() {
+	p.mutex.Lock()
+	select {
+	case <-p.quit:
+		p.mutex.Unlock()
+		return
+	default:
+	}
+	close(p.quit)
+	cmd := p.cmd
+	done := p.done
+	if p.state == ProcessRunning && cmd != nil {
+		cmd.Process.Signal(syscall.SIGINT)
+		// a suspended process does not react to SIGINT
+		cmd.Process.Signal(syscall.SIGCONT)
+	}
+	p.mutex.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		log.Info.Printf("%s: did not exit; kill it\n", p.name)
+		p.mutex.Lock()
+		p.cmd.Process.Kill()
+		p.mutex.Unlock()
+		<-done
+	}
+}
+
+// reload restarts the child with command.
+// The restart is immediate and is not counted as failure.
+func (p *process) reload(command func() *exec.Cmd) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.command = command
+	if p.state == ProcessRunning && p.cmd != nil {
+		p.reloading = true
+		p.cmd.Process.Signal(syscall.SIGINT)
+		p.cmd.Process.Signal(syscall.SIGCONT)
+	}
+}
+
+// signal sends sig to the running child.
+func (p *process) signal(sig syscall.Signal) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.state == ProcessRunning && p.cmd != nil {
+		p.cmd.Process.Signal(sig)
+	}
+}
+
+func (p *process) status() ProcessStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	s := ProcessStatus{
+		Name:     p.name,
+		State:    p.state,
+		Restarts: p.restarts,
+		Started:  p.started,
+		Stderr:   p.stderr.Lines(),
+	}
+	if p.state == ProcessRunning && p.cmd != nil {
+		s.Pid = p.cmd.Process.Pid
+	}
+	if p.lastErr != nil {
+		s.LastErr = p.lastErr.Error()
+	}
+
+	return s
+}
+
+func backoff(failures int) time.Duration {
+	d := restartBackoff
+	for i := 1; i < failures && d < maxRestartBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRestartBackoff {
+		d = maxRestartBackoff
+	}
+
+	return d
+}
+
+// lineBuffer keeps the last lines written to it.
+type lineBuffer struct {
+	mutex   sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newLineBuffer(max int) *lineBuffer {
+	return &lineBuffer{max: max}
+}
+
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.partial = append(b.partial, p...)
+	for {
+		// ffmpeg terminates progress lines with \r
+		i := bytes.IndexAny(b.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			b.add(string(b.partial[:i]))
+		}
+		b.partial = b.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (b *lineBuffer) add(line string) {
+	if b.max <= 0 {
+		return
+	}
+	if len(b.lines) == b.max {
+		copy(b.lines, b.lines[1:])
+		b.lines = b.lines[:b.max-1]
+	}
+	b.lines = append(b.lines, line)
+}
+
+// Lines returns a copy of the buffered lines, the oldest first.
+func (b *lineBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	lines := make([]string, len(b.lines))
+	copy(lines, b.lines)
+
+	return lines
+}
@@ -0,0 +1,155 @@
+package ffmpeg
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func init() {
+	restartBackoff = 10 * time.Millisecond
+	maxRestartBackoff = 40 * time.Millisecond
+	stopTimeout = 500 * time.Millisecond
+}
+
+func shell(script string) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		return exec.Command("sh", "-c", script)
+	}
+}
+
+func waitForState(t *testing.T, p *process, state ProcessState) ProcessStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if st := p.status(); st.State == state {
+			return st
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("state is=%v want=%v", p.status().State, state)
+
+	return ProcessStatus{}
+}
+
+func TestProcessRestartsUntilFailed(t *testing.T) {
+	p := newProcess("test", shell("echo boom >&2; exit 1"), 2, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	st := waitForState(t, p, ProcessFailed)
+	if is, want := st.Restarts, 2; is != want {
+		t.Fatalf("restarts is=%v want=%v", is, want)
+	}
+	if is, want := st.LastErr, "exit status 1"; is != want {
+		t.Fatalf("error is=%v want=%v", is, want)
+	}
+	if is, want := st.Stderr, []string{"boom", "boom", "boom"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("stderr is=%v want=%v", is, want)
+	}
+	if st.Healthy() {
+		t.Fatal("failed process is healthy")
+	}
+}
+
+func TestProcessStop(t *testing.T) {
+	p := newProcess("test", shell("exec sleep 10"), -1, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := p.status()
+	if is, want := st.State, ProcessRunning; is != want {
+		t.Fatalf("state is=%v want=%v", is, want)
+	}
+	if st.Pid == 0 {
+		t.Fatal("missing pid")
+	}
+
+	p.stop()
+	if is, want := p.status().State, ProcessStopped; is != want {
+		t.Fatalf("state is=%v want=%v", is, want)
+	}
+	if is, want := p.status().Restarts, 0; is != want {
+		t.Fatalf("restarts is=%v want=%v", is, want)
+	}
+}
+
+func TestProcessReload(t *testing.T) {
+	// a single failure would stop the process
+	p := newProcess("test", shell("exec sleep 10"), 0, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.stop()
+
+	p.reload(shell("echo reloaded >&2; exec sleep 10"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.status().Stderr) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	st := p.status()
+	if is, want := st.State, ProcessRunning; is != want {
+		t.Fatalf("state is=%v want=%v", is, want)
+	}
+	if is, want := st.Restarts, 1; is != want {
+		t.Fatalf("restarts is=%v want=%v", is, want)
+	}
+	if is, want := st.Stderr, []string{"reloaded"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("stderr is=%v want=%v", is, want)
+	}
+}
+
+func TestProcessStopIgnoringSIGINT(t *testing.T) {
+	p := newProcess("test", shell("trap '' INT; while true; do sleep 0.01; done"), -1, 10)
+	if err := p.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.stop()
+	if is, want := p.status().State, ProcessStopped; is != want {
+		t.Fatalf("state is=%v want=%v", is, want)
+	}
+}
+
+func TestProcessStartError(t *testing.T) {
+	p := newProcess("test", func() *exec.Cmd {
+		return exec.Command("/nonexistent/ffmpeg")
+	}, -1, 10)
+	if err := p.start(); err == nil {
+		t.Fatal("expected error")
+	}
+	p.stop()
+
+	if is, want := p.status().State, ProcessFailed; is != want {
+		t.Fatalf("state is=%v want=%v", is, want)
+	}
+}
+
+func TestLineBuffer(t *testing.T) {
+	b := newLineBuffer(2)
+	b.Write([]byte("frame=1\rframe=2\r"))
+	b.Write([]byte("error: "))
+	b.Write([]byte("device busy\n"))
+
+	if is, want := b.Lines(), []string{"frame=2", "error: device busy"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("lines is=%v want=%v", is, want)
+	}
+}
+
+func TestStderrLinesDisabled(t *testing.T) {
+	f := New(Config{StderrLines: -1})
+	b := newLineBuffer(f.stderrLines())
+	b.Write([]byte("error: device busy\n"))
+
+	if is := b.Lines(); len(is) != 0 {
+		t.Fatalf("lines is=%v", is)
+	}
+	if is, want := New(Config{}).stderrLines(), defaultStderrLines; is != want {
+		t.Fatalf("default lines is=%d want=%d", is, want)
+	}
+}
@@ -0,0 +1,80 @@
+package ffmpeg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/brutella/hc/log"
+)
+
+// Record records the frames of the live view for d into file (mp4) and waits for the end.
+// During a stream the frames come from the stream at its snapshot framerate.
+func (f *ffmpeg) Record(file string, d time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := f.AddViewer(); err != nil {
+		return err
+	}
+	defer f.RemoveViewer()
+
+	cmd := exec.Command("ffmpeg", f.recordCommand(file).Args()...)
+	cmd.Env = f.env
+	cmd.Stdout = Stdout
+	cmd.Stderr = Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	log.Debug.Println("record", file)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var seq uint64
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		frame, next, err := f.LiveFrame(seq, time.Until(end))
+		if err != nil {
+			// the live view restarts when a stream releases the camera
+			if err == ErrNoLiveView {
+				time.Sleep(100 * time.Millisecond)
+			}
+			continue
+		}
+		seq = next
+		if _, err := stdin.Write(frame); err != nil {
+			break
+		}
+	}
+	stdin.Close()
+
+	return cmd.Wait()
+}
+
+// recordCommand returns the ffmpeg command which encodes the jpeg frames
+// written to stdin into file; the frames are timed as they arrive.
+func (f *ffmpeg) recordCommand(file string) Command {
+	return Command{
+		Global: []Option{Flag("hide_banner"), Flag("y")},
+		Inputs: []Input{{
+			Options: []Option{Opt("use_wallclock_as_timestamps", "1")},
+			Format:  "image2pipe",
+			URL:     "pipe:0",
+		}},
+		Outputs: []Output{{
+			NoAudio: true,
+			Video: &Encoder{Codec: f.cfg.H264Encoder, Options: []Option{
+				Opt("pix_fmt", "yuv420p"),
+			}},
+			Options: []Option{
+				Optf("b:v", "%dk", f.liveVideoBitrate()),
+				Opt("vsync", "vfr"),
+				Opt("movflags", "+faststart"),
+			},
+			Format: "mp4",
+			URL:    file,
+		}},
+	}
+}
@@ -0,0 +1,136 @@
+package ffmpeg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// RTCP packet types which carry reception reports (RFC 3550 6.4)
+const (
+	rtcpSenderReport   = 200
+	rtcpReceiverReport = 201
+)
+
+const (
+	// length of a reception report block
+	rtcpReportLength = 24
+	// length of the sender info of a sender report
+	rtcpSenderInfoLength = 20
+	// seconds between the NTP epoch 1900 and the unix epoch 1970
+	ntpEpochOffset = 2208988800
+	// clock rate of the RTP timestamps of the video
+	videoClockRate = 90000
+)
+
+// receptionReport describes how the controller receives a stream.
+type receptionReport struct {
+	SSRC uint32
+	// FractionLost is the fraction of packets lost since the last report in 1/256
+	FractionLost uint8
+	// Lost is the cumulative number of packets lost
+	Lost int32
+	// HighestSeq is the extended highest sequence number received
+	HighestSeq uint32
+	// Jitter is the interarrival jitter in timestamp units
+	Jitter uint32
+	// LSR is the middle of the NTP timestamp of the last sender report;
+	// DLSR is the delay since it was received in 1/65536 seconds
+	LSR  uint32
+	DLSR uint32
+}
+
+// loss returns the fraction of packets lost since the last report.
+func (r receptionReport) loss() float64 {
+	return float64(r.FractionLost) / 256
+}
+
+// jitter returns the interarrival jitter of the video.
+func (r receptionReport) jitter() time.Duration {
+	return time.Duration(r.Jitter) * time.Second / videoClockRate
+}
+
+// roundTrip returns the round trip time of the report received at t;
+// zero if the controller has not received a sender report yet.
+func (r receptionReport) roundTrip(t time.Time) time.Duration {
+	if r.LSR == 0 {
+		return 0
+	}
+
+	rtt := ntpShort(t) - r.LSR - r.DLSR
+	if int32(rtt) < 0 {
+		return 0
+	}
+
+	return time.Duration(rtt) * time.Second / 65536
+}
+
+// ntpShort returns the middle 32 bits of the NTP timestamp of t.
+func ntpShort(t time.Time) uint32 {
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+
+	return uint32(secs<<16) | uint32(frac>>16)
+}
+
+// parseReports returns the reception reports of the sender and receiver reports in the compound packet pkt.
+func parseReports(pkt []byte) ([]receptionReport, error) {
+	var reports []receptionReport
+	for len(pkt) > 0 {
+		if len(pkt) < 4 {
+			return nil, fmt.Errorf("rtcp packet of %d bytes is too short", len(pkt))
+		}
+		if version := pkt[0] >> 6; version != 2 {
+			return nil, fmt.Errorf("unsupported rtcp version %d", version)
+		}
+		count := int(pkt[0] & 0x1f)
+		length := (int(binary.BigEndian.Uint16(pkt[2:4])) + 1) * 4
+		if length > len(pkt) {
+			return nil, fmt.Errorf("rtcp packet of %d bytes exceeds the %d bytes received", length, len(pkt))
+		}
+		typ, body := pkt[1], pkt[4:length]
+		pkt = pkt[length:]
+
+		// the SSRC of the sender precedes the report blocks
+		var blocks []byte
+		switch typ {
+		case rtcpSenderReport:
+			if len(body) < 4+rtcpSenderInfoLength {
+				return nil, fmt.Errorf("rtcp sender report of %d bytes is too short", len(body))
+			}
+			blocks = body[4+rtcpSenderInfoLength:]
+		case rtcpReceiverReport:
+			if len(body) < 4 {
+				return nil, fmt.Errorf("rtcp receiver report of %d bytes is too short", len(body))
+			}
+			blocks = body[4:]
+		default:
+			continue
+		}
+
+		if len(blocks) < count*rtcpReportLength {
+			return nil, fmt.Errorf("rtcp report with %d blocks is too short", count)
+		}
+		for i := 0; i < count; i++ {
+			b := blocks[i*rtcpReportLength:]
+			// the cumulative number of packets lost is a signed 24 bit integer
+			lost := int32(binary.BigEndian.Uint32(b[4:8])<<8) >> 8
+			reports = append(reports, receptionReport{
+				SSRC:         binary.BigEndian.Uint32(b[0:4]),
+				FractionLost: b[4],
+				Lost:         lost,
+				HighestSeq:   binary.BigEndian.Uint32(b[8:12]),
+				Jitter:       binary.BigEndian.Uint32(b[12:16]),
+				LSR:          binary.BigEndian.Uint32(b[16:20]),
+				DLSR:         binary.BigEndian.Uint32(b[20:24]),
+			})
+		}
+	}
+
+	return reports, nil
+}
+
+// isRTCP returns true if pkt is an RTCP packet multiplexed with RTP (RFC 5761 4).
+func isRTCP(pkt []byte) bool {
+	return len(pkt) > 1 && pkt[1] >= 192 && pkt[1] <= 223
+}
@@ -0,0 +1,175 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// RFC 3711 B.3
+func TestDeriveSessionKey(t *testing.T) {
+	key := unhex(t, "E1F97A0D3E018BE0D64FA32C06DE4139")
+	salt := unhex(t, "0EC675AD498AFEEBB6960B3AABE6")
+
+	tests := []struct {
+		label byte
+		want  string
+	}{
+		{0x00, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{0x01, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+		{0x02, "30CBBC08863D8C85D49DB34A9AE1"},
+	}
+	for _, test := range tests {
+		want := unhex(t, test.want)
+		is, err := deriveSessionKey(key, salt, test.label, len(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(is, want) {
+			t.Fatalf("label %d key is=%X want=%X", test.label, is, want)
+		}
+	}
+}
+
+// protectSRTCP encrypts and authenticates pkt like the controller does.
+func protectSRTCP(t *testing.T, crypto rtp.CryptoSuite, pkt []byte, index uint32) []byte {
+	key, _ := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, srtcpLabelEncryption, 16)
+	authKey, _ := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, srtcpLabelAuth, 20)
+	salt, _ := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, srtcpLabelSalt, 14)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= pkt[4+i]
+	}
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], index)
+	for i := 0; i < 4; i++ {
+		iv[10+i] ^= idx[i]
+	}
+
+	out := append([]byte{}, pkt...)
+	cipher.NewCTR(block, iv).XORKeyStream(out[8:], out[8:])
+	binary.BigEndian.PutUint32(idx[:], index|1<<31)
+	out = append(out, idx[:]...)
+
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(out)
+
+	return append(out, mac.Sum(nil)[:srtcpTagLength]...)
+}
+
+// receiverReport returns an RTCP receiver report with a single report block.
+func receiverReport(r receptionReport) []byte {
+	pkt := make([]byte, 8+rtcpReportLength)
+	pkt[0] = 2<<6 | 1
+	pkt[1] = rtcpReceiverReport
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)/4-1))
+	binary.BigEndian.PutUint32(pkt[4:], 0xcafe)
+
+	b := pkt[8:]
+	binary.BigEndian.PutUint32(b[0:], r.SSRC)
+	binary.BigEndian.PutUint32(b[4:], uint32(r.Lost)&0xffffff)
+	b[4] = r.FractionLost
+	binary.BigEndian.PutUint32(b[8:], r.HighestSeq)
+	binary.BigEndian.PutUint32(b[12:], r.Jitter)
+	binary.BigEndian.PutUint32(b[16:], r.LSR)
+	binary.BigEndian.PutUint32(b[20:], r.DLSR)
+
+	return pkt
+}
+
+func TestSRTCPDecrypt(t *testing.T) {
+	crypto := testCrypto(1)
+	c, err := newSRTCP(crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := receiverReport(receptionReport{SSRC: 1111, FractionLost: 64, Lost: -2, HighestSeq: 7, Jitter: 900})
+	pkt := protectSRTCP(t, crypto, plain, 42)
+	if bytes.Equal(pkt[8:len(plain)], plain[8:]) {
+		t.Fatal("report is not encrypted")
+	}
+
+	is, err := c.decrypt(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(is, plain) {
+		t.Fatalf("decrypted is=%X want=%X", is, plain)
+	}
+
+	pkt[10] ^= 0xff
+	if _, err := c.decrypt(pkt); err == nil {
+		t.Fatal("modified packet is authentic")
+	}
+
+	if _, err := newSRTCP(rtp.CryptoSuite{MasterKey: []byte{1}}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestParseReports(t *testing.T) {
+	want := receptionReport{SSRC: 1111, FractionLost: 64, Lost: -2, HighestSeq: 7, Jitter: 900, LSR: 3, DLSR: 4}
+
+	// a sender report without blocks followed by a receiver report
+	sr := make([]byte, 4+4+rtcpSenderInfoLength)
+	sr[0] = 2 << 6
+	sr[1] = rtcpSenderReport
+	binary.BigEndian.PutUint16(sr[2:], uint16(len(sr)/4-1))
+
+	reports, err := parseReports(append(sr, receiverReport(want)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0] != want {
+		t.Fatalf("reports is=%+v want=%+v", reports, want)
+	}
+	if is, want := reports[0].loss(), 0.25; is != want {
+		t.Fatalf("loss is=%v want=%v", is, want)
+	}
+	if is, want := reports[0].jitter(), 10*time.Millisecond; is != want {
+		t.Fatalf("jitter is=%v want=%v", is, want)
+	}
+
+	if _, err := parseReports(receiverReport(want)[:20]); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	sent := time.Date(2020, 7, 4, 12, 0, 0, 0, time.UTC)
+	received := sent.Add(300 * time.Millisecond)
+
+	// the controller held the sender report for 100ms
+	r := receptionReport{LSR: ntpShort(sent), DLSR: 65536 / 10}
+	if is, want := r.roundTrip(received), 200*time.Millisecond; is < want-time.Millisecond || is > want+time.Millisecond {
+		t.Fatalf("round trip is=%v want=%v", is, want)
+	}
+
+	if is := (receptionReport{}).roundTrip(received); is != 0 {
+		t.Fatalf("round trip without sender report is=%v want=0", is)
+	}
+}
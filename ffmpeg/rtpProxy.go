@@ -1,60 +1,168 @@
 package ffmpeg
 
 import (
+	"context"
 	"fmt"
-        "net"
+	"net"
+	"sync"
+
 	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/rtp"
 )
 
+// rtpProxy forwards the packets between the controller and the local ffmpeg ports.
 type rtpProxy struct {
-	rtpProxyExit      bool
-	controllerIPAddr  string
-	bindPort          uint16
-	localRTPPort1     uint16
-	localRTPPort2     uint16
-}
+	controllerIPAddr string
+	bindPort         uint16
+	localRTPPort1    uint16
+	localRTPPort2    uint16
+	// srtpPort receives the plain RTP and RTCP packets of the capture process, which the proxy
+	// protects with crypto before it sends them to the controller; zero disables it
+	srtpPort uint16
+	crypto   rtp.CryptoSuite
+	// receive is called with every packet from the controller; it may be nil
+	receive func(packet []byte)
+	// sent counts the RTP packets forwarded to the controller
+	sent packetCounter
 
+	// cancel stops the forwarding; done is closed when it has stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-func (r *rtpProxy) start() {
-        log.Debug.Println(fmt.Sprintf("start rtp proxy: %s:%d - local RTP ports: %d and %d",
+// start listens on bindPort and forwards the packets in the background
+// until ctx is done or stop is called.
+func (r *rtpProxy) start(ctx context.Context) error {
+	log.Debug.Println(fmt.Sprintf("start rtp proxy: %s:%d - local RTP ports: %d and %d",
 		r.controllerIPAddr, r.bindPort, r.localRTPPort1, r.localRTPPort2))
 
-	r.rtpProxyExit = false
+	var sender *srtpSender
+	if r.srtpPort != 0 {
+		var err error
+		if sender, err = newSRTPSender(r.crypto); err != nil {
+			return err
+		}
+	}
 
 	connection, err := net.ListenUDP("udp", &net.UDPAddr{
 		Port: int(r.bindPort),
 		IP:   net.ParseIP("0.0.0.0"),
 	})
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
+	}
+
+	var plain *net.UDPConn
+	if sender != nil {
+		plain, err = net.ListenUDP("udp", &net.UDPAddr{
+			Port: int(r.srtpPort),
+			IP:   net.IPv4(127, 0, 0, 1),
+		})
+		if err != nil {
+			connection.Close()
+			return err
+		}
 	}
 
-	defer connection.Close()
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+
+	// closing the connections interrupts the pending reads
+	go func() {
+		<-ctx.Done()
+		connection.Close()
+		if plain != nil {
+			plain.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.forward(ctx, connection)
+	}()
+	if plain != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.protect(ctx, plain, connection, sender)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(r.done)
+	}()
+
+	return nil
+}
+
+// protect sends the packets of the capture process received on plain
+// to the controller from connection after protecting them with sender.
+func (r *rtpProxy) protect(ctx context.Context, plain *net.UDPConn, connection *net.UDPConn, sender *srtpSender) {
+	controller := &net.UDPAddr{IP: net.ParseIP(r.controllerIPAddr), Port: int(r.bindPort)}
 	buffer := make([]byte, 2048)
 
 	for {
-		n, addr, _ := connection.ReadFromUDP(buffer)
-		if (addr.String() == fmt.Sprintf("%s:%d", r.controllerIPAddr, r.bindPort)) {
-			//log.Debug.Println("From " + addr.String() + "; send to local")
-			a, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", r.localRTPPort1))
-			_, _ = connection.WriteTo(buffer[0:n], a)
-			a, _ = net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", r.localRTPPort2))
-			_, _ = connection.WriteTo(buffer[0:n], a)
-		} else {
-			//log.Debug.Println("From " + addr.String() + "; send to remote")
-			a, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", r.controllerIPAddr, r.bindPort))
-			_, _ = connection.WriteTo(buffer[0:n], a)
+		n, _, err := plain.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Info.Println("rtp proxy:", err)
+			}
+			return
 		}
 
-		if (r.rtpProxyExit) {
-			return
+		pkt, err := sender.protect(buffer[0:n])
+		if err != nil {
+			log.Debug.Println("srtp:", err)
+			continue
+		}
+		if _, err := connection.WriteTo(pkt, controller); err == nil && !isRTCP(pkt) {
+			r.sent.add(len(pkt))
 		}
 	}
 }
 
+func (r *rtpProxy) forward(ctx context.Context, connection *net.UDPConn) {
+
+	controller := &net.UDPAddr{IP: net.ParseIP(r.controllerIPAddr), Port: int(r.bindPort)}
+	local1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(r.localRTPPort1)}
+	local2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(r.localRTPPort2)}
+	buffer := make([]byte, 2048)
+
+	for {
+		n, addr, err := connection.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Info.Println("rtp proxy:", err)
+			}
+			return
+		}
 
+		if addr.IP.Equal(controller.IP) && addr.Port == controller.Port {
+			if r.receive != nil {
+				r.receive(buffer[0:n])
+			}
+			connection.WriteTo(buffer[0:n], local1)
+			if r.localRTPPort2 != 0 {
+				connection.WriteTo(buffer[0:n], local2)
+			}
+		} else {
+			if _, err := connection.WriteTo(buffer[0:n], controller); err == nil && !isRTCP(buffer[0:n]) {
+				r.sent.add(n)
+			}
+		}
+	}
+}
+
+// stop stops the forwarding and waits until the port is closed.
+// A proxy which has not been started is ignored.
 func (r *rtpProxy) stop() {
-	r.rtpProxyExit = true
-	log.Debug.Println("stop rt proxy")
+	if r.cancel == nil {
+		return
+	}
+
+	r.cancel()
+	<-r.done
+	log.Debug.Println("stop rtp proxy")
 }
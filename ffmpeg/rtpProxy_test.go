@@ -0,0 +1,142 @@
+package ffmpeg
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+)
+
+// freePort returns a UDP port which is free right now.
+func freePort(t *testing.T) uint16 {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestRTPProxyStopsWithoutPackets(t *testing.T) {
+	port := freePort(t)
+	r := &rtpProxy{controllerIPAddr: "192.0.2.1", bindPort: port, localRTPPort1: freePort(t)}
+	if err := r.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not stop")
+	}
+
+	// the port is free again
+	c, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestRTPProxyStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &rtpProxy{controllerIPAddr: "192.0.2.1", bindPort: freePort(t), localRTPPort1: freePort(t)}
+	if err := r.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not stop")
+	}
+	// stopping a stopped proxy returns at once
+	r.stop()
+
+	// a proxy which has never been started
+	(&rtpProxy{}).stop()
+}
+
+func TestStopWhileReceivingRTCP(t *testing.T) {
+	f := New(Config{})
+	defer func() {
+		// a deadlocked Stop must not hang the other tests
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		f.Shutdown(ctx)
+	}()
+
+	// the proxy forwards a packet of the stream to the controller, that is to itself,
+	// and receives it back as a reception report
+	videoPort := freePort(t)
+	id := f.PrepareNewStream(rtp.SetupEndpoints{
+		SessionId: []byte("session"),
+		ControllerAddr: rtp.Addr{
+			IPVersion:    rtp.IPAddrVersionv4,
+			IPAddr:       "127.0.0.1",
+			VideoRtpPort: videoPort,
+			AudioRtpPort: freePort(t),
+		},
+		Video: testCrypto(1),
+		Audio: testCrypto(3),
+	}, rtp.SetupEndpointsResponse{})
+
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	f.mutex.Lock()
+	s := f.streams[id]
+	receive := s.videoProxy.receive
+	s.videoProxy.receive = func(packet []byte) {
+		close(inFlight)
+		<-release
+		receive(packet)
+	}
+	if err := f.rtpProxies[id].start(f.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.videoProxy.start(f.ctx); err != nil {
+		t.Fatal(err)
+	}
+	f.mutex.Unlock()
+
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(videoPort)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte{0x80, 0xc9, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-inFlight:
+	case <-time.After(time.Second):
+		t.Fatal("no reception report")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		f.Stop(id)
+		close(stopped)
+	}()
+	// the report waits for the mutex once Stop waits for the proxy
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop deadlocked with the reception report")
+	}
+	if st := f.Status(); len(st) != 0 {
+		t.Fatalf("status after stop is=%v", st)
+	}
+}
@@ -0,0 +1,25 @@
+package ffmpeg
+
+// SimulatedDevice is the video and audio device of a simulated camera and microphone.
+// Their names are lavfi sources, e.g. "testsrc2=size=1280x720:rate=30" and
+// "sine=frequency=440:sample_rate=48000"; the audio played on it is discarded.
+const SimulatedDevice = "lavfi"
+
+// deviceInput returns the input which captures name on device with options.
+// The sources of the simulated device take no capture options and are read in real time.
+func deviceInput(device, name string, options []Option) Input {
+	if device == SimulatedDevice {
+		return Input{Options: []Option{Flag("re")}, Format: device, URL: name}
+	}
+
+	return Input{Options: options, Format: device, URL: name}
+}
+
+// deviceOutput returns the format and the URL of the output which plays on name of device.
+func deviceOutput(device, name string) (string, string) {
+	if device == SimulatedDevice {
+		return "null", "-"
+	}
+
+	return device, name
+}
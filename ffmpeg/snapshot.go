@@ -3,29 +3,24 @@ package ffmpeg
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"image"
 	_ "image/jpeg"
 	"os/exec"
-	"strings"
 	"time"
 )
 
-// snapshot returns an image by grapping a frame of the video stream.
-func snapshot(width uint, height uint, inputDevice string, inputFilename string) (*image.Image, error) {
-
-	// we check if the snapshot is already in cache to speed up multiple requests
-	// generally during button press
-
+// snapshot returns an image at full resolution by grapping a frame of the video stream.
+// The filters are applied by ffmpeg which runs with env; size zero keeps the camera resolution.
+func snapshot(inputDevice string, inputFilename string, size image.Point, filters FilterChain, env []string) (image.Image, error) {
 	// context to kill the process if not complete in time
 	ctx, cancel := context.WithTimeout(context.Background(), 3000*time.Millisecond)
 	defer cancel()
 
-	// height "-2" keeps the aspect ratio
-	arg := fmt.Sprintf("-hide_banner -f %s -framerate 30 -i %s -vf scale=%d:-2 -frames:v 1 -f mjpeg pipe:1", inputDevice, inputFilename, width)
-	args := strings.Split(arg, " ")
+	args := snapshotCommand(inputDevice, inputFilename, size, filters).Args()
 
-	jg, err := exec.CommandContext(ctx, "ffmpeg", args[:]...).Output()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Env = env
+	jg, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
@@ -36,5 +31,22 @@ func snapshot(width uint, height uint, inputDevice string, inputFilename string)
 		return nil, err
 	}
 
-	return &img, nil
+	return img, nil
+}
+
+// snapshotCommand returns the ffmpeg command which writes a single jpeg frame to stdout.
+// The frame keeps the resolution of the camera; it is resized in process.
+func snapshotCommand(inputDevice string, inputFilename string, size image.Point, filters FilterChain) Command {
+	return Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{deviceInput(inputDevice, inputFilename, []Option{
+			Opt("framerate", "30"), Opt("video_size", videoSize(size)),
+		})},
+		Outputs: []Output{{
+			VideoFilters: filters,
+			Options:      []Option{Opt("frames:v", "1"), Opt("q:v", "2")},
+			Format:       "mjpeg",
+			URL:          "pipe:1",
+		}},
+	}
 }
@@ -0,0 +1,138 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/brutella/hc/log"
+)
+
+// ErrAudioBusy is returned by PlaySound while a stream or another sound uses the audio output.
+var ErrAudioBusy = errors.New("audio output is busy")
+
+// sound is a sound file playing on the audio output.
+type sound struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// PlaySound plays file on the audio output with volume (1 keeps the volume of the file).
+// It does not wait for the end of the sound.
+// A running stream or the intercom hold the audio output; PlaySound returns ErrAudioBusy in the meantime.
+func (f *ffmpeg) PlaySound(file string, volume float64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.sound != nil || f.intercom != nil || f.streaming() {
+		return ErrAudioBusy
+	}
+
+	return f.startSound(file, volume)
+}
+
+// MixSound plays file on the audio output like PlaySound.
+// During a stream the sound is mixed into the audio coming from the controller
+// so that the visitor hears both.
+func (f *ffmpeg) MixSound(file string, volume float64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, s := range f.streams {
+		if !s.isActive() {
+			continue
+		}
+		if runtime.GOOS == "darwin" {
+			// the audio output of macOS mixes the sound with the stream
+			if f.sound != nil {
+				return ErrAudioBusy
+			}
+			return f.startSound(file, volume)
+		}
+		return s.mixSound(file, volume)
+	}
+
+	// a stream may be about to start
+	if f.sound != nil || f.intercom != nil || f.streaming() {
+		return ErrAudioBusy
+	}
+
+	return f.startSound(file, volume)
+}
+
+// startSound plays file; the caller must hold the mutex.
+func (f *ffmpeg) startSound(file string, volume float64) error {
+	exe, cmd := soundCommand(runtime.GOOS, f.audioDevice(), f.audioOutputName(), file, volume)
+	c := exec.Command(exe, cmd.Args()...)
+	c.Stdout = Stdout
+	c.Stderr = Stderr
+	log.Debug.Println("sound", c)
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	snd := &sound{cmd: c, done: make(chan struct{})}
+	f.sound = snd
+	go func() {
+		if err := c.Wait(); err != nil {
+			log.Debug.Println("sound:", err)
+		}
+		close(snd.done)
+
+		f.mutex.Lock()
+		if f.sound == snd {
+			f.sound = nil
+		}
+		f.mutex.Unlock()
+	}()
+
+	return nil
+}
+
+// detachSound removes the playing sound, if any; the caller stops it with stop
+// after releasing the mutex. It must be called with the mutex held.
+func (f *ffmpeg) detachSound() *sound {
+	snd := f.sound
+	f.sound = nil
+
+	return snd
+}
+
+// stop stops the sound and waits until the audio output is free; a nil sound is ignored.
+func (snd *sound) stop() {
+	if snd == nil {
+		return
+	}
+
+	log.Debug.Println("stop sound")
+	snd.cmd.Process.Signal(syscall.SIGKILL)
+	<-snd.done
+}
+
+// soundCommand returns the executable and the command which plays file on the audio output.
+func soundCommand(goos, audioDevice, audioOutputName, file string, volume float64) (string, Command) {
+	input := Input{URL: file}
+	filters := FilterChain{{Name: "volume", Args: []string{fmt.Sprintf("%.2f", volume)}}}
+
+	if goos == "darwin" {
+		// see playbackCommand
+		return "ffplay", Command{
+			Global: []Option{Flag("hide_banner"), Flag("nodisp"), Flag("autoexit"), Opt("af", filters.String())},
+			Inputs: []Input{input},
+		}
+	}
+
+	format, url := deviceOutput(audioDevice, audioOutputName)
+	return "ffmpeg", Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{input},
+		Outputs: []Output{{
+			NoVideo:      true,
+			AudioFilters: filters,
+			Format:       format,
+			URL:          url,
+		}},
+	}
+}
@@ -0,0 +1,45 @@
+package ffmpeg
+
+import (
+	"testing"
+
+	"github.com/brutella/hc/rtp"
+)
+
+func TestSoundCommands(t *testing.T) {
+	exe, cmd := soundCommand("linux", "alsa", "default", "/home/pi/Doorbell/chime.wav", 0.8)
+	checkGolden(t, "sound_linux", append([]string{exe}, cmd.Args()...))
+
+	exe, cmd = soundCommand("darwin", "avfoundation", "default", "/Users/pi/Doorbell/chime.mp3", 1)
+	checkGolden(t, "sound_darwin", append([]string{exe}, cmd.Args()...))
+}
+
+func TestPlaySoundWhileBusy(t *testing.T) {
+	f := New(Config{AudioDevice: "alsa", AudioNameOutput: "default"})
+
+	// a running stream holds the audio output
+	f.streams["session"] = &stream{capture: &process{}}
+	if err := f.PlaySound("chime.wav", 1); err != ErrAudioBusy {
+		t.Fatalf("error is=%v want=%v", err, ErrAudioBusy)
+	}
+
+	// another sound is playing
+	delete(f.streams, "session")
+	f.sound = &sound{}
+	if err := f.PlaySound("chime.wav", 1); err != ErrAudioBusy {
+		t.Fatalf("error is=%v want=%v", err, ErrAudioBusy)
+	}
+}
+
+func TestPlaybackMixCommands(t *testing.T) {
+	audio := testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)
+
+	s := testStream("linux", "h264_omx", "")
+	exe, cmd := s.playbackMixCommand("linux", audio, "/home/pi/Doorbell/messages/package.wav", 0.8)
+	checkGolden(t, "playback_linux_mix", append([]string{exe}, cmd.Args()...))
+
+	// the mixed audio is the reference of the echo canceller too
+	s.audioProcessing.EchoCancellation = true
+	exe, cmd = s.playbackMixCommand("linux", audio, "/home/pi/Doorbell/messages/package.wav", 0.8)
+	checkGolden(t, "playback_linux_mix_echo_cancellation", append([]string{exe}, cmd.Args()...))
+}
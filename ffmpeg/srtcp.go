@@ -0,0 +1,159 @@
+package ffmpeg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/brutella/hc/rtp"
+)
+
+// labels of the SRTCP session keys (RFC 3711 4.3.2)
+const (
+	srtcpLabelEncryption = 0x03
+	srtcpLabelAuth       = 0x04
+	srtcpLabelSalt       = 0x05
+)
+
+const (
+	// length of the E flag and the SRTCP index which follow the payload
+	srtcpIndexLength = 4
+	// length of the HMAC-SHA1-80 authentication tag
+	srtcpTagLength = 10
+	// the RTCP header and the SSRC of the sender are not encrypted
+	srtcpHeaderLength = 8
+)
+
+// srtcp authenticates and decrypts the SRTCP packets which the controller sends
+// with the AES_CM_128_HMAC_SHA1_80 crypto suite of a stream, and protects
+// the RTCP packets sent to the controller.
+type srtcp struct {
+	block   cipher.Block
+	salt    []byte
+	authKey []byte
+}
+
+// newSRTCP derives the SRTCP session keys from crypto.
+func newSRTCP(crypto rtp.CryptoSuite) (*srtcp, error) {
+	block, salt, authKey, err := newSessionKeys(crypto, srtcpLabelEncryption, srtcpLabelAuth, srtcpLabelSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &srtcp{block: block, salt: salt, authKey: authKey}, nil
+}
+
+// newSessionKeys returns the cipher, the salt and the authentication key
+// derived from crypto with the labels of SRTP or SRTCP.
+func newSessionKeys(crypto rtp.CryptoSuite, encryption, auth, salt byte) (cipher.Block, []byte, []byte, error) {
+	if len(crypto.MasterKey) != 16 || len(crypto.MasterSalt) != 14 {
+		return nil, nil, nil, fmt.Errorf("unsupported srtp master key of %d bytes and salt of %d bytes", len(crypto.MasterKey), len(crypto.MasterSalt))
+	}
+
+	key, err := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, encryption, 16)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	authKey, err := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, auth, 20)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sessionSalt, err := deriveSessionKey(crypto.MasterKey, crypto.MasterSalt, salt, 14)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return block, sessionSalt, authKey, nil
+}
+
+// deriveSessionKey returns the session key of length n for label;
+// the key derivation rate is zero (RFC 3711 4.3.1).
+func deriveSessionKey(masterKey, masterSalt []byte, label byte, n int) ([]byte, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the label is xored into the salt right before the 48 bit index
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, masterSalt)
+	iv[7] ^= label
+
+	key := make([]byte, n)
+	cipher.NewCTR(block, iv).XORKeyStream(key, key)
+
+	return key, nil
+}
+
+// decrypt authenticates pkt and returns the decrypted RTCP packet without index and tag.
+func (c *srtcp) decrypt(pkt []byte) ([]byte, error) {
+	if len(pkt) < srtcpHeaderLength+srtcpIndexLength+srtcpTagLength {
+		return nil, errors.New("srtcp packet is too short")
+	}
+
+	tag := len(pkt) - srtcpTagLength
+	mac := hmac.New(sha1.New, c.authKey)
+	mac.Write(pkt[:tag])
+	if !hmac.Equal(mac.Sum(nil)[:srtcpTagLength], pkt[tag:]) {
+		return nil, errors.New("srtcp packet is not authentic")
+	}
+
+	end := tag - srtcpIndexLength
+	index := binary.BigEndian.Uint32(pkt[end:tag])
+	out := append([]byte{}, pkt[:end]...)
+	if index&(1<<31) == 0 {
+		// the E flag is not set; the packet is not encrypted
+		return out, nil
+	}
+	index &^= 1 << 31
+
+	cipher.NewCTR(c.block, sessionIV(c.salt, pkt[4:8], uint64(index))).XORKeyStream(out[srtcpHeaderLength:], out[srtcpHeaderLength:])
+
+	return out, nil
+}
+
+// encrypt encrypts and authenticates the RTCP packet pkt with the SRTCP index.
+func (c *srtcp) encrypt(pkt []byte, index uint32) ([]byte, error) {
+	if len(pkt) < srtcpHeaderLength {
+		return nil, errors.New("rtcp packet is too short")
+	}
+
+	index &^= 1 << 31
+	out := make([]byte, len(pkt), len(pkt)+srtcpIndexLength+srtcpTagLength)
+	copy(out, pkt)
+	cipher.NewCTR(c.block, sessionIV(c.salt, pkt[4:8], uint64(index))).XORKeyStream(out[srtcpHeaderLength:], out[srtcpHeaderLength:])
+
+	// the E flag is set since the packet is encrypted
+	var idx [srtcpIndexLength]byte
+	binary.BigEndian.PutUint32(idx[:], index|1<<31)
+	out = append(out, idx[:]...)
+
+	mac := hmac.New(sha1.New, c.authKey)
+	mac.Write(out)
+
+	return append(out, mac.Sum(nil)[:srtcpTagLength]...), nil
+}
+
+// sessionIV returns the IV of the AES counter mode of the packet of ssrc with the 48 bit index:
+// IV = salt * 2^16 XOR SSRC * 2^64 XOR index * 2^16 (RFC 3711 4.1.1)
+func sessionIV(salt []byte, ssrc []byte, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= ssrc[i]
+	}
+	for i := 0; i < 6; i++ {
+		iv[8+i] ^= byte(index >> uint(8*(5-i)))
+	}
+
+	return iv
+}
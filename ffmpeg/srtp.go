@@ -0,0 +1,126 @@
+package ffmpeg
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+
+	"github.com/brutella/hc/rtp"
+)
+
+// labels of the SRTP session keys (RFC 3711 4.3.2)
+const (
+	srtpLabelEncryption = 0x00
+	srtpLabelAuth       = 0x01
+	srtpLabelSalt       = 0x02
+)
+
+const (
+	// length of the fixed RTP header
+	rtpHeaderLength = 12
+	// length of the HMAC-SHA1-80 authentication tag
+	srtpTagLength = 10
+	// srtpOverhead is kept free in the packets of the muxer for the tag of SRTP
+	// and the index of SRTCP, like the srtp protocol of ffmpeg does
+	srtpOverhead = srtpTagLength + srtcpIndexLength
+)
+
+// srtpSender protects the RTP and RTCP packets which the capture process sends to the
+// controller with the AES_CM_128_HMAC_SHA1_80 crypto suite of a stream.
+//
+// The capture process restarts with every change of the bitrate, of day and night mode
+// and after a crash, and every muxer starts its sequence numbers anew. Encrypted by ffmpeg,
+// the packets would repeat their index, and the keystream, under the master key of the session
+// and the controller would drop them as replays. The sender numbers the packets itself instead,
+// so that the index keeps increasing over the whole session.
+type srtpSender struct {
+	block   cipher.Block
+	salt    []byte
+	authKey []byte
+	// rtcp protects the sender reports of the muxer
+	rtcp *srtcp
+
+	// index is the index of the last RTP packet: rollover counter and sequence number
+	index   uint64
+	started bool
+	// rtcpIndex is the SRTCP index of the last RTCP packet
+	rtcpIndex uint32
+}
+
+// newSRTPSender derives the session keys of the packets sent with crypto.
+func newSRTPSender(crypto rtp.CryptoSuite) (*srtpSender, error) {
+	block, salt, authKey, err := newSessionKeys(crypto, srtpLabelEncryption, srtpLabelAuth, srtpLabelSalt)
+	if err != nil {
+		return nil, err
+	}
+	rtcp, err := newSRTCP(crypto)
+	if err != nil {
+		return nil, err
+	}
+
+	return &srtpSender{block: block, salt: salt, authKey: authKey, rtcp: rtcp}, nil
+}
+
+// protect returns the SRTP or SRTCP packet of the plain RTP or RTCP packet pkt.
+func (s *srtpSender) protect(pkt []byte) ([]byte, error) {
+	if isRTCP(pkt) {
+		s.rtcpIndex = (s.rtcpIndex + 1) &^ (1 << 31)
+		return s.rtcp.encrypt(pkt, s.rtcpIndex)
+	}
+
+	return s.protectRTP(pkt)
+}
+
+// protectRTP numbers pkt with the next index and encrypts and authenticates it.
+// The timestamps are the ones of the muxer; its sender reports map them to the wall clock.
+func (s *srtpSender) protectRTP(pkt []byte) ([]byte, error) {
+	header, err := rtpHeaderSize(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.started {
+		s.index = (s.index + 1) & (1<<48 - 1)
+	} else {
+		// the sequence numbers continue the ones of the first muxer
+		s.index = uint64(binary.BigEndian.Uint16(pkt[2:4]))
+		s.started = true
+	}
+
+	out := make([]byte, len(pkt), len(pkt)+srtpTagLength)
+	copy(out, pkt)
+	binary.BigEndian.PutUint16(out[2:4], uint16(s.index))
+	cipher.NewCTR(s.block, sessionIV(s.salt, pkt[8:12], s.index)).XORKeyStream(out[header:], out[header:])
+
+	// the rollover counter is authenticated but not sent
+	var roc [4]byte
+	binary.BigEndian.PutUint32(roc[:], uint32(s.index>>16))
+	mac := hmac.New(sha1.New, s.authKey)
+	mac.Write(out)
+	mac.Write(roc[:])
+
+	return append(out, mac.Sum(nil)[:srtpTagLength]...), nil
+}
+
+// rtpHeaderSize returns the length of the header of the RTP packet pkt
+// with its CSRC list and its header extension.
+func rtpHeaderSize(pkt []byte) (int, error) {
+	if len(pkt) < rtpHeaderLength || pkt[0]>>6 != 2 {
+		return 0, errors.New("invalid rtp packet")
+	}
+
+	n := rtpHeaderLength + 4*int(pkt[0]&0x0f)
+	if pkt[0]&0x10 != 0 {
+		if len(pkt) < n+4 {
+			return 0, errors.New("rtp header extension is too short")
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(pkt[n+2:n+4]))
+	}
+	if len(pkt) < n {
+		return 0, errors.New("rtp header is too short")
+	}
+
+	return n, nil
+}
@@ -0,0 +1,136 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+)
+
+// RFC 3711 B.2
+func TestSessionKeystream(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "2B7E151628AED2A6ABF7158809CF4F3C"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := unhex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD")
+
+	is := make([]byte, 32)
+	cipher.NewCTR(block, sessionIV(salt, []byte{0, 0, 0, 0}, 0)).XORKeyStream(is, is)
+	if want := unhex(t, "E03EAD0935C95E80E166B16DD92B4EB4D23513162B02D0F72A43A2FE4A5F97AB"); !bytes.Equal(is, want) {
+		t.Fatalf("keystream is=%X want=%X", is, want)
+	}
+}
+
+// rtpPacket returns an RTP packet of the ssrc 1111 with seq and payload.
+func rtpPacket(seq uint16, payload []byte) []byte {
+	pkt := make([]byte, rtpHeaderLength, rtpHeaderLength+len(payload))
+	pkt[0] = 2 << 6
+	pkt[1] = 99
+	binary.BigEndian.PutUint16(pkt[2:], seq)
+	binary.BigEndian.PutUint32(pkt[4:], uint32(seq)*3000)
+	binary.BigEndian.PutUint32(pkt[8:], 1111)
+
+	return append(pkt, payload...)
+}
+
+// unprotectSRTP authenticates and decrypts pkt like the controller does with the rollover counter roc.
+func unprotectSRTP(t *testing.T, s *srtpSender, pkt []byte, roc uint32) []byte {
+	tag := len(pkt) - srtpTagLength
+	mac := hmac.New(sha1.New, s.authKey)
+	mac.Write(pkt[:tag])
+	binary.Write(mac, binary.BigEndian, roc)
+	if !hmac.Equal(mac.Sum(nil)[:srtpTagLength], pkt[tag:]) {
+		t.Fatal("srtp packet is not authentic")
+	}
+
+	out := append([]byte{}, pkt[:tag]...)
+	index := uint64(roc)<<16 | uint64(binary.BigEndian.Uint16(pkt[2:4]))
+	cipher.NewCTR(s.block, sessionIV(s.salt, pkt[8:12], index)).XORKeyStream(out[rtpHeaderLength:], out[rtpHeaderLength:])
+
+	return out
+}
+
+func TestSRTPSenderContinuesIndex(t *testing.T) {
+	s, err := newSRTPSender(testCrypto(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first muxer wraps its sequence numbers, the restarted one starts anew
+	payload := []byte("frame")
+	tests := []struct {
+		seq     uint16
+		wantSeq uint16
+		roc     uint32
+	}{
+		{65534, 65534, 0},
+		{65535, 65535, 0},
+		{0, 0, 1},
+		{20, 1, 1},
+		{21, 2, 1},
+	}
+	for _, test := range tests {
+		pkt, err := s.protect(rtpPacket(test.seq, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(pkt, payload) {
+			t.Fatal("payload is not encrypted")
+		}
+
+		plain := unprotectSRTP(t, s, pkt, test.roc)
+		if is := binary.BigEndian.Uint16(plain[2:4]); is != test.wantSeq {
+			t.Fatalf("sequence number of %d is=%d want=%d", test.seq, is, test.wantSeq)
+		}
+		if !bytes.Equal(plain[rtpHeaderLength:], payload) {
+			t.Fatalf("payload is=%q want=%q", plain[rtpHeaderLength:], payload)
+		}
+	}
+
+	if _, err := s.protect([]byte{0x80, 99, 0}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSRTPSenderProtectsRTCP(t *testing.T) {
+	crypto := testCrypto(1)
+	s, err := newSRTPSender(crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newSRTCP(crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a sender report without report blocks
+	report := make([]byte, 28)
+	report[0] = 2 << 6
+	report[1] = 200
+	binary.BigEndian.PutUint16(report[2:], 6)
+	binary.BigEndian.PutUint32(report[4:], 1111)
+	copy(report[8:], "ntp time and counts!")
+
+	var indices []uint32
+	for i := 0; i < 2; i++ {
+		pkt, err := s.protect(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		is, err := c.decrypt(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(is, report) {
+			t.Fatalf("report is=%X want=%X", is, report)
+		}
+		indices = append(indices, binary.BigEndian.Uint32(pkt[len(report):]))
+	}
+	if indices[0] == indices[1] {
+		t.Fatalf("srtcp index repeated: %X", indices)
+	}
+}
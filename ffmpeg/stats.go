@@ -0,0 +1,151 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionStats describes the transmission of a stream session to the controller.
+type SessionStats struct {
+	ID       StreamID
+	Started  time.Time
+	Duration time.Duration
+	// packets and bytes sent to the controller
+	VideoPackets uint64
+	VideoBytes   uint64
+	AudioPackets uint64
+	AudioBytes   uint64
+	// Bitrate is the average bitrate of the video in kbit/s
+	Bitrate float64
+	// encoder progress reported by ffmpeg; Framerate and Speed are
+	// the averages of the running capture process
+	Frames        uint64
+	DroppedFrames uint64
+	DupFrames     uint64
+	Framerate     float64
+	Speed         float64
+	// reception of the video by the controller from its last report;
+	// Loss is the fraction lost since the previous report, Lost the cumulative count
+	Reports   int
+	Loss      float64
+	Lost      int32
+	Jitter    time.Duration
+	RoundTrip time.Duration
+}
+
+// packetCounter counts the packets which a proxy sends to the controller.
+type packetCounter struct {
+	mutex   sync.Mutex
+	packets uint64
+	bytes   uint64
+}
+
+func (c *packetCounter) add(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.packets++
+	c.bytes += uint64(n)
+}
+
+func (c *packetCounter) get() (uint64, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.packets, c.bytes
+}
+
+// restartCounter sums a counter over the restarts of the process which reports it.
+type restartCounter struct {
+	base uint64
+	last uint64
+}
+
+func (c *restartCounter) set(v uint64) {
+	if v < c.last {
+		// the process restarted and counts from zero
+		c.base += c.last
+	}
+	c.last = v
+}
+
+func (c restartCounter) total() uint64 {
+	return c.base + c.last
+}
+
+// encoderProgress collects the reports which ffmpeg writes with -progress.
+type encoderProgress struct {
+	mutex     sync.Mutex
+	frames    restartCounter
+	dropped   restartCounter
+	dup       restartCounter
+	framerate float64
+	speed     float64
+}
+
+// read parses the key=value lines of the reports from r until r is closed.
+// Values take effect at the end of each report.
+func (p *encoderProgress) read(r io.Reader) {
+	report := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		report[kv[0]] = strings.TrimSpace(kv[1])
+
+		if kv[0] == "progress" {
+			p.update(report)
+			report = map[string]string{}
+		}
+	}
+}
+
+// update applies a report; unavailable values ("N/A") keep their previous value.
+func (p *encoderProgress) update(report map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if v, err := strconv.ParseUint(report["frame"], 10, 64); err == nil {
+		p.frames.set(v)
+	}
+	if v, err := strconv.ParseUint(report["drop_frames"], 10, 64); err == nil {
+		p.dropped.set(v)
+	}
+	if v, err := strconv.ParseUint(report["dup_frames"], 10, 64); err == nil {
+		p.dup.set(v)
+	}
+	if v, err := strconv.ParseFloat(report["fps"], 64); err == nil {
+		p.framerate = v
+	}
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(report["speed"], "x"), 64); err == nil {
+		p.speed = v
+	}
+}
+
+// fill copies the progress into st.
+func (p *encoderProgress) fill(st *SessionStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	st.Frames = p.frames.total()
+	st.DroppedFrames = p.dropped.total()
+	st.DupFrames = p.dup.total()
+	st.Framerate = p.framerate
+	st.Speed = p.speed
+}
+
+// kbitrate returns the bitrate in kbit/s of n bytes sent in d.
+func kbitrate(n uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return float64(n) * 8 / 1000 / d.Seconds()
+}
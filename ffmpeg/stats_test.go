@@ -0,0 +1,85 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncoderProgress(t *testing.T) {
+	reports := `frame=48
+fps=23.9
+stream_0_0_q=-1.0
+bitrate=N/A
+total_size=N/A
+out_time=00:00:02.000000
+dup_frames=1
+drop_frames=2
+speed=0.99x
+progress=continue
+frame=96
+fps=24.1
+speed=N/A
+drop_frames=3
+progress=continue
+frame=12
+fps=12.0
+drop_frames=0
+progress=continue
+frame=20
+`
+
+	p := &encoderProgress{}
+	p.read(strings.NewReader(reports))
+
+	var st SessionStats
+	p.fill(&st)
+	// the capture process restarted after 96 frames;
+	// the last report is incomplete
+	if st.Frames != 108 || st.DroppedFrames != 3 || st.DupFrames != 1 {
+		t.Fatalf("frames is=%d dropped=%d dup=%d want=108 3 1", st.Frames, st.DroppedFrames, st.DupFrames)
+	}
+	if st.Framerate != 12 || st.Speed != 0.99 {
+		t.Fatalf("framerate is=%v speed=%v want=12 0.99", st.Framerate, st.Speed)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	s := testStream("linux", "h264_omx", "")
+	s.videoProxy = &rtpProxy{}
+	s.startRTCP(testVideo())
+	s.capture = &process{}
+	if s.rate != nil {
+		t.Fatal("adaptive bitrate is enabled")
+	}
+
+	start := time.Now()
+	s.started = start
+	for i := 0; i < 100; i++ {
+		s.videoProxy.sent.add(1250)
+	}
+
+	lossy := receiverReport(receptionReport{SSRC: uint32(s.resp.SsrcVideo), FractionLost: 64, Lost: 7, Jitter: 900})
+	s.receiveRTCP(protectSRTCP(t, s.req.Video, lossy, 1))
+
+	st := s.stats("id", start.Add(10*time.Second))
+	if st.ID != "id" || st.Duration != 10*time.Second {
+		t.Fatalf("id is=%q duration is=%v", st.ID, st.Duration)
+	}
+	if st.VideoPackets != 100 || st.VideoBytes != 125000 || st.Bitrate != 100 {
+		t.Fatalf("video is=%d packets %d bytes %vk want=100 packets 125000 bytes 100k", st.VideoPackets, st.VideoBytes, st.Bitrate)
+	}
+	if st.Reports != 1 || st.Loss != 0.25 || st.Lost != 7 || st.Jitter != 10*time.Millisecond {
+		t.Fatalf("reception is=%+v", st)
+	}
+}
+
+func TestIsRTCP(t *testing.T) {
+	if !isRTCP(receiverReport(receptionReport{})) {
+		t.Fatal("receiver report is not rtcp")
+	}
+	// marker bit and payload type 96
+	if isRTCP([]byte{0x80, 0xe0, 0, 1}) {
+		t.Fatal("rtp packet is rtcp")
+	}
+}
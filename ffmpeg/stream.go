@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"github.com/brutella/hc/log"
 	"github.com/brutella/hc/rtp"
+	"image"
+	"os"
 	"os/exec"
-	"strings"
 	"runtime"
+	"strings"
 	"syscall"
-	"io"
+	"time"
 )
 
 type stream struct {
@@ -20,190 +22,634 @@ type stream struct {
 	h264Decoder     string
 	h264Encoder     string
 	minVideoBitrate int
-
-	req             rtp.SetupEndpoints
-	resp            rtp.SetupEndpointsResponse
-
-	cmd             *exec.Cmd
-	cmd2            *exec.Cmd
-
-	rtpProxyPort1   uint16
-	rtpProxyPort2   uint16
+	// settings which replace the ones above in night mode
+	nightFramerate  int
+	nightMinBitrate int
+	night           bool
+
+	req  rtp.SetupEndpoints
+	resp rtp.SetupEndpointsResponse
+
+	rtpProxyPort1 uint16
+	rtpProxyPort2 uint16
+	// rtpProxyPort3 receives the video RTCP from the video proxy
+	rtpProxyPort3 uint16
+	// rtpProxyPort4 and rtpProxyPort5 receive the plain audio and video of the capture process
+	// which the proxies protect with SRTP, see srtpSender
+	rtpProxyPort4 uint16
+	rtpProxyPort5 uint16
+
+	audioProcessing AudioProcessing
+	adaptive        AdaptiveBitrate
+
+	maxRestarts int
+	stderrLines int
+
+	// filters draw the privacy mask and the overlay on the stream
+	// and on the snapshots taken from it
+	filters FilterChain
+	// videoSize is the resolution requested from the camera; zero keeps its default
+	videoSize image.Point
+	// env is the environment of the capture process
+	env []string
+
+	// capture streams camera and microphone to the controller
+	capture *process
+	// playback plays the audio coming from the controller
+	playback *process
+	// microphone captures the microphone for the echo canceller
+	microphone *process
+	// tap receives the frames which the capture process writes to stdout
+	tap *frameTap
+	// canceller removes the echo of the speaker from the microphone
+	canceller *echoCanceller
+	// micReader and micWriter are the ends of the pipe which carries
+	// the microphone audio from the echo canceller to the capture process
+	micReader *os.File
+	micWriter *os.File
+	// videoProxy forwards the video to the controller and its reception reports to receiveRTCP
+	videoProxy *rtpProxy
+	// srtcp decrypts the reception reports; rate adapts the video to them
+	// and is nil without adaptive bitrate
+	srtcp *srtcp
+	rate  *rateController
+	// progress receives the reports which the capture process writes to progressWriter
+	progress       *encoderProgress
+	progressReader *os.File
+	progressWriter *os.File
+	// started is the start of the session; report is the last reception report
+	// of the video received at reportAt
+	started  time.Time
+	report   receptionReport
+	reportAt time.Time
+	reports  int
+
+	// parameters of the running stream
+	video rtp.VideoParameters
+	audio rtp.AudioParameters
 }
 
 func (s *stream) isActive() bool {
-	return s.cmd != nil
+	return s.capture != nil
 }
 
 func (s *stream) stop() {
 	log.Debug.Println("stop stream")
 
-	if s.cmd != nil {
-		s.cmd.Process.Signal(syscall.SIGINT)
-		// avoid zombie (SIGCHLD)
-		s.cmd.Process.Wait()
-		s.cmd = nil
+	if s.microphone != nil {
+		s.microphone.stop()
+		s.microphone = nil
+	}
+
+	if s.capture != nil {
+		s.capture.stop()
+		s.capture = nil
+	}
+
+	if s.playback != nil {
+		s.playback.stop()
+		s.playback = nil
+	}
+
+	s.closeMicPipe()
+	s.closeProgressPipe()
+}
+
+// processes returns the started processes of the stream.
+func (s *stream) processes() []*process {
+	var ps []*process
+	for _, p := range []*process{s.capture, s.playback, s.microphone} {
+		if p != nil {
+			ps = append(ps, p)
+		}
 	}
 
-        if s.cmd2 != nil {
-                s.cmd2.Process.Signal(syscall.SIGINT)
-		// avoid zombie (SIGCHLD)
-		s.cmd2.Process.Wait()
-                s.cmd2 = nil
-        }
+	return ps
+}
+
+// status returns the health of the stream processes.
+func (s *stream) status() []ProcessStatus {
+	var st []ProcessStatus
+	for _, p := range s.processes() {
+		st = append(st, p.status())
+	}
+
+	return st
 }
 
 func (s *stream) start(video rtp.VideoParameters, audio rtp.AudioParameters) error {
 	log.Debug.Println("start stream")
 
-	ffmpegVideo := "-hide_banner" +
-		fmt.Sprintf(" -f %s", s.videoDevice) +
-		fmt.Sprintf(" -framerate %d", s.framerate(video.Attributes)) +
-		fmt.Sprintf("%s", s.videoDecoderOption(video))
-
-	if runtime.GOOS == "linux" {
-		ffmpegVideo += fmt.Sprintf(" -i %s", s.videoFilename)
-	}  else if runtime.GOOS == "darwin" {
-		ffmpegVideo += fmt.Sprintf(" -i %s:%s", s.videoFilename, s.audioInputName)
-	}
-
-	ffmpegVideo += " -an" +
-		fmt.Sprintf(" -codec:v %s", s.videoEncoder(video))
-
-	if runtime.GOOS == "darwin" {
-		ffmpegVideo += " -pix_fmt yuv420p -vsync vfr"
-	}
-
-	ffmpegVideo += " -preset ultrafast -tune zerolatency" +
-		// height "-2" keeps the aspect ratio
-		fmt.Sprintf(" -video_size %d:-2", video.Attributes.Width) +
-		fmt.Sprintf(" -framerate %d", video.Attributes.Framerate) +
-		fmt.Sprintf(" -level:v %s", videoLevel(video.CodecParams))
-
-	if runtime.GOOS == "linux" {
-                ffmpegVideo += fmt.Sprintf(" -profile:v %s", videoProfile(video.CodecParams))
-	}
-
-	ffmpegVideo += " -f copy" +
-		fmt.Sprintf(" -b:v %dk", s.videoBitrate(video)) +
-		fmt.Sprintf(" -payload_type %d", video.RTP.PayloadType) +
-		fmt.Sprintf(" -ssrc %d", s.resp.SsrcVideo) +
-		" -f rtp -srtp_out_suite AES_CM_128_HMAC_SHA1_80" +
-		fmt.Sprintf(" -srtp_out_params %s", s.req.Video.SrtpKey()) +
-		fmt.Sprintf(" srtp://%s:%d?rtcpport=%d&localrtcpport=%d&pkt_size=%s&timeout=60",
-			s.req.ControllerAddr.IPAddr,
-			s.req.ControllerAddr.VideoRtpPort,
-			s.req.ControllerAddr.VideoRtpPort,
-			s.req.ControllerAddr.VideoRtpPort,
-			videoMTU(s.req))
-
-	ffmpegAudio := " -fflags nobuffer" +
-		" -flags low_delay -probesize 32 -analyzeduration 0 "
-	if runtime.GOOS == "linux" {
-		ffmpegAudio += fmt.Sprintf("-f %s -i %s -vn", s.audioDevice, s.audioInputName)
-	}  else if runtime.GOOS == "darwin" {
-		ffmpegAudio += "-vn"
-	}
-
-	ffmpegAudio += fmt.Sprintf(" %s", audioCodecOption(audio)) +
-		" -flags +global_header" +
-		fmt.Sprintf(" -ar %s", audioSamplingRate(audio)) +
-		fmt.Sprintf(" -b:a %dk -bufsize 48k", audio.RTP.Bitrate) +
-		" -ac 1" +
-		fmt.Sprintf(" -payload_type %d", audio.RTP.PayloadType) +
-		fmt.Sprintf(" -ssrc %d", s.resp.SsrcAudio) +
-		" -f rtp -srtp_out_suite AES_CM_128_HMAC_SHA1_80" +
-		fmt.Sprintf(" -srtp_out_params %s", s.req.Audio.SrtpKey()) +
-		fmt.Sprintf(" srtp://127.0.0.1:%d?rtcpport=%d&localrtcpport=%d&pkt_size=%s&timeout=60",
-			s.req.ControllerAddr.AudioRtpPort,
-			s.req.ControllerAddr.AudioRtpPort,
+	s.startRTCP(video)
+
+	args := s.captureCommand(runtime.GOOS, video, audio).Args()
+	playbackExec, playback2 := s.playbackCommand(runtime.GOOS, audio)
+	args2 := playback2.Args()
+	sdp := s.playbackSDP(audio)
+
+	log.Debug.Println(sdp)
+
+	tap := newFrameTap()
+	if err := s.openProgressPipe(); err != nil {
+		return err
+	}
+	if s.echoCancellation(runtime.GOOS) {
+		var err error
+		if s.micReader, s.micWriter, err = os.Pipe(); err != nil {
+			s.closeProgressPipe()
+			return err
+		}
+		s.canceller = newEchoCanceller(s.audioProcessing.EchoTail, s.micWriter)
+	}
+	canceller := s.canceller
+
+	capture := newProcess("capture", s.captureProcess(args, tap), s.maxRestarts, s.stderrLines)
+	playback := newProcess("playback", s.playbackProcess(playbackExec, args2, sdp), s.maxRestarts, s.stderrLines)
+
+	if err := capture.start(); err != nil {
+		s.closeMicPipe()
+		s.closeProgressPipe()
+		return err
+	}
+
+	if err := playback.start(); err != nil {
+		capture.stop()
+		s.closeMicPipe()
+		s.closeProgressPipe()
+		return err
+	}
+
+	if canceller != nil {
+		args3 := s.microphoneCommand().Args()
+		microphone := newProcess("microphone", func() *exec.Cmd {
+			cmd := exec.Command("ffmpeg", args3...)
+			cmd.Stdout = canceller
+			return cmd
+		}, s.maxRestarts, s.stderrLines)
+
+		if err := microphone.start(); err != nil {
+			capture.stop()
+			playback.stop()
+			s.closeMicPipe()
+			s.closeProgressPipe()
+			return err
+		}
+		s.microphone = microphone
+	}
+
+	s.capture = capture
+	s.playback = playback
+	s.tap = tap
+	s.video = video
+	s.audio = audio
+	s.started = time.Now()
+
+	return nil
+}
+
+// startRTCP prepares the decryption of the reception reports of the controller
+// and the adaptation of the video to them.
+func (s *stream) startRTCP(video rtp.VideoParameters) {
+	c, err := newSRTCP(s.req.Video)
+	if err != nil {
+		log.Info.Println("reception reports disabled:", err)
+		return
+	}
+
+	s.srtcp = c
+	if s.adaptive.Enabled {
+		s.rate = newRateController(s.adaptive, s.videoBitrate(video), int(s.outputFramerate(video.Attributes)), time.Now())
+	}
+}
+
+// receiveRTCP records the reception report of the controller in the SRTCP packet pkt
+// and adapts the video to it. The capture process restarts with the new bitrate and framerate.
+func (s *stream) receiveRTCP(pkt []byte) {
+	if s.srtcp == nil || s.capture == nil {
+		return
+	}
+
+	plain, err := s.srtcp.decrypt(pkt)
+	if err != nil {
+		log.Debug.Println("rtcp:", err)
+		return
+	}
+	reports, err := parseReports(plain)
+	if err != nil {
+		log.Debug.Println("rtcp:", err)
+		return
+	}
+
+	now := time.Now()
+	for _, r := range reports {
+		if r.SSRC != uint32(s.resp.SsrcVideo) {
+			continue
+		}
+		s.report, s.reportAt = r, now
+		s.reports++
+
+		if s.rate == nil || !s.rate.update(r, now) {
+			continue
+		}
+
+		log.Info.Printf("adapt video to %.0f%% loss, %s jitter and %s rtt: %dk at %d fps",
+			r.loss()*100, r.jitter(), r.roundTrip(now), s.rate.bitrate, s.rate.framerate)
+		args := s.captureCommand(runtime.GOOS, s.video, s.audio).Args()
+		s.capture.reload(s.captureProcess(args, s.tap))
+	}
+}
+
+// captureProcess returns the command of the capture process which writes the frames for snapshots to tap.
+func (s *stream) captureProcess(args []string, tap *frameTap) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		cmd := exec.Command("ffmpeg", args...)
+		cmd.Env = s.env
+		cmd.Stdout = tap
+		if s.progressWriter != nil {
+			// -progress pipe:3
+			cmd.ExtraFiles = []*os.File{s.progressWriter}
+		}
+		if s.micReader != nil {
+			// microphone audio without echo
+			cmd.Stdin = s.micReader
+		}
+		return cmd
+	}
+}
+
+// playbackProcess returns the command of the playback process which reads the SDP from stdin.
+func (s *stream) playbackProcess(exe string, args []string, sdp string) func() *exec.Cmd {
+	canceller := s.canceller
+	return func() *exec.Cmd {
+		cmd := exec.Command(exe, args...)
+		cmd.Stdout = Stdout
+		if canceller != nil {
+			// the audio played by the speaker is the reference of the echo canceller
+			cmd.Stdout = canceller.referenceWriter()
+		}
+		// pipe the SDP header
+		cmd.Stdin = strings.NewReader(sdp)
+		return cmd
+	}
+}
+
+// mixSound restarts the playback process to mix file with volume into the audio from the controller.
+func (s *stream) mixSound(file string, volume float64) error {
+	if s.playback == nil {
+		return fmt.Errorf("stream is not running")
+	}
+
+	exe, cmd := s.playbackMixCommand(runtime.GOOS, s.audio, file, volume)
+	log.Debug.Println("mix sound into the stream:", file)
+	s.playback.reload(s.playbackProcess(exe, cmd.Args(), s.playbackSDP(s.audio)))
+
+	return nil
+}
+
+// closeMicPipe closes the pipe between echo canceller and capture process.
+func (s *stream) closeMicPipe() {
+	s.canceller = nil
+
+	if s.micWriter != nil {
+		s.micWriter.Close()
+		s.micWriter = nil
+	}
+
+	if s.micReader != nil {
+		s.micReader.Close()
+		s.micReader = nil
+	}
+}
+
+// openProgressPipe opens the pipe which carries the progress reports
+// from the capture process to progress.
+func (s *stream) openProgressPipe() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	s.progress = &encoderProgress{}
+	s.progressReader, s.progressWriter = r, w
+	go s.progress.read(r)
+
+	return nil
+}
+
+// closeProgressPipe closes the pipe between capture process and progress.
+func (s *stream) closeProgressPipe() {
+	if s.progressWriter != nil {
+		s.progressWriter.Close()
+		s.progressWriter = nil
+	}
+
+	if s.progressReader != nil {
+		s.progressReader.Close()
+		s.progressReader = nil
+	}
+}
+
+// stats returns the statistics of the session at now.
+// The audio packets are counted by the audio proxy and added by the caller.
+func (s *stream) stats(id StreamID, now time.Time) SessionStats {
+	st := SessionStats{ID: id, Started: s.started}
+	if !s.started.IsZero() {
+		st.Duration = now.Sub(s.started)
+	}
+
+	if s.videoProxy != nil {
+		st.VideoPackets, st.VideoBytes = s.videoProxy.sent.get()
+		st.Bitrate = kbitrate(st.VideoBytes, st.Duration)
+	}
+
+	if s.progress != nil {
+		s.progress.fill(&st)
+	}
+
+	if s.reports > 0 {
+		st.Reports = s.reports
+		st.Loss = s.report.loss()
+		st.Lost = s.report.Lost
+		st.Jitter = s.report.jitter()
+		st.RoundTrip = s.report.roundTrip(s.reportAt)
+	}
+
+	return st
+}
+
+// echoCancellation returns true if the echo canceller runs between speaker and microphone.
+// avfoundation captures the microphone with the camera; the microphone cannot be processed in between.
+func (s *stream) echoCancellation(goos string) bool {
+	return s.audioProcessing.echoCancellation(goos)
+}
+
+// echoCancellation returns true if the echo canceller runs between speaker and microphone, see stream.echoCancellation.
+func (a AudioProcessing) echoCancellation(goos string) bool {
+	return a.EchoCancellation && goos != "darwin"
+}
+
+// setNight restarts the capture process with the night or the day settings
+// and with filters.
+func (s *stream) setNight(night bool, filters FilterChain) {
+	s.night = night
+	s.filters = filters
+
+	if s.capture != nil {
+		log.Debug.Println("switch stream to night mode:", night)
+		args := s.captureCommand(runtime.GOOS, s.video, s.audio).Args()
+		s.capture.reload(s.captureProcess(args, s.tap))
+	}
+}
+
+// captureCommand returns the ffmpeg command which streams camera and microphone to the controller.
+func (s *stream) captureCommand(goos string, video rtp.VideoParameters, audio rtp.AudioParameters) Command {
+	videoInput := deviceInput(s.videoDevice, s.videoFilename, []Option{
+		Optf("framerate", "%d", s.framerate(video.Attributes)),
+		Opt("codec:v", s.videoDecoder(video)),
+		Opt("video_size", videoSize(s.videoSize)),
+	})
+
+	videoOpts := []Option{
+		Opt("preset", "ultrafast"),
+		Opt("tune", "zerolatency"),
+		Opt("level:v", videoLevel(video.CodecParams)),
+	}
+	if goos == "linux" {
+		videoOpts = append(videoOpts, Opt("profile:v", videoProfile(video.CodecParams)))
+	}
+	if goos == "darwin" {
+		videoOpts = append(videoOpts, Opt("pix_fmt", "yuv420p"))
+	}
+
+	videoOutput := Output{
+		Maps:    []string{"0:v"},
+		NoAudio: true,
+		Video:   &Encoder{Codec: s.videoEncoder(video), Options: videoOpts},
+		// mask and overlay are drawn at full resolution; height "-2" keeps the aspect ratio
+		VideoFilters: append(append(FilterChain{}, s.filters...),
+			Filter{Name: "scale", Args: []string{fmt.Sprintf("%d", video.Attributes.Width), "-2"}}),
+		Options: append([]Option{
+			Optf("r", "%d", s.outputFramerate(video.Attributes)),
+			Optf("b:v", "%dk", s.videoBitrate(video)),
+		}, rtpOptions(video.RTP.PayloadType, s.resp.SsrcVideo)...),
+		Format: "rtp",
+		// the video proxy protects and counts the packets and reads the reception reports
+		URL: fmt.Sprintf("rtp://127.0.0.1:%d?rtcpport=%d&localrtcpport=%d&pkt_size=%d&timeout=60",
+			s.rtpProxyPort5,
+			s.rtpProxyPort5,
+			s.rtpProxyPort3,
+			videoMTU(s.req)-srtpOverhead),
+	}
+
+	audioOutput := Output{
+		NoVideo:      true,
+		Audio:        audioEncoder(audio),
+		AudioFilters: s.audioFilters(),
+		Options: append([]Option{
+			Opt("flags", "+global_header"),
+			Opt("ar", audioSamplingRate(audio)),
+			Optf("b:a", "%dk", audio.RTP.Bitrate),
+			Opt("bufsize", "48k"),
+			Opt("ac", "1"),
+		}, rtpOptions(audio.RTP.PayloadType, s.resp.SsrcAudio)...),
+		Format: "rtp",
+		URL: fmt.Sprintf("rtp://127.0.0.1:%d?rtcpport=%d&localrtcpport=%d&pkt_size=%d&timeout=60",
+			s.rtpProxyPort4,
+			s.rtpProxyPort4,
 			s.rtpProxyPort1,
-			audioMTU())
-
-	args := strings.Split(ffmpegVideo + ffmpegAudio, " ")
-	cmd := exec.Command("ffmpeg", args[:]...)
-	cmd.Stdout = Stdout
-	cmd.Stderr = Stderr
-
-	// TODO manage different codec
-	ffmpegAudio2SDP := "v=0\n" +
-		"o=- 0 0 IN IP4 127.0.0.1\n" +
-		"s=No Name\n" +
-		"c=IN IP4 127.0.0.1\n" +
-		"t=0 0\n" +
-		"a=tool:libavformat 58.29.100\n" +
-		fmt.Sprintf("m=audio %d RTP/AVP 110\n", s.rtpProxyPort2) +
-		fmt.Sprintf("b=AS:%d\n", audio.RTP.Bitrate) +
-		"a=rtpmap:110 MPEG4-GENERIC/16000/1\n" +
-		"a=fmtp:110 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=F8F0212C00BC00\n" +
-		fmt.Sprintf("a=crypto:1 AES_CM_128_HMAC_SHA1_80 inline:%s", s.req.Audio.SrtpKey())
-
-	// second ffmpeg instance to manage audio from IOS
-	ffmpegAudio2 := "-hide_banner" +
-	" -fflags nobuffer -flags low_delay -probesize 32 -analyzeduration 0" +
-	" -protocol_whitelist rtp,srtp,crypto,file,udp,pipe -f sdp" +
-	" -vn" +
-	fmt.Sprintf(" %s", audioCodecOption(audio)) +
-	" -flags +global_header" +
-	" -i pipe:"
-
-	cmd2_exec := "ffmpeg"
-	if runtime.GOOS == "linux" {
-		ffmpegAudio2 += fmt.Sprintf(" -f %s %s -async %s", s.audioDevice, s.audioOutputName, audioSamplingRate(audio))
-	} else if runtime.GOOS == "darwin" {
-		ffmpegAudio2 += " -nodisp -sync ext"
+			audioMTU()-srtpOverhead),
+	}
+
+	// the progress reports are read from the pipe opened by openProgressPipe
+	cmd := Command{Global: []Option{Flag("hide_banner"), Opt("progress", "pipe:3")}}
+
+	switch goos {
+	case "darwin":
+		// avfoundation captures video and audio from the same input
+		videoInput.URL = s.videoFilename + ":" + s.audioInputName
+		videoOutput.Options = append([]Option{Opt("vsync", "vfr")}, videoOutput.Options...)
+		audioOutput.Maps = []string{"0:a"}
+		audioOutput.Options = append([]Option{Opt("fflags", "nobuffer")}, audioOutput.Options...)
+		cmd.Inputs = []Input{videoInput}
+	default:
+		audioInput := deviceInput(s.audioDevice, s.audioInputName, lowLatencyInputOptions())
+		if s.echoCancellation(goos) {
+			// the microphone comes from the echo canceller
+			audioInput = Input{
+				Options: echoAudioOptions(),
+				Format:  "s16le",
+				URL:     "pipe:0",
+			}
+		}
+		audioOutput.Maps = []string{"1:a"}
+		cmd.Inputs = []Input{videoInput, audioInput}
+	}
+
+	// frames for snapshots are taken before encoding
+	snapshotOutput := Output{
+		Maps:         []string{"0:v"},
+		NoAudio:      true,
+		Video:        &Encoder{Codec: "mjpeg", Options: []Option{Opt("q:v", "2")}},
+		VideoFilters: append(FilterChain{{Name: "fps", Args: []string{fmt.Sprintf("%d", tapFramerate)}}}, s.filters...),
+		Format:       "image2pipe",
+		URL:          "pipe:1",
+	}
+
+	cmd.Outputs = []Output{videoOutput, audioOutput, snapshotOutput}
+
+	return cmd
+}
+
+// playbackCommand returns the executable and the command which plays the audio coming from the controller.
+// The command reads the SDP returned by playbackSDP from stdin.
+func (s *stream) playbackCommand(goos string, audio rtp.AudioParameters) (string, Command) {
+	input := Input{
+		Options: append(lowLatencyInputOptions(),
+			Opt("protocol_whitelist", "rtp,srtp,crypto,file,udp,pipe"),
+			Flag("vn"),
+			Opt("codec:a", audioDecoder(audio)),
+		),
+		Format: "sdp",
+		URL:    "pipe:",
+	}
+
+	if goos == "darwin" {
 		// 04/07/2020 we need to use ffplay on macOS
 		// since AudioToolbox output is only in trunk
-		cmd2_exec = "ffplay"
+		return "ffplay", Command{
+			Global: []Option{Flag("hide_banner"), Flag("nodisp"), Opt("sync", "ext")},
+			Inputs: []Input{input},
+		}
+	}
+
+	format, url := deviceOutput(s.audioDevice, s.audioOutputName)
+	cmd := Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{input},
+		Outputs: []Output{{
+			Format: format,
+			URL:    url,
+		}},
+	}
+	if s.echoCancellation(goos) {
+		// reference of the echo canceller
+		cmd.Outputs = append(cmd.Outputs, Output{
+			Options: echoAudioOptions(),
+			Format:  "s16le",
+			URL:     "pipe:1",
+		})
+	}
+
+	return "ffmpeg", cmd
+}
+
+// playbackMixCommand returns the playback command which mixes file with volume
+// into the audio coming from the controller.
+// The file is played once; the audio from the controller keeps playing afterwards.
+func (s *stream) playbackMixCommand(goos string, audio rtp.AudioParameters, file string, volume float64) (string, Command) {
+	exe, cmd := s.playbackCommand(goos, audio)
+
+	graph := fmt.Sprintf("[1:a]volume=%.2f[sound];[0:a][sound]amix=inputs=2:duration=first:dropout_transition=0", volume)
+	switch len(cmd.Outputs) {
+	case 1:
+		graph += "[speaker]"
+		cmd.Outputs[0].Maps = []string{"[speaker]"}
+	case 2:
+		// speaker and reference of the echo canceller
+		graph += ",asplit=2[speaker][reference]"
+		cmd.Outputs[0].Maps = []string{"[speaker]"}
+		cmd.Outputs[1].Maps = []string{"[reference]"}
+	}
+
+	cmd.Inputs = append(cmd.Inputs, Input{Options: []Option{Flag("re")}, URL: file})
+	cmd.Global = append(cmd.Global, Opt("filter_complex", graph))
+
+	return exe, cmd
+}
+
+// microphoneCommand returns the ffmpeg command which writes the microphone audio
+// for the echo canceller to stdout.
+func (s *stream) microphoneCommand() Command {
+	return Command{
+		Global: []Option{Flag("hide_banner")},
+		Inputs: []Input{deviceInput(s.audioDevice, s.audioInputName, lowLatencyInputOptions())},
+		Outputs: []Output{{
+			NoVideo: true,
+			Options: echoAudioOptions(),
+			Format:  "s16le",
+			URL:     "pipe:1",
+		}},
 	}
+}
 
-	args2 := strings.Split(ffmpegAudio2, " ")
-	cmd2 := exec.Command(cmd2_exec, args2[:]...)
-	cmd2.Stdout = Stdout
-	cmd2.Stderr = Stderr
+// echoAudioOptions describe the audio exchanged with the echo canceller.
+func echoAudioOptions() []Option {
+	return []Option{Optf("ar", "%d", echoSampleRate), Opt("ac", "1")}
+}
 
-	// pipe the SDP header
-	stdin2, stdin2_err := cmd2.StdinPipe()
-	if stdin2_err != nil {
-		log.Debug.Println(stdin2_err)
+// audioFilters returns the noise suppression and the automatic gain control of the microphone.
+func (s *stream) audioFilters() FilterChain {
+	return s.audioProcessing.filters()
+}
+
+// filters returns the noise suppression and the automatic gain control of the microphone.
+func (a AudioProcessing) filters() FilterChain {
+	var chain FilterChain
+	if nr := a.NoiseReduction; nr > 0 {
+		chain = append(chain, Filter{Name: "afftdn", Args: []string{fmt.Sprintf("nr=%d", nr)}})
+	}
+	if a.AutomaticGain {
+		chain = append(chain, Filter{Name: "dynaudnorm"})
 	}
-	defer stdin2.Close()
-	io.WriteString(stdin2, ffmpegAudio2SDP)
 
-	log.Debug.Println(cmd)
-	log.Debug.Println(cmd2)
-	log.Debug.Println(ffmpegAudio2SDP)
+	return chain
+}
 
-	err := cmd.Start()
-	err2:= cmd2.Start()
-	if err == nil {
-		s.cmd = cmd
+// videoSize returns the value of the video_size option; empty for the default size.
+func videoSize(size image.Point) string {
+	if size == (image.Point{}) {
+		return ""
 	}
 
-	if err2 == nil {
-		s.cmd2 = cmd2
+	return fmt.Sprintf("%dx%d", size.X, size.Y)
+}
+
+func lowLatencyInputOptions() []Option {
+	return []Option{
+		Opt("fflags", "nobuffer"),
+		Opt("flags", "low_delay"),
+		Opt("probesize", "32"),
+		Opt("analyzeduration", "0"),
 	}
+}
 
-	return err
+// rtpOptions returns the options of the RTP muxer; the proxies encrypt the packets, see srtpSender.
+func rtpOptions(payloadType uint8, ssrc int32) []Option {
+	return []Option{
+		Optf("payload_type", "%d", payloadType),
+		Optf("ssrc", "%d", ssrc),
+	}
 }
 
 // TODO (mah) test
 func (s *stream) suspend() {
 	log.Debug.Println("suspend stream")
-	s.cmd.Process.Signal(syscall.SIGSTOP)
-	s.cmd2.Process.Signal(syscall.SIGSTOP)
+	for _, p := range s.processes() {
+		p.signal(syscall.SIGSTOP)
+	}
 }
 
 // TODO (mah) test
 func (s *stream) resume() {
 	log.Debug.Println("resume stream")
-	s.cmd.Process.Signal(syscall.SIGCONT)
-	s.cmd2.Process.Signal(syscall.SIGCONT)
+	for _, p := range s.processes() {
+		p.signal(syscall.SIGCONT)
+	}
 }
 
 // TODO (mah) implement
 func (s *stream) reconfigure(video rtp.VideoParameters, audio rtp.AudioParameters) error {
-	if s.cmd != nil {
+	if s.capture != nil {
 		log.Debug.Println("reconfigure() is not implemented")
 	}
 
@@ -219,21 +665,28 @@ func (s *stream) videoEncoder(param rtp.VideoParameters) string {
 	return "?"
 }
 
-func (s *stream) videoDecoderOption(param rtp.VideoParameters) string {
+func (s *stream) videoDecoder(param rtp.VideoParameters) string {
 	switch param.CodecType {
 	case rtp.VideoCodecType_H264:
-		if s.h264Decoder != "" {
-			return fmt.Sprintf(" -codec:v %s", s.h264Decoder)
-		}
+		return s.h264Decoder
 	}
 
 	return ""
 }
 
 func (s *stream) videoBitrate(param rtp.VideoParameters) int {
+	if s.rate != nil {
+		return s.rate.bitrate
+	}
+
+	min := s.minVideoBitrate
+	if s.night && s.nightMinBitrate > 0 {
+		min = s.nightMinBitrate
+	}
+
 	br := int(param.RTP.Bitrate)
-	if s.minVideoBitrate > br {
-		br = s.minVideoBitrate
+	if min > br {
+		br = min
 	}
 
 	return br
@@ -264,7 +717,21 @@ func (s *stream) framerate(attr rtp.VideoCodecAttributes) byte {
 		return 30
 	}
 
-	return attr.Framerate
+	return s.outputFramerate(attr)
+}
+
+// outputFramerate returns the requested framerate capped in night mode
+// and by the adaptation to the reception reports.
+func (s *stream) outputFramerate(attr rtp.VideoCodecAttributes) byte {
+	framerate := attr.Framerate
+	if s.night && s.nightFramerate > 0 && s.nightFramerate < int(framerate) {
+		framerate = byte(s.nightFramerate)
+	}
+	if s.rate != nil && s.rate.framerate < int(framerate) {
+		framerate = byte(s.rate.framerate)
+	}
+
+	return framerate
 }
 
 // https://superuser.com/a/564007
@@ -285,71 +752,17 @@ func videoLevel(param rtp.VideoCodecParameters) string {
 	return ""
 }
 
-func videoMTU(setup rtp.SetupEndpoints) string {
+func videoMTU(setup rtp.SetupEndpoints) int {
 	switch setup.ControllerAddr.IPVersion {
 	case rtp.IPAddrVersionv4:
-		return "1378"
+		return 1378
 	case rtp.IPAddrVersionv6:
-		return "1228"
-	}
-
-	return "1378"
-}
-
-func audioMTU() string {
-	return "188"
-}
-
-// https://trac.ffmpeg.org/wiki/audio%20types
-func audioCodecOption(param rtp.AudioParameters) string {
-	switch param.CodecType {
-	case rtp.AudioCodecType_PCMU:
-		log.Debug.Println("audioCodec(PCMU) not supported")
-	case rtp.AudioCodecType_PCMA:
-		log.Debug.Println("audioCodec(PCMA) not supported")
-	case rtp.AudioCodecType_AAC_ELD:
-		// requires ffmpeg built with --enable-libfdk-aac
-		return "-acodec libfdk_aac -aprofile aac_eld"
-	case rtp.AudioCodecType_Opus:
-		// bad quality
-		return fmt.Sprintf("-codec:a libopus")
-	case rtp.AudioCodecType_MSBC:
-		log.Debug.Println("audioCodec(MSBC) not supported")
-	case rtp.AudioCodecType_AMR:
-		log.Debug.Println("audioCodec(AMR) not supported")
-	case rtp.AudioCodecType_ARM_WB:
-		log.Debug.Println("audioCodec(ARM_WB) not supported")
+		return 1228
 	}
 
-	return ""
+	return 1378
 }
 
-func audioVariableBitrate(param rtp.AudioParameters) string {
-	switch param.CodecParams.Bitrate {
-	case rtp.AudioCodecBitrateVariable:
-		return "on"
-	case rtp.AudioCodecBitrateConstant:
-		return "off"
-	default:
-		log.Info.Println("variableBitrate() undefined bitrate", param.CodecParams.Bitrate)
-		break
-	}
-
-	return "?"
-}
-
-func audioSamplingRate(param rtp.AudioParameters) string {
-	switch param.CodecParams.Samplerate {
-	case rtp.AudioCodecSampleRate8Khz:
-		return "8k"
-	case rtp.AudioCodecSampleRate16Khz:
-		return "16k"
-	case rtp.AudioCodecSampleRate24Khz:
-		return "24k"
-	default:
-		log.Info.Println("audioSamplingRate() undefined samplrate", param.CodecParams.Samplerate)
-		break
-	}
-
-	return ""
+func audioMTU() int {
+	return 188
 }
@@ -0,0 +1,257 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/rtp"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// checkGolden compares the arguments with testdata/name.golden which contains one argument per line.
+func checkGolden(t *testing.T, name string, sections ...[]string) {
+	var buf bytes.Buffer
+	for i, args := range sections {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		for _, arg := range args {
+			fmt.Fprintln(&buf, arg)
+		}
+	}
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is := buf.String(); is != string(want) {
+		t.Fatalf("%s\nis:\n%s\nwant:\n%s", path, is, want)
+	}
+}
+
+func testCrypto(key byte) rtp.CryptoSuite {
+	return rtp.CryptoSuite{
+		MasterKey:  bytes.Repeat([]byte{key}, 16),
+		MasterSalt: bytes.Repeat([]byte{key + 1}, 14),
+	}
+}
+
+func testStream(goos, encoder, decoder string) *stream {
+	s := &stream{
+		h264Decoder:     decoder,
+		h264Encoder:     encoder,
+		minVideoBitrate: 300,
+		req: rtp.SetupEndpoints{
+			ControllerAddr: rtp.Addr{
+				IPVersion:    rtp.IPAddrVersionv4,
+				IPAddr:       "192.168.1.20",
+				VideoRtpPort: 51000,
+				AudioRtpPort: 51002,
+			},
+			Video: testCrypto(1),
+			Audio: testCrypto(3),
+		},
+		resp:          rtp.SetupEndpointsResponse{SsrcVideo: 1111, SsrcAudio: 2222},
+		rtpProxyPort1: 3100,
+		rtpProxyPort2: 4100,
+		rtpProxyPort3: 5100,
+		rtpProxyPort4: 6100,
+		rtpProxyPort5: 7100,
+	}
+
+	switch goos {
+	case "darwin":
+		s.videoDevice = "avfoundation"
+		s.videoFilename = "FaceTime HD Camera"
+		s.audioDevice = "avfoundation"
+		s.audioInputName = "default"
+		s.audioOutputName = "default"
+	default:
+		s.videoDevice = "v4l2"
+		s.videoFilename = "/dev/video0"
+		s.audioDevice = "alsa"
+		s.audioInputName = "plughw:CARD=seeed2micvoicec,DEV=0"
+		s.audioOutputName = "default"
+	}
+
+	return s
+}
+
+func testVideo() rtp.VideoParameters {
+	return rtp.VideoParameters{
+		CodecType: rtp.VideoCodecType_H264,
+		CodecParams: rtp.VideoCodecParameters{
+			Profiles: []rtp.VideoCodecProfile{{Id: rtp.VideoCodecProfileMain}},
+			Levels:   []rtp.VideoCodecLevel{{Level: rtp.VideoCodecLevel3_1}},
+		},
+		Attributes: rtp.VideoCodecAttributes{Width: 1280, Height: 720, Framerate: 24},
+		RTP:        rtp.RTPParams{PayloadType: 99, Bitrate: 299, MTU: 1378},
+	}
+}
+
+func testAudio(codec byte, samplerate byte) rtp.AudioParameters {
+	return rtp.AudioParameters{
+		CodecType: codec,
+		CodecParams: rtp.AudioCodecParameters{
+			Channels:   1,
+			Bitrate:    rtp.AudioCodecBitrateVariable,
+			Samplerate: samplerate,
+		},
+		RTP: rtp.RTPParams{PayloadType: 110, Bitrate: 24},
+	}
+}
+
+func TestStreamCommands(t *testing.T) {
+	codecs := []struct {
+		name       string
+		codec      byte
+		samplerate byte
+	}{
+		{"aac-eld", rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz},
+		{"opus", rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate24Khz},
+	}
+	encoders := map[string][]struct {
+		encoder string
+		decoder string
+	}{
+		"linux":  {{"h264_omx", ""}, {"h264_v4l2m2m", "h264_v4l2m2m"}, {"libx264", ""}},
+		"darwin": {{"libx264", ""}, {"h264_videotoolbox", ""}},
+	}
+
+	for _, goos := range []string{"linux", "darwin"} {
+		for _, c := range codecs {
+			for _, e := range encoders[goos] {
+				name := strings.Join([]string{"stream", goos, c.name, e.encoder}, "_")
+				t.Run(name, func(t *testing.T) {
+					s := testStream(goos, e.encoder, e.decoder)
+					audio := testAudio(c.codec, c.samplerate)
+					exe, playback := s.playbackCommand(goos, audio)
+
+					checkGolden(t, name,
+						s.captureCommand(goos, testVideo(), audio).Args(),
+						append([]string{exe}, playback.Args()...))
+				})
+			}
+		}
+	}
+}
+
+func TestStreamCommandsWithOverlay(t *testing.T) {
+	overlay, err := (Overlay{Text: "{{.Camera}} {{.Timestamp}}", CameraName: "Front door"}).Filters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testStream("linux", "h264_omx", "")
+	s.filters = overlay
+	checkGolden(t, "stream_linux_overlay",
+		s.captureCommand("linux", testVideo(), testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)).Args())
+	checkGolden(t, "snapshot_linux_overlay", snapshotCommand("v4l2", "/dev/video0", image.Point{}, overlay).Args())
+}
+
+func TestStreamCommandsWithPrivacyMask(t *testing.T) {
+	mask := FilterChain{{
+		Name:    "overlay",
+		Sources: []FilterChain{{{Name: "movie", Args: []string{"/tmp/mask.png"}}}},
+	}}
+
+	s := testStream("linux", "h264_omx", "")
+	s.filters = mask
+	s.videoSize = image.Pt(1920, 1080)
+	checkGolden(t, "stream_linux_mask",
+		s.captureCommand("linux", testVideo(), testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)).Args())
+	checkGolden(t, "snapshot_linux_mask", snapshotCommand("v4l2", "/dev/video0", image.Pt(1920, 1080), mask).Args())
+}
+
+func TestStreamCommandsAtNight(t *testing.T) {
+	s := testStream("linux", "h264_omx", "")
+	s.nightFramerate = 15
+	s.nightMinBitrate = 500
+	s.setNight(true, FilterChain{{Name: "hue", Args: []string{"s=0"}}})
+	checkGolden(t, "stream_linux_night",
+		s.captureCommand("linux", testVideo(), testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)).Args())
+
+	// a framerate below the night framerate is kept
+	video := testVideo()
+	video.Attributes.Framerate = 10
+	if is, want := s.framerate(video.Attributes), byte(10); is != want {
+		t.Fatalf("framerate is=%v want=%v", is, want)
+	}
+}
+
+func TestStreamCommandsWithAudioProcessing(t *testing.T) {
+	audio := testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)
+	processing := AudioProcessing{EchoCancellation: true, NoiseReduction: 12, AutomaticGain: true}
+
+	s := testStream("linux", "h264_omx", "")
+	s.audioProcessing = processing
+	exe, playback := s.playbackCommand("linux", audio)
+	checkGolden(t, "stream_linux_audio_processing",
+		s.captureCommand("linux", testVideo(), audio).Args(),
+		append([]string{exe}, playback.Args()...),
+		s.microphoneCommand().Args())
+
+	// avfoundation captures the microphone with the camera
+	s = testStream("darwin", "libx264", "")
+	s.audioProcessing = processing
+	exe, playback = s.playbackCommand("darwin", audio)
+	checkGolden(t, "stream_darwin_audio_processing",
+		s.captureCommand("darwin", testVideo(), audio).Args(),
+		append([]string{exe}, playback.Args()...))
+}
+
+func TestDeviceNamesWithSpaces(t *testing.T) {
+	s := testStream("darwin", "libx264", "")
+	args := s.captureCommand("darwin", testVideo(), testAudio(rtp.AudioCodecType_AAC_ELD, rtp.AudioCodecSampleRate16Khz)).Args()
+
+	found := false
+	for _, arg := range args {
+		if arg == "" {
+			t.Fatalf("empty argument in %q", args)
+		}
+		if arg == "FaceTime HD Camera:default" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing input in %q", args)
+	}
+}
+
+func TestSnapshotCommands(t *testing.T) {
+	checkGolden(t, "snapshot_linux", snapshotCommand("v4l2", "/dev/video0", image.Point{}, nil).Args())
+	checkGolden(t, "snapshot_darwin", snapshotCommand("avfoundation", "FaceTime HD Camera", image.Point{}, nil).Args())
+}
+
+func TestSimulatedCommands(t *testing.T) {
+	s := testStream("linux", "libx264", "")
+	s.videoDevice = SimulatedDevice
+	s.videoFilename = "testsrc2=size=1280x720:rate=30"
+	s.audioDevice = SimulatedDevice
+	s.audioInputName = "sine=frequency=440:sample_rate=48000"
+	s.audioProcessing = AudioProcessing{EchoCancellation: true}
+
+	audio := testAudio(rtp.AudioCodecType_Opus, rtp.AudioCodecSampleRate24Khz)
+	exe, playback := s.playbackCommand("linux", audio)
+	sound, soundCmd := soundCommand("linux", s.audioDevice, s.audioOutputName, "/tmp/chime.wav", 1)
+	checkGolden(t, "stream_linux_simulated",
+		s.captureCommand("linux", testVideo(), audio).Args(),
+		append([]string{exe}, playback.Args()...),
+		s.microphoneCommand().Args(),
+		snapshotCommand(s.videoDevice, s.videoFilename, image.Point{}, nil).Args(),
+		append([]string{sound}, soundCmd.Args()...))
+}
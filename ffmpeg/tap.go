@@ -0,0 +1,121 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sync"
+	"time"
+)
+
+// the capture process writes a jpeg frame every second to stdout
+const tapFramerate = 1
+
+// a partial frame larger than maxTapBuffer is dropped
+const maxTapBuffer = 8 << 20
+
+var (
+	jpegStart = []byte{0xff, 0xd8}
+	jpegEnd   = []byte{0xff, 0xd9}
+)
+
+// frameTap receives the jpeg frames which the capture process
+// takes from the camera before encoding.
+type frameTap struct {
+	mutex sync.Mutex
+	buf   []byte
+	last  []byte
+	taken time.Time
+	// seq is the sequence number of the last frame
+	seq uint64
+	// next is closed when a new frame arrives
+	next chan struct{}
+}
+
+func newFrameTap() *frameTap {
+	return &frameTap{next: make(chan struct{})}
+}
+
+// Write splits the mjpeg stream into frames.
+func (t *frameTap) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.buf = append(t.buf, p...)
+	for {
+		start := bytes.Index(t.buf, jpegStart)
+		if start < 0 {
+			t.buf = t.buf[:0]
+			break
+		}
+		end := bytes.Index(t.buf[start+len(jpegStart):], jpegEnd)
+		if end < 0 {
+			t.buf = t.buf[start:]
+			if len(t.buf) > maxTapBuffer {
+				t.buf = t.buf[:0]
+			}
+			break
+		}
+		end += start + len(jpegStart) + len(jpegEnd)
+
+		t.last = append([]byte{}, t.buf[start:end]...)
+		t.taken = time.Now()
+		t.seq++
+		close(t.next)
+		t.next = make(chan struct{})
+
+		t.buf = t.buf[end:]
+	}
+
+	return len(p), nil
+}
+
+// frame returns the last frame if it is younger than maxAge.
+// Otherwise it waits at most timeout for the next frame.
+func (t *frameTap) frame(maxAge, timeout time.Duration) (image.Image, error) {
+	t.mutex.Lock()
+	if t.last != nil && time.Since(t.taken) < maxAge {
+		last := t.last
+		t.mutex.Unlock()
+		return jpeg.Decode(bytes.NewReader(last))
+	}
+	next := t.next
+	t.mutex.Unlock()
+
+	select {
+	case <-next:
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no frame from the stream within %s", timeout)
+	}
+
+	t.mutex.Lock()
+	last := t.last
+	t.mutex.Unlock()
+
+	return jpeg.Decode(bytes.NewReader(last))
+}
+
+// nextFrame returns the last frame and its sequence number unless its sequence number is after.
+// Otherwise it waits at most timeout for the next frame.
+func (t *frameTap) nextFrame(after uint64, timeout time.Duration) ([]byte, uint64, error) {
+	t.mutex.Lock()
+	if t.last != nil && t.seq != after {
+		last, seq := t.last, t.seq
+		t.mutex.Unlock()
+		return last, seq, nil
+	}
+	next := t.next
+	t.mutex.Unlock()
+
+	select {
+	case <-next:
+	case <-time.After(timeout):
+		return nil, after, fmt.Errorf("no frame from the stream within %s", timeout)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.last, t.seq, nil
+}
@@ -0,0 +1,68 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestFrameTapSplitsFrames(t *testing.T) {
+	tap := newFrameTap()
+	first := testJPEG(t, 64, 48)
+	second := testJPEG(t, 32, 24)
+
+	// frames arrive in arbitrary chunks
+	stream := append(append([]byte{}, first...), second...)
+	for len(stream) > 0 {
+		n := 100
+		if n > len(stream) {
+			n = len(stream)
+		}
+		tap.Write(stream[:n])
+		stream = stream[n:]
+	}
+
+	img, err := tap.frame(time.Minute, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := img.Bounds().Dx(), 32; is != want {
+		t.Fatalf("width is=%v want=%v", is, want)
+	}
+}
+
+func TestFrameTapWaitsForNextFrame(t *testing.T) {
+	tap := newFrameTap()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tap.Write(testJPEG(t, 16, 16))
+	}()
+
+	img, err := tap.frame(time.Minute, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is, want := img.Bounds().Dx(), 16; is != want {
+		t.Fatalf("width is=%v want=%v", is, want)
+	}
+}
+
+func TestFrameTapTimeout(t *testing.T) {
+	tap := newFrameTap()
+	tap.Write([]byte{0x00, 0x01, 0xff})
+
+	if _, err := tap.frame(time.Minute, 10*time.Millisecond); err == nil {
+		t.Fatal("expected timeout")
+	}
+}
@@ -7,6 +7,8 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/nathan-osman/go-rpigpio v0.0.0-20160701025123-bce6190607da
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
-	github.com/patrickmn/go-cache v2.1.0+incompatible
+	github.com/pion/interceptor v0.1.25
+	github.com/pion/rtp v1.8.3
+	github.com/pion/webrtc/v3 v3.2.24
 	github.com/radovskyb/watcher v1.0.6
 )
@@ -0,0 +1,270 @@
+package hkdoorbell
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// Step is a value written to an output for a while.
+type Step struct {
+	Value    rpi.Value
+	Duration time.Duration
+}
+
+// Pattern is a sequence of steps which an output repeats;
+// a pattern of a single step is a steady light.
+type Pattern []Step
+
+// ParsePattern parses a pattern written as "on", "off" or as
+// comma separated steps like "on:200ms,off:800ms".
+func ParsePattern(s string) (Pattern, error) {
+	var p Pattern
+	for _, step := range strings.Split(s, ",") {
+		fields := strings.SplitN(strings.TrimSpace(step), ":", 2)
+
+		var st Step
+		switch fields[0] {
+		case "on":
+			st.Value = rpi.HIGH
+		case "off":
+			st.Value = rpi.LOW
+		default:
+			return nil, fmt.Errorf("invalid pattern %q: step %q is neither on nor off", s, step)
+		}
+
+		if len(fields) == 2 {
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid pattern %q: step %q has no positive duration", s, step)
+			}
+			st.Duration = d
+		}
+		p = append(p, st)
+	}
+
+	if len(p) > 1 {
+		for _, st := range p {
+			if st.Duration == 0 {
+				return nil, fmt.Errorf("invalid pattern %q: every step of a blink needs a duration", s)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// IndicatorConfig contains the patterns shown by an indicator in every state of the doorbell.
+type IndicatorConfig struct {
+	Idle      Pattern
+	Ring      Pattern
+	Streaming Pattern
+	Error     Pattern
+	// RingDuration is how long the ring pattern is shown after a ring
+	RingDuration time.Duration
+	// CameraCheck is the interval between two frames taken to check the camera;
+	// zero checks only the processes of the streams
+	CameraCheck time.Duration
+}
+
+// states of the doorbell shown by an indicator, in increasing priority
+type indicatorState int
+
+const (
+	indicatorIdle indicatorState = iota
+	indicatorStreaming
+	indicatorRing
+	indicatorError
+)
+
+func (s indicatorState) String() string {
+	switch s {
+	case indicatorStreaming:
+		return "streaming"
+	case indicatorRing:
+		return "ring"
+	case indicatorError:
+		return "error"
+	}
+
+	return "idle"
+}
+
+// interval between two checks of the streams
+const indicatorInterval = 500 * time.Millisecond
+
+// width of the frames taken to check the camera
+const cameraCheckWidth = 64
+
+// Indicator drives an output, e.g. the LED of the button, with the pattern of the
+// state of the doorbell: error when ffmpeg or the camera is unhealthy, ring for
+// a while after a ring, streaming while someone is watching and idle otherwise.
+type Indicator struct {
+	ff  ffmpeg.FFMPEG
+	cfg IndicatorConfig
+	out Output
+	now func() time.Time
+
+	rings chan struct{}
+
+	mutex sync.Mutex
+	// cameraErr is the error of the last camera check
+	cameraErr error
+}
+
+// InitIndicator returns an indicator which shows the idle pattern once it runs.
+func InitIndicator(ff ffmpeg.FFMPEG, cfg IndicatorConfig, out Output) *Indicator {
+	return &Indicator{
+		ff:    ff,
+		cfg:   cfg,
+		out:   out,
+		now:   time.Now,
+		rings: make(chan struct{}, 1),
+	}
+}
+
+// Ring shows the ring pattern for RingDuration; it never blocks.
+func (i *Indicator) Ring() {
+	select {
+	case i.rings <- struct{}{}:
+	default:
+	}
+}
+
+// Run drives the output until ctx is done and then turns it off.
+func (i *Indicator) Run(ctx context.Context) {
+	if i.cfg.CameraCheck > 0 {
+		go i.checkCamera(ctx)
+	}
+
+	ticker := time.NewTicker(indicatorInterval)
+	defer ticker.Stop()
+
+	var ringUntil time.Time
+	state := i.state(ringUntil)
+	pattern := i.pattern(state)
+	step := 0
+	i.write(pattern[step])
+
+	// a nil channel never fires, that is a steady pattern
+	var next <-chan time.Time
+	timer := func() {
+		next = nil
+		if len(pattern) > 1 {
+			next = time.After(pattern[step].Duration)
+		}
+	}
+	timer()
+
+	for {
+		select {
+		case <-ctx.Done():
+			i.write(Step{Value: rpi.LOW})
+			return
+		case <-i.rings:
+			ringUntil = i.now().Add(i.cfg.RingDuration)
+		case <-ticker.C:
+		case <-next:
+			step = (step + 1) % len(pattern)
+			i.write(pattern[step])
+			timer()
+			continue
+		}
+
+		if s := i.state(ringUntil); s != state {
+			log.Debug.Printf("indicator: %s\n", s)
+			state = s
+			pattern = i.pattern(state)
+			step = 0
+			i.write(pattern[step])
+			timer()
+		}
+	}
+}
+
+// state returns the state of the doorbell; the ring pattern lasts until ringUntil.
+func (i *Indicator) state(ringUntil time.Time) indicatorState {
+	i.mutex.Lock()
+	cameraErr := i.cameraErr
+	i.mutex.Unlock()
+
+	if cameraErr != nil {
+		return indicatorError
+	}
+	for _, st := range i.ff.Status() {
+		if !st.Healthy() {
+			return indicatorError
+		}
+	}
+
+	if i.now().Before(ringUntil) {
+		return indicatorRing
+	}
+
+	if len(i.ff.Stats()) > 0 {
+		return indicatorStreaming
+	}
+
+	return indicatorIdle
+}
+
+// pattern returns the pattern of state; a state without pattern turns the output off.
+func (i *Indicator) pattern(state indicatorState) Pattern {
+	var p Pattern
+	switch state {
+	case indicatorIdle:
+		p = i.cfg.Idle
+	case indicatorStreaming:
+		p = i.cfg.Streaming
+	case indicatorRing:
+		p = i.cfg.Ring
+	case indicatorError:
+		p = i.cfg.Error
+	}
+
+	if len(p) == 0 {
+		return Pattern{{Value: rpi.LOW}}
+	}
+
+	return p
+}
+
+func (i *Indicator) write(st Step) {
+	if err := i.out.Write(st.Value); err != nil {
+		log.Info.Println("indicator:", err)
+	}
+}
+
+// checkCamera takes a small frame every CameraCheck; the frame is shared
+// with the snapshots so that the camera is rarely opened for it.
+func (i *Indicator) checkCamera(ctx context.Context) {
+	ticker := time.NewTicker(i.cfg.CameraCheck)
+	defer ticker.Stop()
+
+	for {
+		img, err := i.ff.Snapshot(cameraCheckWidth, 0)
+		if err == nil && img == nil {
+			err = fmt.Errorf("no frame")
+		}
+		if err != nil {
+			log.Info.Println("indicator: camera:", err)
+		}
+
+		i.mutex.Lock()
+		i.cameraErr = err
+		i.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
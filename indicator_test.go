@@ -0,0 +1,113 @@
+package hkdoorbell
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/rtp"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Pattern
+	}{
+		{"on", Pattern{{Value: rpi.HIGH}}},
+		{"off", Pattern{{Value: rpi.LOW}}},
+		{"on:200ms, off:1s", Pattern{{rpi.HIGH, 200 * time.Millisecond}, {rpi.LOW, time.Second}}},
+	}
+	for _, test := range tests {
+		p, err := ParsePattern(test.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, test.want) {
+			t.Fatalf("%q is=%v want=%v", test.s, p, test.want)
+		}
+	}
+
+	for _, s := range []string{"", "blink", "on:fast", "on:-1s", "on,off:1s"} {
+		if _, err := ParsePattern(s); err == nil {
+			t.Fatalf("%q is valid", s)
+		}
+	}
+}
+
+func TestIndicatorState(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	i := InitIndicator(ff, IndicatorConfig{}, &testOutput{})
+	now := time.Now()
+	i.now = func() time.Time { return now }
+
+	if is := i.state(time.Time{}); is != indicatorIdle {
+		t.Fatalf("state is=%s want=idle", is)
+	}
+
+	id := ff.PrepareNewStream(rtp.SetupEndpoints{SessionId: []byte{1}}, rtp.SetupEndpointsResponse{})
+	ff.Start(id, rtp.VideoParameters{}, rtp.AudioParameters{})
+	if is := i.state(time.Time{}); is != indicatorStreaming {
+		t.Fatalf("state is=%s want=streaming", is)
+	}
+
+	// a ring has priority over the stream
+	if is := i.state(now.Add(time.Second)); is != indicatorRing {
+		t.Fatalf("state is=%s want=ring", is)
+	}
+
+	ff.Processes = []ffmpeg.ProcessStatus{{State: ffmpeg.ProcessFailed}}
+	if is := i.state(now.Add(time.Second)); is != indicatorError {
+		t.Fatalf("state is=%s want=error", is)
+	}
+
+	ff.Stop(id)
+	i.cameraErr = errors.New("no camera")
+	if is := i.state(time.Time{}); is != indicatorError {
+		t.Fatalf("state is=%s want=error", is)
+	}
+}
+
+// chanOutput passes the values written to a GPIO output to a channel.
+type chanOutput chan rpi.Value
+
+func (o chanOutput) Write(v rpi.Value) error {
+	o <- v
+	return nil
+}
+
+func TestIndicatorBlinksAfterRing(t *testing.T) {
+	out := make(chanOutput, 100)
+	i := InitIndicator(ffmpeg.NewFake(), IndicatorConfig{
+		Idle:         Pattern{{Value: rpi.HIGH}},
+		Ring:         Pattern{{rpi.LOW, 10 * time.Millisecond}, {rpi.HIGH, 10 * time.Millisecond}},
+		RingDuration: time.Minute,
+	}, out)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go i.Run(ctx)
+
+	next := func() rpi.Value {
+		select {
+		case v := <-out:
+			return v
+		case <-time.After(time.Second):
+			t.Fatal("no value written")
+		}
+		return 0
+	}
+
+	if is := next(); is != rpi.HIGH {
+		t.Fatalf("idle is=%v want=HIGH", is)
+	}
+	i.Ring()
+	for _, want := range []rpi.Value{rpi.LOW, rpi.HIGH, rpi.LOW, rpi.HIGH} {
+		if is := next(); is != want {
+			t.Fatalf("ring is=%v want=%v", is, want)
+		}
+	}
+}
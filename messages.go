@@ -0,0 +1,118 @@
+package hkdoorbell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/service"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+// extensions of the sound files which are loaded as messages
+var messageExtensions = map[string]bool{
+	".wav":  true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".m4a":  true,
+}
+
+// Message is a pre-recorded voice message, e.g. "leave the package at the door".
+type Message struct {
+	// Name is the file name without extension
+	Name string
+	File string
+}
+
+// Messages plays pre-recorded voice messages through the doorbell speaker.
+type Messages struct {
+	ff     ffmpeg.FFMPEG
+	volume float64
+	list   []Message
+}
+
+// LoadMessages loads the sound files in dir as messages sorted by name.
+// A missing directory contains no messages.
+func LoadMessages(ff ffmpeg.FFMPEG, dir string, volume float64) (*Messages, error) {
+	m := &Messages{ff: ff, volume: volume}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || !messageExtensions[strings.ToLower(ext)] {
+			continue
+		}
+		m.list = append(m.list, Message{
+			Name: strings.TrimSuffix(f.Name(), ext),
+			File: filepath.Join(dir, f.Name()),
+		})
+	}
+	sort.Slice(m.list, func(i, j int) bool { return m.list[i].Name < m.list[j].Name })
+
+	return m, nil
+}
+
+// Names returns the names of the messages.
+func (m *Messages) Names() []string {
+	names := make([]string, len(m.list))
+	for i, msg := range m.list {
+		names[i] = msg.Name
+	}
+
+	return names
+}
+
+// Play plays the message with name to the visitor.
+// During a live session the message is mixed into the audio of the call.
+func (m *Messages) Play(name string) error {
+	for _, msg := range m.list {
+		if msg.Name == name {
+			log.Debug.Println("play message", name)
+			return m.ff.MixSound(msg.File, m.volume)
+		}
+	}
+
+	return fmt.Errorf("unknown message %q", name)
+}
+
+// how long a message switch stays on after it has been triggered
+var messageSwitchReset = time.Second
+
+// AddMessageSwitches adds a stateless switch for every message to the doorbell.
+// Turning a switch on plays its message; the switch turns itself off again.
+func AddMessageSwitches(doorbell *Doorbell, m *Messages) {
+	for _, msg := range m.list {
+		name := msg.Name
+
+		sw := service.NewSwitch()
+		n := characteristic.NewName()
+		n.SetValue(name)
+		sw.AddCharacteristic(n.Characteristic)
+		doorbell.AddService(sw.Service)
+		doorbell.Messages = append(doorbell.Messages, sw)
+
+		sw.On.OnValueRemoteUpdate(func(on bool) {
+			if !on {
+				return
+			}
+			if err := m.Play(name); err != nil {
+				log.Info.Println("message:", err)
+			}
+			time.AfterFunc(messageSwitchReset, func() {
+				sw.On.SetValue(false)
+			})
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package hkdoorbell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+func testMessages(t *testing.T, ff ffmpeg.FFMPEG) (*Messages, string) {
+	dir, err := ioutil.TempDir("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"we will be right there.mp3", "leave the package.WAV", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := LoadMessages(ff, dir, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, dir
+}
+
+func TestLoadMessages(t *testing.T) {
+	m, dir := testMessages(t, ffmpeg.NewFake())
+	defer os.RemoveAll(dir)
+
+	if is, want := m.Names(), []string{"leave the package", "we will be right there"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("names is=%v want=%v", is, want)
+	}
+
+	// a missing directory has no messages
+	m, err := LoadMessages(ffmpeg.NewFake(), filepath.Join(dir, "missing"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if is := m.Names(); len(is) != 0 {
+		t.Fatalf("names is=%v want none", is)
+	}
+}
+
+func TestPlayMessage(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	m, dir := testMessages(t, ff)
+	defer os.RemoveAll(dir)
+
+	if err := m.Play("leave the package"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Play("go away"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	want := []ffmpeg.Call{{Method: "MixSound", File: filepath.Join(dir, "leave the package.WAV"), Volume: 0.5}}
+	if is := ff.Calls(); !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%+v want=%+v", is, want)
+	}
+}
+
+func TestMessageSwitches(t *testing.T) {
+	messageSwitchReset = 10 * time.Millisecond
+
+	ff := ffmpeg.NewFake()
+	m, dir := testMessages(t, ff)
+	defer os.RemoveAll(dir)
+
+	doorbell := NewDoorbell(accessory.Info{Name: "Doorbell"})
+	AddMessageSwitches(doorbell, m)
+	if is, want := len(doorbell.Messages), 2; is != want {
+		t.Fatalf("switches is=%v want=%v", is, want)
+	}
+
+	sw := doorbell.Messages[1]
+	off := make(chan struct{})
+	sw.On.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+		if new == false {
+			close(off)
+		}
+	})
+	sw.On.UpdateValueFromConnection(true, testConn{})
+
+	if is, want := ff.Methods(), []string{"MixSound"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%v want=%v", is, want)
+	}
+	if is, want := ff.Calls()[0].File, filepath.Join(dir, "we will be right there.mp3"); is != want {
+		t.Fatalf("file is=%v want=%v", is, want)
+	}
+
+	// the switch is stateless
+	select {
+	case <-off:
+	case <-time.After(time.Second):
+		t.Fatal("switch is still on")
+	}
+}
@@ -0,0 +1,374 @@
+// Package mqtt is a minimal MQTT 3.1.1 client which subscribes to topics.
+// It receives messages with QoS 0 and 1 and does not publish.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// control packet types (MQTT 3.1.1 2.2.1)
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// the longest packet accepted from the broker
+const maxPacketLength = 1 << 20
+
+var errSubscribe = errors.New("mqtt: subscription refused")
+
+// Options configures the connection to the broker.
+type Options struct {
+	ClientID string
+	// Username and Password are sent if Username is not empty
+	Username string
+	Password string
+	// KeepAlive is the longest time without packets; the client pings the broker
+	// at half of it. Zero uses one minute.
+	KeepAlive time.Duration
+	// Timeout of dialing and of the replies of the broker; zero uses 10 seconds.
+	Timeout time.Duration
+}
+
+// Message is a message published on a subscribed topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client is a connection to an MQTT broker.
+type Client struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	opts     Options
+	messages chan Message
+	subacks  chan byte
+	// done is closed when the connection is lost, quit by Close
+	done chan struct{}
+	quit chan struct{}
+
+	mutex    sync.Mutex
+	packetID uint16
+	err      error
+	closed   bool
+}
+
+// Dial connects to the broker at addr ("host:port").
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = time.Minute
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		opts:     opts,
+		messages: make(chan Message, 16),
+		subacks:  make(chan byte, 1),
+		done:     make(chan struct{}),
+		quit:     make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.read()
+	go c.ping()
+
+	return c, nil
+}
+
+// connect sends the CONNECT packet and waits for its acknowledgement.
+func (c *Client) connect() error {
+	var flags byte = 0x02 // clean session
+	payload := encodeString(c.opts.ClientID)
+	if c.opts.Username != "" {
+		flags |= 0x80 | 0x40
+		payload = append(payload, encodeString(c.opts.Username)...)
+		payload = append(payload, encodeString(c.opts.Password)...)
+	}
+
+	body := append(encodeString("MQTT"), 4, flags)
+	body = append(body, encodeUint16(uint16(c.opts.KeepAlive/time.Second))...)
+	body = append(body, payload...)
+
+	c.conn.SetDeadline(time.Now().Add(c.opts.Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := writePacket(c.conn, packetConnect<<4, body); err != nil {
+		return err
+	}
+
+	header, ack, err := readPacket(c.reader)
+	if err != nil {
+		return err
+	}
+	if header>>4 != packetConnack || len(ack) != 2 {
+		return fmt.Errorf("mqtt: unexpected packet %d", header>>4)
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("mqtt: connection refused with code %d", ack[1])
+	}
+
+	return nil
+}
+
+// Subscribe subscribes to topic, which may contain the wildcards + and #,
+// and waits for the broker to acknowledge it.
+func (c *Client) Subscribe(topic string) error {
+	c.mutex.Lock()
+	c.packetID++
+	id := c.packetID
+	c.mutex.Unlock()
+
+	body := append(encodeUint16(id), encodeString(topic)...)
+	// QoS 1 at most
+	body = append(body, 1)
+	if err := c.write(packetSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	select {
+	case code := <-c.subacks:
+		if code == 0x80 {
+			return errSubscribe
+		}
+		return nil
+	case <-c.done:
+		return c.Err()
+	case <-time.After(c.opts.Timeout):
+		return errors.New("mqtt: subscription timed out")
+	}
+}
+
+// Messages delivers the messages of the subscribed topics.
+// The channel is closed when the connection is lost or closed.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Err returns the reason why the connection was lost; nil while connected.
+func (c *Client) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
+
+// Close disconnects from the broker.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mutex.Unlock()
+
+	if closed {
+		return nil
+	}
+
+	close(c.quit)
+	c.write(packetDisconnect<<4, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) write(header byte, body []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.Timeout))
+	return writePacket(c.conn, header, body)
+}
+
+// read receives the packets of the broker until the connection is lost.
+func (c *Client) read() {
+	var err error
+	defer func() {
+		c.mutex.Lock()
+		if c.closed {
+			err = errors.New("mqtt: connection closed")
+		}
+		c.err = err
+		c.mutex.Unlock()
+
+		close(c.done)
+		close(c.messages)
+		c.conn.Close()
+	}()
+
+	for {
+		// the broker answers the pings within the keep alive
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive + c.opts.Timeout))
+
+		var header byte
+		var body []byte
+		if header, body, err = readPacket(c.reader); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case packetPublish:
+			var m Message
+			var id uint16
+			if m, id, err = decodePublish(header, body); err != nil {
+				return
+			}
+			if id != 0 {
+				if err = c.write(packetPuback<<4, encodeUint16(id)); err != nil {
+					return
+				}
+			}
+			select {
+			case c.messages <- m:
+			case <-c.quit:
+			}
+		case packetSuback:
+			if len(body) < 3 {
+				err = errors.New("mqtt: short suback")
+				return
+			}
+			select {
+			case c.subacks <- body[2]:
+			case <-c.quit:
+			}
+		case packetPingresp:
+		default:
+			err = fmt.Errorf("mqtt: unexpected packet %d", header>>4)
+			return
+		}
+	}
+}
+
+// ping keeps the connection alive until it is lost.
+func (c *Client) ping() {
+	t := time.NewTicker(c.opts.KeepAlive / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := c.write(packetPingreq<<4, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// decodePublish returns the message of a PUBLISH packet
+// and its packet identifier which is zero for QoS 0.
+func decodePublish(header byte, body []byte) (Message, uint16, error) {
+	topic, rest, err := decodeString(body)
+	if err != nil {
+		return Message{}, 0, err
+	}
+
+	var id uint16
+	if qos := header >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return Message{}, 0, errors.New("mqtt: short publish")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+
+	return Message{Topic: topic, Payload: rest}, id, nil
+}
+
+func writePacket(w io.Writer, header byte, body []byte) error {
+	pkt := append([]byte{header}, encodeLength(len(body))...)
+	_, err := w.Write(append(pkt, body...))
+	return err
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the remaining length is encoded in at most four bytes
+	length, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		shift += 7
+	}
+	if length > maxPacketLength {
+		return 0, nil, fmt.Errorf("mqtt: packet of %d bytes is too long", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return header, body, nil
+}
+
+func encodeLength(n int) []byte {
+	var b []byte
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func encodeUint16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func encodeString(s string) []byte {
+	return append(encodeUint16(uint16(len(s))), s...)
+}
+
+func decodeString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: short string")
+	}
+
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
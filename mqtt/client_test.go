@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// broker accepts a single client and passes its packets to handle.
+func broker(t *testing.T, handle func(conn net.Conn, header byte, body []byte)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			header, body, err := readPacket(r)
+			if err != nil {
+				return
+			}
+			handle(conn, header, body)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSubscribe(t *testing.T) {
+	connect := make(chan []byte, 1)
+	addr := broker(t, func(conn net.Conn, header byte, body []byte) {
+		switch header >> 4 {
+		case packetConnect:
+			connect <- body
+			writePacket(conn, packetConnack<<4, []byte{0, 0})
+		case packetSubscribe:
+			writePacket(conn, packetSuback<<4, append(body[:2], 1))
+			// a message with QoS 0 and one with QoS 1
+			writePacket(conn, packetPublish<<4, append(encodeString("doorbell/ring"), "press"...))
+			pkt := append(encodeString("doorbell/ring"), 0, 7)
+			writePacket(conn, packetPublish<<4|0x02, append(pkt, "long"...))
+		case packetPuback:
+			if !bytes.Equal(body, []byte{0, 7}) {
+				t.Errorf("puback is=%v want=[0 7]", body)
+			}
+		}
+	})
+
+	c, err := Dial(addr, Options{ClientID: "hkdoorbell", Username: "user", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	body := <-connect
+	want := append(encodeString("MQTT"), 4, 0xc2, 0, 60)
+	want = append(want, encodeString("hkdoorbell")...)
+	want = append(want, encodeString("user")...)
+	want = append(want, encodeString("secret")...)
+	if !bytes.Equal(body, want) {
+		t.Fatalf("connect is=%v want=%v", body, want)
+	}
+
+	if err := c.Subscribe("doorbell/+"); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"press", "long"} {
+		select {
+		case m := <-c.Messages():
+			if m.Topic != "doorbell/ring" || string(m.Payload) != payload {
+				t.Fatalf("message is=%s %q want=doorbell/ring %q", m.Topic, m.Payload, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	c.Close()
+	if _, ok := <-c.Messages(); ok {
+		t.Fatal("messages not closed")
+	}
+}
+
+func TestConnectionRefused(t *testing.T) {
+	addr := broker(t, func(conn net.Conn, header byte, body []byte) {
+		// not authorized
+		writePacket(conn, packetConnack<<4, []byte{0, 5})
+	})
+
+	if _, err := Dial(addr, Options{ClientID: "hkdoorbell"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		var buf bytes.Buffer
+		writePacket(&buf, packetPingreq<<4, make([]byte, n))
+		_, body, err := readPacket(bufio.NewReader(&buf))
+		if n > maxPacketLength {
+			if err == nil {
+				t.Fatalf("packet of %d bytes accepted", n)
+			}
+			continue
+		}
+		if err != nil || len(body) != n {
+			t.Fatalf("length is=%d want=%d: %v", len(body), n, err)
+		}
+	}
+}
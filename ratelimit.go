@@ -0,0 +1,73 @@
+package hkdoorbell
+
+import (
+	"time"
+)
+
+// reasons why a press does not ring
+const (
+	ringCoalesced = "coalesced"
+	ringCooldown  = "cooldown"
+	ringRate      = "rate"
+)
+
+// RingLimits protects HomeKit and the history from presses in quick succession.
+// Zero values disable the corresponding limit.
+type RingLimits struct {
+	// Coalesce merges a press into the ring of the previous press
+	// if it follows within Coalesce; hammering the button is a single ring
+	Coalesce time.Duration
+	// Cooldown suppresses the presses within Cooldown after a ring
+	Cooldown time.Duration
+	// PerMinute is the highest number of rings within a minute
+	PerMinute int
+	// PrankPerMinute flags the presses as prank while more than PrankPerMinute
+	// presses happened within a minute
+	PrankPerMinute int
+}
+
+// ringLimiter decides which presses ring.
+type ringLimiter struct {
+	limits RingLimits
+	// rings and presses within the last minute
+	rings   []time.Time
+	presses []time.Time
+}
+
+// press records a press at t and returns the reason why it does not ring,
+// empty if it rings, and whether it is a prank.
+func (l *ringLimiter) press(t time.Time) (string, bool) {
+	minuteAgo := t.Add(-time.Minute)
+	l.rings = since(l.rings, minuteAgo)
+	l.presses = since(l.presses, minuteAgo)
+
+	var previous time.Time
+	if n := len(l.presses); n > 0 {
+		previous = l.presses[n-1]
+	}
+	l.presses = append(l.presses, t)
+	prank := l.limits.PrankPerMinute > 0 && len(l.presses) > l.limits.PrankPerMinute
+
+	switch {
+	case !previous.IsZero() && t.Sub(previous) < l.limits.Coalesce:
+		return ringCoalesced, prank
+	case len(l.rings) > 0 && t.Sub(l.rings[len(l.rings)-1]) < l.limits.Cooldown:
+		return ringCooldown, prank
+	case l.limits.PerMinute > 0 && len(l.rings) >= l.limits.PerMinute:
+		return ringRate, prank
+	}
+
+	l.rings = append(l.rings, t)
+	return "", prank
+}
+
+// since returns the times of ts after t; ts is in chronological order.
+func since(ts []time.Time, t time.Time) []time.Time {
+	for i, ti := range ts {
+		if ti.After(t) {
+			return ts[i:]
+		}
+	}
+
+	return ts[:0]
+}
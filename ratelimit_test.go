@@ -0,0 +1,111 @@
+package hkdoorbell
+
+import (
+	"image"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+func TestRingLimiter(t *testing.T) {
+	l := ringLimiter{limits: RingLimits{Coalesce: 2 * time.Second, Cooldown: 10 * time.Second, PerMinute: 3, PrankPerMinute: 5}}
+	start := time.Now()
+
+	presses := []struct {
+		at         time.Duration
+		suppressed string
+		prank      bool
+	}{
+		{0, "", false},
+		// hammering the button is a single ring
+		{time.Second, ringCoalesced, false},
+		{2 * time.Second, ringCoalesced, false},
+		{5 * time.Second, ringCooldown, false},
+		{15 * time.Second, "", false},
+		{30 * time.Second, "", true},
+		// three rings within a minute
+		{45 * time.Second, ringRate, true},
+		// the first ring is older than a minute
+		{61 * time.Second, "", true},
+		{2 * time.Minute, "", false},
+	}
+	for _, p := range presses {
+		suppressed, prank := l.press(start.Add(p.at))
+		if suppressed != p.suppressed || prank != p.prank {
+			t.Fatalf("press at %s is=%q prank=%t want=%q prank=%t", p.at, suppressed, prank, p.suppressed, p.prank)
+		}
+	}
+}
+
+func TestRingLimiterDisabled(t *testing.T) {
+	l := ringLimiter{}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if suppressed, prank := l.press(now); suppressed != "" || prank {
+			t.Fatalf("press %d suppressed=%q prank=%t", i, suppressed, prank)
+		}
+	}
+}
+
+// testRings records the presses of a RingHandler.
+type testRings struct {
+	mutex      sync.Mutex
+	suppressed []string
+	pranks     int
+	inserted   chan struct{}
+}
+
+func (h *testRings) InsertRing(source string, suppressed string, prank bool) {
+	h.mutex.Lock()
+	h.suppressed = append(h.suppressed, suppressed)
+	if prank {
+		h.pranks++
+	}
+	h.mutex.Unlock()
+
+	h.inserted <- struct{}{}
+}
+
+func (h *testRings) InsertSnapshot(image *image.Image) {
+}
+
+func TestRingHandlerSuppressesPresses(t *testing.T) {
+	event := characteristic.NewProgrammableSwitchEvent()
+	events := make(chan interface{}, 10)
+	event.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+		events <- new
+	})
+	history := &testRings{inserted: make(chan struct{}, 10)}
+
+	h := InitRingHandler(ffmpeg.NewFake(), event, nil, history, RingLimits{Cooldown: time.Minute, PrankPerMinute: 2})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		h.Ring("gpio")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-history.inserted:
+		case <-time.After(time.Second):
+			t.Fatalf("press %d not recorded", i)
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("HomeKit events is=%d want=1", len(events))
+	}
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	suppressed := map[string]int{}
+	for _, s := range history.suppressed {
+		suppressed[s]++
+	}
+	if suppressed[""] != 1 || suppressed[ringCooldown] != 2 || history.pranks != 1 {
+		t.Fatalf("presses is=%v with %d pranks", history.suppressed, history.pranks)
+	}
+}
@@ -0,0 +1,140 @@
+package hkdoorbell
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/log"
+	"github.com/brutella/hc/service"
+
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// RelayConfig describes how the relay of an existing chime is pulsed when someone rings.
+type RelayConfig struct {
+	// Pattern is played once on the relay for every ring
+	Pattern Pattern
+	// Patterns replaces Pattern for the rings of a source, e.g. "mqtt"
+	Patterns map[string]Pattern
+}
+
+// RelayChime rings an existing mechanical or electronic chime through a relay.
+// It can be muted while the HomeKit notifications continue.
+type RelayChime struct {
+	cfg RelayConfig
+	out Output
+
+	mutex   sync.Mutex
+	muted   bool
+	pulsing bool
+}
+
+func InitRelayChime(cfg RelayConfig, out Output) *RelayChime {
+	return &RelayChime{
+		cfg: cfg,
+		out: out,
+	}
+}
+
+// Ring plays the pattern of source on the relay in the background
+// unless the chime is muted or still ringing.
+func (c *RelayChime) Ring(source string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.muted {
+		log.Debug.Println("relay chime: muted")
+		return
+	}
+	if c.pulsing {
+		return
+	}
+	c.pulsing = true
+
+	p, ok := c.cfg.Patterns[source]
+	if !ok {
+		p = c.cfg.Pattern
+	}
+	go c.play(p)
+}
+
+// play writes the steps of p and releases the relay at the end.
+func (c *RelayChime) play(p Pattern) {
+	for _, st := range p {
+		c.write(st.Value)
+		time.Sleep(st.Duration)
+	}
+	c.write(rpi.LOW)
+
+	c.mutex.Lock()
+	c.pulsing = false
+	c.mutex.Unlock()
+}
+
+func (c *RelayChime) write(v rpi.Value) {
+	if err := c.out.Write(v); err != nil {
+		log.Info.Println("relay chime:", err)
+	}
+}
+
+// SetMuted mutes or unmutes the chime.
+func (c *RelayChime) SetMuted(muted bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	log.Debug.Println("relay chime: muted", muted)
+	c.muted = muted
+}
+
+func (c *RelayChime) Muted() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.muted
+}
+
+// AddRelayMuteSwitch adds a switch to the doorbell which mutes the chime while it is on.
+func AddRelayMuteSwitch(doorbell *Doorbell, c *RelayChime) {
+	sw := service.NewSwitch()
+	n := characteristic.NewName()
+	n.SetValue("Mute Chime")
+	sw.AddCharacteristic(n.Characteristic)
+	doorbell.AddService(sw.Service)
+	doorbell.ChimeMute = sw
+
+	sw.On.SetValue(c.Muted())
+	sw.On.OnValueRemoteUpdate(c.SetMuted)
+}
+
+// ParseRelayPatterns parses the relay patterns of the sources written as
+// "source=pattern" separated by semicolons, e.g. "gpio=on:300ms;mqtt=on:100ms,off:100ms,on:100ms".
+// Every step needs a duration since the pattern is played once.
+func ParseRelayPatterns(s string) (map[string]Pattern, error) {
+	patterns := make(map[string]Pattern)
+	for _, field := range strings.Split(s, ";") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(field, "=", 2)
+		source := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || source == "" {
+			return nil, fmt.Errorf("invalid relay pattern %q: use source=pattern", field)
+		}
+		p, err := ParsePattern(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range p {
+			if st.Duration == 0 {
+				return nil, fmt.Errorf("invalid relay pattern %q: every step needs a duration", field)
+			}
+		}
+		patterns[source] = p
+	}
+
+	return patterns, nil
+}
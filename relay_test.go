@@ -0,0 +1,84 @@
+package hkdoorbell
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+func TestParseRelayPatterns(t *testing.T) {
+	p, err := ParseRelayPatterns("gpio=on:300ms; mqtt=on:100ms,off:100ms,on:100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Pattern{
+		"gpio": {{rpi.HIGH, 300 * time.Millisecond}},
+		"mqtt": {{rpi.HIGH, 100 * time.Millisecond}, {rpi.LOW, 100 * time.Millisecond}, {rpi.HIGH, 100 * time.Millisecond}},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("patterns is=%v want=%v", p, want)
+	}
+
+	for _, s := range []string{"gpio", "=on:1s", "gpio=on", "gpio=blink:1s"} {
+		if _, err := ParseRelayPatterns(s); err == nil {
+			t.Fatalf("%q is valid", s)
+		}
+	}
+}
+
+// expectValues waits for the values written to out.
+func expectValues(t *testing.T, out chanOutput, want ...rpi.Value) {
+	t.Helper()
+
+	for i, w := range want {
+		select {
+		case v := <-out:
+			if v != w {
+				t.Fatalf("value %d is=%v want=%v", i, v, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("value %d not written", i)
+		}
+	}
+}
+
+func TestRelayChimePatterns(t *testing.T) {
+	out := make(chanOutput, 10)
+	c := InitRelayChime(RelayConfig{
+		Pattern:  Pattern{{rpi.HIGH, time.Millisecond}},
+		Patterns: map[string]Pattern{"mqtt": {{rpi.HIGH, time.Millisecond}, {rpi.LOW, time.Millisecond}, {rpi.HIGH, time.Millisecond}}},
+	}, out)
+
+	c.Ring("gpio")
+	expectValues(t, out, rpi.HIGH, rpi.LOW)
+
+	// wait for the end of the pulse
+	time.Sleep(10 * time.Millisecond)
+	c.Ring("mqtt")
+	expectValues(t, out, rpi.HIGH, rpi.LOW, rpi.HIGH, rpi.LOW)
+}
+
+func TestRelayMuteSwitch(t *testing.T) {
+	out := make(chanOutput, 10)
+	c := InitRelayChime(RelayConfig{Pattern: Pattern{{rpi.HIGH, time.Millisecond}}}, out)
+	doorbell := NewDoorbell(accessory.Info{Name: "Doorbell"})
+	AddRelayMuteSwitch(doorbell, c)
+
+	doorbell.ChimeMute.On.UpdateValueFromConnection(true, testConn{})
+	if !c.Muted() {
+		t.Fatal("chime not muted by the switch")
+	}
+	c.Ring("gpio")
+	time.Sleep(10 * time.Millisecond)
+	if len(out) != 0 {
+		t.Fatalf("muted chime wrote %d values", len(out))
+	}
+
+	doorbell.ChimeMute.On.UpdateValueFromConnection(false, testConn{})
+	c.Ring("gpio")
+	expectValues(t, out, rpi.HIGH, rpi.LOW)
+}
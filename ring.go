@@ -0,0 +1,99 @@
+package hkdoorbell
+
+import (
+	"image"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+// RingHistory records the presses and the snapshots of the rings, e.g. the backend.
+type RingHistory interface {
+	// InsertRing records a press at source; suppressed is the reason
+	// why it did not ring, empty if it rang
+	InsertRing(source string, suppressed string, prank bool)
+	InsertSnapshot(image *image.Image)
+}
+
+// RingHandler handles the presses of every trigger source: a press which is
+// not suppressed by the limits rings, that is it sends the HomeKit doorbell event,
+// plays the chime and takes a snapshot. Every press is recorded.
+type RingHandler struct {
+	ff          ffmpeg.FFMPEG
+	switchEvent *characteristic.ProgrammableSwitchEvent
+	chime       *Chime
+	history     RingHistory
+	now         func() time.Time
+
+	mutex   sync.Mutex
+	limiter ringLimiter
+	onRing  []func(source string)
+}
+
+// InitRingHandler returns a handler of the rings; chime and history may be nil.
+func InitRingHandler(ff ffmpeg.FFMPEG, switchEvent *characteristic.ProgrammableSwitchEvent, chime *Chime, history RingHistory, limits RingLimits) *RingHandler {
+	return &RingHandler{
+		ff:          ff,
+		switchEvent: switchEvent,
+		chime:       chime,
+		history:     history,
+		now:         time.Now,
+		limiter:     ringLimiter{limits: limits},
+	}
+}
+
+// OnRing adds a function which is called for every press which rings, e.g. to blink the LED.
+func (h *RingHandler) OnRing(fn func(source string)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.onRing = append(h.onRing, fn)
+}
+
+// Ring notifies HomeKit that someone rang at source unless the limits suppress it.
+// Chime, snapshot and history run in the background so that the sources are never blocked.
+func (h *RingHandler) Ring(source string) {
+	h.mutex.Lock()
+	suppressed, prank := h.limiter.press(h.now())
+	onRing := h.onRing
+	h.mutex.Unlock()
+
+	if suppressed != "" {
+		log.Debug.Printf("ring from %s suppressed (%s, prank %t)\n", source, suppressed, prank)
+		if h.history != nil {
+			go h.history.InsertRing(source, suppressed, prank)
+		}
+		return
+	}
+
+	log.Debug.Printf(">>> Someone rang the doorbell (%s) <<<\n", source)
+	h.switchEvent.SetValue(1)
+	for _, fn := range onRing {
+		fn(source)
+	}
+
+	go h.record(source, prank)
+}
+
+// record plays the chime and records the ring with a snapshot in the history.
+func (h *RingHandler) record(source string, prank bool) {
+	if h.chime != nil {
+		h.chime.Ring()
+	}
+
+	if h.history == nil {
+		return
+	}
+	h.history.InsertRing(source, "", prank)
+
+	// this is the size used by preview on IOS
+	// we hope that it doesn't change :)
+	img, err := h.ff.Snapshot(1280, 960)
+	if img != nil && err == nil {
+		h.history.InsertSnapshot(img)
+	}
+}
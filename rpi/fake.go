@@ -0,0 +1,231 @@
+package rpi
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FakeChip is an in-memory Chip for tests and for the simulated hardware.
+// The level of its input lines is set with Set.
+type FakeChip struct {
+	// KeepValues limits the values kept by every output line requested afterwards;
+	// zero keeps all of them
+	KeepValues int
+
+	mutex   sync.Mutex
+	inputs  map[int]*FakeInput
+	outputs map[int]*FakeOutput
+}
+
+var _ Chip = &FakeChip{}
+
+// NewFakeChip returns a FakeChip without requested lines.
+func NewFakeChip() *FakeChip {
+	return &FakeChip{
+		inputs:  make(map[int]*FakeInput),
+		outputs: make(map[int]*FakeOutput),
+	}
+}
+
+func (c *FakeChip) RequestInput(offset int, cfg InputConfig) (InputLine, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(offset); err != nil {
+		return nil, err
+	}
+
+	// the bias sets the level of an unconnected line
+	l := &FakeInput{Config: cfg, events: make(chan Event, eventBuffer)}
+	if cfg.Bias == PullUp {
+		l.value = HIGH
+	}
+	c.inputs[offset] = l
+
+	return l, nil
+}
+
+func (c *FakeChip) RequestOutput(offset int, value Value) (OutputLine, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.check(offset); err != nil {
+		return nil, err
+	}
+
+	l := &FakeOutput{values: []Value{value}, keep: c.KeepValues}
+	c.outputs[offset] = l
+
+	return l, nil
+}
+
+// check returns an error if the line at offset is already requested.
+func (c *FakeChip) check(offset int) error {
+	if c.inputs[offset] != nil || c.outputs[offset] != nil {
+		return fmt.Errorf("gpio line %d: device or resource busy", offset)
+	}
+
+	return nil
+}
+
+func (c *FakeChip) Close() error {
+	return nil
+}
+
+// Input returns the input line requested at offset; nil if it was not requested.
+func (c *FakeChip) Input(offset int) *FakeInput {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.inputs[offset]
+}
+
+// Output returns the output line requested at offset; nil if it was not requested.
+func (c *FakeChip) Output(offset int) *FakeOutput {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.outputs[offset]
+}
+
+// Lines returns the offsets of the requested input and output lines in increasing order.
+func (c *FakeChip) Lines() (inputs []int, outputs []int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for o := range c.inputs {
+		inputs = append(inputs, o)
+	}
+	for o := range c.outputs {
+		outputs = append(outputs, o)
+	}
+	sort.Ints(inputs)
+	sort.Ints(outputs)
+
+	return inputs, outputs
+}
+
+// FakeInput is an input line of a FakeChip.
+type FakeInput struct {
+	// Config is the configuration of the request
+	Config InputConfig
+
+	mutex  sync.Mutex
+	value  Value
+	closed bool
+	events chan Event
+}
+
+// Set changes the level of the line and reports the edge if it is configured.
+// The kernel debounce is not simulated; every change is an edge.
+// Like the kernel, the line drops the edge if the buffer of Events is full.
+func (l *FakeInput) Set(value Value) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed || value == l.value {
+		return
+	}
+	l.value = value
+
+	edge := RisingEdge
+	if value == LOW {
+		edge = FallingEdge
+	}
+	if l.Config.Edge == edge || l.Config.Edge == BothEdges {
+		select {
+		case l.events <- Event{Edge: edge}:
+		default:
+		}
+	}
+}
+
+// Press pulls the line low and releases it, like a button with a pull-up.
+func (l *FakeInput) Press() {
+	l.Set(LOW)
+	l.Set(HIGH)
+}
+
+// Toggle changes the level of the line and restores it,
+// like a button which connects the line to the other level.
+func (l *FakeInput) Toggle() {
+	v, _ := l.Read()
+	l.Set(v ^ 1)
+	l.Set(v)
+}
+
+func (l *FakeInput) Read() (Value, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.value, nil
+}
+
+func (l *FakeInput) Events() <-chan Event {
+	if l.Config.Edge == NoEdge {
+		return nil
+	}
+
+	return l.events
+}
+
+func (l *FakeInput) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+
+	return nil
+}
+
+// FakeOutput is an output line of a FakeChip.
+type FakeOutput struct {
+	mutex  sync.Mutex
+	values []Value
+	keep   int
+	closed bool
+}
+
+func (l *FakeOutput) Write(value Value) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return fmt.Errorf("gpio line is closed")
+	}
+	l.values = append(l.values, value)
+	if l.keep > 0 && len(l.values) > l.keep {
+		l.values = append(l.values[:0], l.values[len(l.values)-l.keep:]...)
+	}
+
+	return nil
+}
+
+// Values returns the initial value and every written value in order;
+// only the last KeepValues of the chip are kept.
+func (l *FakeOutput) Values() []Value {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]Value{}, l.values...)
+}
+
+// Value returns the last written value.
+func (l *FakeOutput) Value() Value {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.values[len(l.values)-1]
+}
+
+func (l *FakeOutput) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	return nil
+}
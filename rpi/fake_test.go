@@ -0,0 +1,40 @@
+package rpi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeInputWithoutReader(t *testing.T) {
+	l, err := NewFakeChip().RequestInput(17, InputConfig{Edge: BothEdges, Bias: PullUp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := l.(*FakeInput)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < eventBuffer; i++ {
+			input.Toggle()
+		}
+		input.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("set blocks when nobody reads the events")
+	}
+
+	// the first edges are kept
+	n := 0
+	for e := range input.Events() {
+		if want := []Edge{FallingEdge, RisingEdge}[n%2]; e.Edge != want {
+			t.Fatalf("edge %d is=%v want=%v", n, e.Edge, want)
+		}
+		n++
+	}
+	if n != eventBuffer {
+		t.Fatalf("events is=%d want=%d", n, eventBuffer)
+	}
+}
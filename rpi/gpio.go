@@ -0,0 +1,97 @@
+// Package rpi requests GPIO lines from the Linux GPIO character device
+// (/dev/gpiochipN) with edge events, debounce and bias.
+package rpi
+
+import (
+	"errors"
+	"time"
+)
+
+// Indicate the current state of the pin.
+type Value int
+
+const (
+	LOW  = iota // pin is low (off)
+	HIGH        // pin is high (on)
+)
+
+// Edge selects the transitions of an input line which are reported as events.
+type Edge int
+
+const (
+	NoEdge      Edge = iota // no events
+	RisingEdge              // low to high
+	FallingEdge             // high to low
+	BothEdges               // both transitions
+)
+
+// Bias selects the internal pull resistor of an input line.
+type Bias int
+
+const (
+	BiasAsIs     Bias = iota // keep the bias configured by the firmware
+	PullUp                   // internal pull-up
+	PullDown                 // internal pull-down
+	BiasDisabled             // no pull resistor
+)
+
+// ParseBias returns the bias named "as-is", "pull-up", "pull-down" or "disabled".
+func ParseBias(name string) (Bias, error) {
+	switch name {
+	case "", "as-is":
+		return BiasAsIs, nil
+	case "pull-up":
+		return PullUp, nil
+	case "pull-down":
+		return PullDown, nil
+	case "disabled":
+		return BiasDisabled, nil
+	}
+
+	return BiasAsIs, errors.New("unknown bias " + name)
+}
+
+// InputConfig configures an input line.
+type InputConfig struct {
+	Edge Edge
+	Bias Bias
+	// Debounce is the time the line must be stable before an edge is reported;
+	// zero disables the debouncing of the kernel
+	Debounce time.Duration
+}
+
+// Event is an edge of an input line.
+type Event struct {
+	// Edge is RisingEdge or FallingEdge
+	Edge Edge
+	// Time is the monotonic timestamp of the edge
+	Time time.Duration
+}
+
+// InputLine is a line requested for input.
+type InputLine interface {
+	Read() (Value, error)
+	// Events delivers the configured edges until the line is closed.
+	Events() <-chan Event
+	Close() error
+}
+
+// OutputLine is a line requested for output.
+type OutputLine interface {
+	Write(Value) error
+	Close() error
+}
+
+// Chip requests the lines of a GPIO chip by their offset,
+// which is the BCM number of the pin on the Raspberry Pi.
+type Chip interface {
+	RequestInput(offset int, cfg InputConfig) (InputLine, error)
+	RequestOutput(offset int, value Value) (OutputLine, error)
+	Close() error
+}
+
+// consumer is the name of the lines' user shown by the kernel
+const consumer = "hkdoorbell"
+
+// eventBuffer is the number of events buffered by Events
+const eventBuffer = 16
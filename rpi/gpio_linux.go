@@ -0,0 +1,274 @@
+//go:build linux
+// +build linux
+
+package rpi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// GPIO v2 uAPI of <linux/gpio.h>
+const (
+	linesMax    = 64
+	numAttrsMax = 10
+	nameSize    = 32
+
+	lineFlagInput        = 1 << 2
+	lineFlagOutput       = 1 << 3
+	lineFlagEdgeRising   = 1 << 4
+	lineFlagEdgeFalling  = 1 << 5
+	lineFlagBiasPullUp   = 1 << 8
+	lineFlagBiasPullDown = 1 << 9
+	lineFlagBiasDisabled = 1 << 10
+
+	lineAttrIDOutputValues = 2
+	lineAttrIDDebounce     = 3
+
+	lineEventRisingEdge  = 1
+	lineEventFallingEdge = 2
+
+	// length of struct gpio_v2_line_event
+	lineEventSize = 48
+)
+
+type lineAttribute struct {
+	id      uint32
+	padding uint32
+	// flags, values or debounce_period_us
+	value uint64
+}
+
+type lineConfigAttribute struct {
+	attr lineAttribute
+	mask uint64
+}
+
+type lineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [numAttrsMax]lineConfigAttribute
+}
+
+type lineRequest struct {
+	offsets         [linesMax]uint32
+	consumer        [nameSize]byte
+	config          lineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32
+}
+
+type lineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// ioctl request numbers: _IOWR(0xB4, nr, size)
+func iowr(nr uintptr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xb4<<8 | nr
+}
+
+var (
+	getLineIoctl     = iowr(0x07, unsafe.Sizeof(lineRequest{}))
+	getLineValsIoctl = iowr(0x0e, unsafe.Sizeof(lineValues{}))
+	setLineValsIoctl = iowr(0x0f, unsafe.Sizeof(lineValues{}))
+)
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+type chip struct {
+	f *os.File
+}
+
+// OpenChip opens a GPIO chip by its name, e.g. "gpiochip0", or its path.
+func OpenChip(name string) (Chip, error) {
+	path := name
+	if !strings.Contains(name, "/") {
+		path = filepath.Join("/dev", name)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chip{f}, nil
+}
+
+func (c *chip) request(offset int, cfg lineConfig) (*os.File, error) {
+	req := lineRequest{numLines: 1, config: cfg}
+	req.offsets[0] = uint32(offset)
+	copy(req.consumer[:], consumer)
+	if cfg.flags&(lineFlagEdgeRising|lineFlagEdgeFalling) != 0 {
+		req.eventBufferSize = eventBuffer
+	}
+
+	if err := ioctl(c.f.Fd(), getLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("gpio line %d: %v", offset, err)
+	}
+
+	// the line is non-blocking so that closing it ends a pending read
+	if err := syscall.SetNonblock(int(req.fd), true); err != nil {
+		syscall.Close(int(req.fd))
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(req.fd), fmt.Sprintf("%s:%d", c.f.Name(), offset)), nil
+}
+
+// RequestInput requests the line at offset for input with edge events, bias and debounce.
+func (c *chip) RequestInput(offset int, cfg InputConfig) (InputLine, error) {
+	lc := lineConfig{flags: inputFlags(cfg)}
+	if cfg.Debounce > 0 {
+		lc.numAttrs = 1
+		lc.attrs[0] = lineConfigAttribute{
+			attr: lineAttribute{id: lineAttrIDDebounce, value: uint64(cfg.Debounce / time.Microsecond)},
+			mask: 1,
+		}
+	}
+
+	f, err := c.request(offset, lc)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &line{f: f, done: make(chan struct{})}
+	if cfg.Edge != NoEdge {
+		l.events = make(chan Event, eventBuffer)
+		go l.readEvents()
+	}
+
+	return l, nil
+}
+
+// RequestOutput requests the line at offset for output set to value.
+func (c *chip) RequestOutput(offset int, value Value) (OutputLine, error) {
+	lc := lineConfig{flags: lineFlagOutput, numAttrs: 1}
+	lc.attrs[0] = lineConfigAttribute{
+		attr: lineAttribute{id: lineAttrIDOutputValues, value: uint64(value & 1)},
+		mask: 1,
+	}
+
+	f, err := c.request(offset, lc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line{f: f, done: make(chan struct{})}, nil
+}
+
+func (c *chip) Close() error {
+	return c.f.Close()
+}
+
+// inputFlags returns the line flags of cfg.
+func inputFlags(cfg InputConfig) uint64 {
+	flags := uint64(lineFlagInput)
+
+	switch cfg.Edge {
+	case RisingEdge:
+		flags |= lineFlagEdgeRising
+	case FallingEdge:
+		flags |= lineFlagEdgeFalling
+	case BothEdges:
+		flags |= lineFlagEdgeRising | lineFlagEdgeFalling
+	}
+
+	switch cfg.Bias {
+	case PullUp:
+		flags |= lineFlagBiasPullUp
+	case PullDown:
+		flags |= lineFlagBiasPullDown
+	case BiasDisabled:
+		flags |= lineFlagBiasDisabled
+	}
+
+	return flags
+}
+
+// line is a single requested line.
+type line struct {
+	f      *os.File
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *line) Read() (Value, error) {
+	v := lineValues{mask: 1}
+	if err := ioctl(l.f.Fd(), getLineValsIoctl, unsafe.Pointer(&v)); err != nil {
+		return LOW, err
+	}
+
+	return Value(v.bits & 1), nil
+}
+
+func (l *line) Write(value Value) error {
+	v := lineValues{bits: uint64(value & 1), mask: 1}
+	return ioctl(l.f.Fd(), setLineValsIoctl, unsafe.Pointer(&v))
+}
+
+func (l *line) Events() <-chan Event {
+	return l.events
+}
+
+// readEvents delivers the events read from the line until it is closed.
+func (l *line) readEvents() {
+	defer close(l.events)
+
+	buf := make([]byte, eventBuffer*lineEventSize)
+	for {
+		n, err := l.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for i := 0; i+lineEventSize <= n; i += lineEventSize {
+			e, ok := decodeEvent(buf[i : i+lineEventSize])
+			if !ok {
+				continue
+			}
+			select {
+			case l.events <- e:
+			case <-l.done:
+				return
+			}
+		}
+	}
+}
+
+// decodeEvent decodes a struct gpio_v2_line_event of a little endian host.
+func decodeEvent(b []byte) (Event, bool) {
+	e := Event{Time: time.Duration(binary.LittleEndian.Uint64(b[0:8]))}
+	switch binary.LittleEndian.Uint32(b[8:12]) {
+	case lineEventRisingEdge:
+		e.Edge = RisingEdge
+	case lineEventFallingEdge:
+		e.Edge = FallingEdge
+	default:
+		return e, false
+	}
+
+	return e, true
+}
+
+func (l *line) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.f.Close()
+}
@@ -0,0 +1,54 @@
+package rpi
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// sizes of the structs of <linux/gpio.h> on every architecture
+func TestLineStructSizes(t *testing.T) {
+	sizes := []struct {
+		name     string
+		is, want uintptr
+	}{
+		{"gpio_v2_line_attribute", unsafe.Sizeof(lineAttribute{}), 16},
+		{"gpio_v2_line_config_attribute", unsafe.Sizeof(lineConfigAttribute{}), 24},
+		{"gpio_v2_line_config", unsafe.Sizeof(lineConfig{}), 272},
+		{"gpio_v2_line_request", unsafe.Sizeof(lineRequest{}), 592},
+		{"gpio_v2_line_values", unsafe.Sizeof(lineValues{}), 16},
+	}
+	for _, s := range sizes {
+		if s.is != s.want {
+			t.Fatalf("%s is=%d want=%d", s.name, s.is, s.want)
+		}
+	}
+
+	if is, want := getLineIoctl, uintptr(0xc250b407); is != want {
+		t.Fatalf("GPIO_V2_GET_LINE_IOCTL is=%#x want=%#x", is, want)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	b := make([]byte, lineEventSize)
+	binary.LittleEndian.PutUint64(b[0:], uint64(3*time.Second))
+	binary.LittleEndian.PutUint32(b[8:], lineEventFallingEdge)
+
+	e, ok := decodeEvent(b)
+	if !ok || e.Edge != FallingEdge || e.Time != 3*time.Second {
+		t.Fatalf("event is=%+v", e)
+	}
+
+	binary.LittleEndian.PutUint32(b[8:], 7)
+	if _, ok := decodeEvent(b); ok {
+		t.Fatal("unknown event decoded")
+	}
+}
+
+func TestInputFlags(t *testing.T) {
+	is := inputFlags(InputConfig{Edge: BothEdges, Bias: PullUp})
+	if want := uint64(lineFlagInput | lineFlagEdgeRising | lineFlagEdgeFalling | lineFlagBiasPullUp); is != want {
+		t.Fatalf("flags is=%#x want=%#x", is, want)
+	}
+}
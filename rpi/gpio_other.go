@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package rpi
+
+import (
+	"errors"
+	"runtime"
+)
+
+// OpenChip fails since the GPIO character device is only available on Linux.
+func OpenChip(name string) (Chip, error) {
+	return nil, errors.New("gpio is not supported on " + runtime.GOOS)
+}
@@ -36,7 +36,7 @@ func first(ips []net.IP, filter func(net.IP) bool) net.IP {
 }
 
 func setupStreamManagement(m *service.CameraRTPStreamManagement, ff ffmpeg.FFMPEG) {
-	status := rtp.StreamingStatus{rtp.StreamingStatusAvailable}
+	status := rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable}
 	setTLV8Payload(m.StreamingStatus.Bytes, status)
 	setTLV8Payload(m.SupportedRTPConfiguration.Bytes, rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80))
 	setTLV8Payload(m.SupportedVideoStreamConfiguration.Bytes, rtp.DefaultVideoStreamConfiguration())
@@ -57,14 +57,14 @@ func setupStreamManagement(m *service.CameraRTPStreamManagement, ff ffmpeg.FFMPE
 
 			if ff.ActiveStreams() == 0 {
 				// Update stream status when no streams are currently active
-				setTLV8Payload(m.StreamingStatus.Bytes, rtp.StreamingStatus{rtp.StreamingStatusAvailable})
+				setTLV8Payload(m.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable})
 			}
 
 		case rtp.SessionControlCommandTypeStart:
 			ff.Start(id, cfg.Video, cfg.Audio)
 			// Only one video stream is suppported, set the status to busy.
 			// This way HomeKit knows that nobody is allowed to connect anymore.
-			setTLV8Payload(m.StreamingStatus.Bytes, rtp.StreamingStatus{rtp.StreamingStatusBusy})
+			setTLV8Payload(m.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusBusy})
 
 		case rtp.SessionControlCommandTypeSuspend:
 			ff.Suspend(id)
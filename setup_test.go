@@ -0,0 +1,289 @@
+package hkdoorbell
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/brutella/hc/rtp"
+	"github.com/brutella/hc/service"
+	"github.com/brutella/hc/tlv8"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+)
+
+// testConn is a connection from a HomeKit controller to the loopback interface.
+type testConn struct {
+	net.Conn
+}
+
+func (c testConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51826}
+}
+
+var testSessionID = []byte{0x75, 0xbc, 0xb6, 0x22, 0x7d, 0x13, 0x41, 0x78, 0xb4, 0xb9, 0x6f, 0x39, 0x44, 0x5d, 0x14, 0x27}
+
+func newTestStreamManagement(t *testing.T) (*service.CameraRTPStreamManagement, *ffmpeg.Fake) {
+	m := service.NewCameraRTPStreamManagement()
+	ff := ffmpeg.NewFake()
+	setupStreamManagement(m, ff)
+
+	return m, ff
+}
+
+func testCryptoSuite(key byte) rtp.CryptoSuite {
+	return rtp.CryptoSuite{
+		Types:      []rtp.CryptoSuiteType{{Type: rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80}},
+		MasterKey:  bytes.Repeat([]byte{key}, 16),
+		MasterSalt: bytes.Repeat([]byte{key + 1}, 14),
+	}
+}
+
+func writeTLV8(t *testing.T, c interface {
+	UpdateValueFromConnection(interface{}, net.Conn)
+}, v interface{}) {
+	b, err := tlv8.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UpdateValueFromConnection(base64.StdEncoding.EncodeToString(b), testConn{})
+}
+
+func setupEndpoints(t *testing.T, m *service.CameraRTPStreamManagement, session []byte) rtp.SetupEndpointsResponse {
+	req := rtp.SetupEndpoints{
+		SessionId: session,
+		ControllerAddr: rtp.Addr{
+			IPVersion:    rtp.IPAddrVersionv4,
+			IPAddr:       "127.0.0.1",
+			VideoRtpPort: 50000,
+			AudioRtpPort: 50002,
+		},
+		Video: testCryptoSuite(1),
+		Audio: testCryptoSuite(3),
+	}
+	writeTLV8(t, m.SetupEndpoints.Characteristic, req)
+
+	var resp rtp.SetupEndpointsResponse
+	if err := tlv8.Unmarshal(m.SetupEndpoints.GetValue(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func selectStreamConfiguration(t *testing.T, m *service.CameraRTPStreamManagement, session []byte, cmd byte, video rtp.VideoParameters, audio rtp.AudioParameters) {
+	cfg := rtp.StreamConfiguration{
+		Command: rtp.SessionControlCommand{Identifier: session, Type: cmd},
+		Video:   video,
+		Audio:   audio,
+	}
+	writeTLV8(t, m.SelectedRTPStreamConfiguration.Characteristic, cfg)
+}
+
+func streamingStatus(t *testing.T, m *service.CameraRTPStreamManagement) byte {
+	var status rtp.StreamingStatus
+	if err := tlv8.Unmarshal(m.StreamingStatus.GetValue(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	return status.Status
+}
+
+func testVideoParameters(width, height uint16) rtp.VideoParameters {
+	return rtp.VideoParameters{
+		CodecType: rtp.VideoCodecType_H264,
+		CodecParams: rtp.VideoCodecParameters{
+			Profiles: []rtp.VideoCodecProfile{{Id: rtp.VideoCodecProfileMain}},
+			Levels:   []rtp.VideoCodecLevel{{Level: rtp.VideoCodecLevel4}},
+		},
+		Attributes: rtp.VideoCodecAttributes{Width: width, Height: height, Framerate: 30},
+		RTP:        rtp.RTPParams{PayloadType: 99, Ssrc: 1, Bitrate: 299, MTU: 1378},
+	}
+}
+
+func testAudioParameters() rtp.AudioParameters {
+	return rtp.AudioParameters{
+		CodecType: rtp.AudioCodecType_AAC_ELD,
+		CodecParams: rtp.AudioCodecParameters{
+			Channels:   1,
+			Bitrate:    rtp.AudioCodecBitrateVariable,
+			Samplerate: rtp.AudioCodecSampleRate16Khz,
+		},
+		RTP: rtp.RTPParams{PayloadType: 110, Ssrc: 2, Bitrate: 24},
+	}
+}
+
+func TestSupportedConfiguration(t *testing.T) {
+	m, ff := newTestStreamManagement(t)
+
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusAvailable; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+
+	var video rtp.VideoStreamConfiguration
+	if err := tlv8.Unmarshal(m.SupportedVideoStreamConfiguration.GetValue(), &video); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(video.Codecs), 1; is != want {
+		t.Fatalf("video codecs is=%v want=%v", is, want)
+	}
+
+	var audio rtp.AudioStreamConfiguration
+	if err := tlv8.Unmarshal(m.SupportedAudioStreamConfiguration.GetValue(), &audio); err != nil {
+		t.Fatal(err)
+	}
+	if is, want := len(audio.Codecs), 2; is != want {
+		t.Fatalf("audio codecs is=%v want=%v", is, want)
+	}
+
+	if calls := ff.Calls(); len(calls) != 0 {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+}
+
+func TestSetupEndpoints(t *testing.T) {
+	m, ff := newTestStreamManagement(t)
+
+	resp := setupEndpoints(t, m, testSessionID)
+
+	if is, want := resp.SessionId, testSessionID; !reflect.DeepEqual(is, want) {
+		t.Fatalf("session is=%v want=%v", is, want)
+	}
+	if is, want := resp.Status, rtp.SessionStatusSuccess; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+	if is, want := resp.AccessoryAddr.IPAddr, "127.0.0.1"; is != want {
+		t.Fatalf("ip is=%v want=%v", is, want)
+	}
+	if is, want := resp.AccessoryAddr.IPVersion, rtp.IPAddrVersionv4; is != want {
+		t.Fatalf("ip version is=%v want=%v", is, want)
+	}
+	if is, want := resp.AccessoryAddr.VideoRtpPort, uint16(50000); is != want {
+		t.Fatalf("video port is=%v want=%v", is, want)
+	}
+	if is, want := resp.AccessoryAddr.AudioRtpPort, uint16(50002); is != want {
+		t.Fatalf("audio port is=%v want=%v", is, want)
+	}
+	if is, want := resp.Video.MasterKey, testCryptoSuite(1).MasterKey; !reflect.DeepEqual(is, want) {
+		t.Fatalf("video key is=%v want=%v", is, want)
+	}
+	if is, want := resp.Audio.MasterSalt, testCryptoSuite(3).MasterSalt; !reflect.DeepEqual(is, want) {
+		t.Fatalf("audio salt is=%v want=%v", is, want)
+	}
+	if resp.SsrcVideo < 0 || resp.SsrcAudio < 0 {
+		t.Fatalf("negative ssrc video=%v audio=%v", resp.SsrcVideo, resp.SsrcAudio)
+	}
+
+	if is, want := ff.Methods(), []string{"PrepareNewStream"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%v want=%v", is, want)
+	}
+	if is, want := ff.Calls()[0].ID, ffmpeg.StreamID(testSessionID); is != want {
+		t.Fatalf("stream is=%v want=%v", is, want)
+	}
+	if is, want := ff.ActiveStreams(), 1; is != want {
+		t.Fatalf("active streams is=%v want=%v", is, want)
+	}
+	// preparing a stream does not make the camera busy
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusAvailable; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+}
+
+func TestStreamLifecycle(t *testing.T) {
+	m, ff := newTestStreamManagement(t)
+	id := ffmpeg.StreamID(testSessionID)
+	audio := testAudioParameters()
+
+	setupEndpoints(t, m, testSessionID)
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeStart, testVideoParameters(1280, 720), audio)
+	if !ff.Running(id) {
+		t.Fatal("stream not started")
+	}
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusBusy; is != want {
+		t.Fatalf("status after start is=%v want=%v", is, want)
+	}
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeSuspend, testVideoParameters(1280, 720), audio)
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusBusy; is != want {
+		t.Fatalf("status after suspend is=%v want=%v", is, want)
+	}
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeResume, testVideoParameters(1280, 720), audio)
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusBusy; is != want {
+		t.Fatalf("status after resume is=%v want=%v", is, want)
+	}
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeReconfigure, testVideoParameters(640, 360), audio)
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusBusy; is != want {
+		t.Fatalf("status after reconfigure is=%v want=%v", is, want)
+	}
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeEnd, rtp.VideoParameters{}, rtp.AudioParameters{})
+	if ff.Running(id) {
+		t.Fatal("stream not stopped")
+	}
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusAvailable; is != want {
+		t.Fatalf("status after end is=%v want=%v", is, want)
+	}
+
+	want := []string{"PrepareNewStream", "Start", "Suspend", "Resume", "Reconfigure", "Stop"}
+	if is := ff.Methods(); !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%v want=%v", is, want)
+	}
+
+	calls := ff.Calls()
+	for _, c := range calls {
+		if c.ID != id {
+			t.Fatalf("%s: stream is=%v want=%v", c.Method, c.ID, id)
+		}
+	}
+	if is, want := calls[1].Video.Attributes, (rtp.VideoCodecAttributes{Width: 1280, Height: 720, Framerate: 30}); is != want {
+		t.Fatalf("start video is=%+v want=%+v", is, want)
+	}
+	if is, want := calls[1].Audio.CodecType, byte(rtp.AudioCodecType_AAC_ELD); is != want {
+		t.Fatalf("start audio is=%v want=%v", is, want)
+	}
+	if is, want := calls[4].Video.Attributes, (rtp.VideoCodecAttributes{Width: 640, Height: 360, Framerate: 30}); is != want {
+		t.Fatalf("reconfigure video is=%+v want=%+v", is, want)
+	}
+}
+
+func TestEndKeepsBusyWhileOtherStreamsAreActive(t *testing.T) {
+	m, ff := newTestStreamManagement(t)
+	other := append([]byte{}, testSessionID...)
+	other[0] = 0xff
+
+	setupEndpoints(t, m, testSessionID)
+	setupEndpoints(t, m, other)
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeStart, testVideoParameters(1280, 720), testAudioParameters())
+
+	selectStreamConfiguration(t, m, other, rtp.SessionControlCommandTypeEnd, rtp.VideoParameters{}, rtp.AudioParameters{})
+	if is, want := ff.ActiveStreams(), 1; is != want {
+		t.Fatalf("active streams is=%v want=%v", is, want)
+	}
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusBusy; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+
+	selectStreamConfiguration(t, m, testSessionID, rtp.SessionControlCommandTypeEnd, rtp.VideoParameters{}, rtp.AudioParameters{})
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusAvailable; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	m, ff := newTestStreamManagement(t)
+
+	setupEndpoints(t, m, testSessionID)
+	selectStreamConfiguration(t, m, testSessionID, 0xff, rtp.VideoParameters{}, rtp.AudioParameters{})
+
+	if is, want := ff.Methods(), []string{"PrepareNewStream"}; !reflect.DeepEqual(is, want) {
+		t.Fatalf("calls is=%v want=%v", is, want)
+	}
+	if is, want := streamingStatus(t, m), rtp.StreamingStatusAvailable; is != want {
+		t.Fatalf("status is=%v want=%v", is, want)
+	}
+}
@@ -0,0 +1,274 @@
+package hkdoorbell
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// Simulator drives the lines of a fake GPIO chip with text commands, so that
+// the doorbell runs on a machine without its hardware. The commands are
+//
+//	press <line>   presses and releases a button on an input, e.g. the doorbell button
+//	high <line>    sets an input high, e.g. opens the case with a pull-up switch
+//	low <line>     sets an input low
+//	state          shows the level of every line
+//
+// where line is the offset of the line or its name.
+type Simulator struct {
+	chip *rpi.FakeChip
+
+	mutex sync.Mutex
+	names map[int]string
+}
+
+// SimulatedLine is the state of a line of the simulator.
+type SimulatedLine struct {
+	Line  int    `json:"line"`
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// SimulatedState contains the state of every requested line of the simulator.
+type SimulatedState struct {
+	Inputs  []SimulatedLine `json:"inputs"`
+	Outputs []SimulatedLine `json:"outputs"`
+}
+
+// NewSimulator returns a simulator of the lines requested from chip.
+func NewSimulator(chip *rpi.FakeChip) *Simulator {
+	return &Simulator{chip: chip, names: make(map[int]string)}
+}
+
+// Name names the line at offset in the commands and in the state, e.g. "button".
+func (s *Simulator) Name(offset int, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.names[offset] = name
+}
+
+// State returns the level of every requested line.
+func (s *Simulator) State() SimulatedState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var st SimulatedState
+	inputs, outputs := s.chip.Lines()
+	for _, o := range inputs {
+		v, _ := s.chip.Input(o).Read()
+		st.Inputs = append(st.Inputs, SimulatedLine{Line: o, Name: s.names[o], Value: int(v)})
+	}
+	for _, o := range outputs {
+		st.Outputs = append(st.Outputs, SimulatedLine{Line: o, Name: s.names[o], Value: int(s.chip.Output(o).Value())})
+	}
+
+	return st
+}
+
+// Exec executes command and returns its reply.
+func (s *Simulator) Exec(command string) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	if fields[0] == "state" {
+		var b strings.Builder
+		st := s.State()
+		for _, l := range st.Inputs {
+			fmt.Fprintf(&b, "input %d %s: %s\n", l.Line, l.Name, levelName(l.Value))
+		}
+		for _, l := range st.Outputs {
+			fmt.Fprintf(&b, "output %d %s: %s\n", l.Line, l.Name, levelName(l.Value))
+		}
+		return b.String(), nil
+	}
+
+	if len(fields) != 2 {
+		return "", fmt.Errorf("invalid command %q", command)
+	}
+	line, err := s.input(fields[1])
+	if err != nil {
+		return "", err
+	}
+
+	switch fields[0] {
+	case "press":
+		line.Toggle()
+	case "high":
+		line.Set(rpi.HIGH)
+	case "low":
+		line.Set(rpi.LOW)
+	default:
+		return "", fmt.Errorf("invalid command %q", command)
+	}
+
+	return "ok\n", nil
+}
+
+// input returns the input line with the offset or the name.
+func (s *Simulator) input(name string) (*rpi.FakeInput, error) {
+	offset, err := strconv.Atoi(name)
+	if err != nil {
+		offset = -1
+		s.mutex.Lock()
+		for o, n := range s.names {
+			if n == name {
+				offset = o
+			}
+		}
+		s.mutex.Unlock()
+	}
+
+	if l := s.chip.Input(offset); l != nil {
+		return l, nil
+	}
+
+	return nil, fmt.Errorf("no input line %s", name)
+}
+
+func levelName(v int) string {
+	if rpi.Value(v) == rpi.HIGH {
+		return "high"
+	}
+
+	return "low"
+}
+
+// Run executes the commands written on r, one per line, and writes their replies to w
+// until the end of the input or until ctx is done;
+// like StdinTrigger, a pending read of the terminal ends with the next line.
+func (s *Simulator) Run(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		errc <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line := <-lines:
+			reply, err := s.Exec(line)
+			if err != nil {
+				reply = err.Error() + "\n"
+			}
+			io.WriteString(w, reply)
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// RunFIFO executes the commands written to the named pipe at path, e.g.
+// echo press button > /tmp/hkdoorbell.fifo
+// The pipe is created if it does not exist and removed when ctx is done.
+func (s *Simulator) RunFIFO(ctx context.Context, path string) error {
+	if err := syscall.Mkfifo(path, 0600); err != nil && !os.IsExist(err) {
+		return err
+	}
+	defer os.Remove(path)
+
+	// opened for writing as well the pipe neither blocks the open
+	// nor reaches the end when a writer goes away
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer closeWhenDone(ctx, f)()
+
+	err = s.Run(ctx, f, ioutil.Discard)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// ServeHTTP serves the page of the simulator with the live view of the camera.
+// The page posts the commands and polls the state as JSON at ?state.
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost:
+		reply, err := s.Exec(r.FormValue("command"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, reply)
+	case r.URL.Query()["state"] != nil:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.State()); err != nil {
+			log.Info.Println("simulator:", err)
+		}
+	default:
+		io.WriteString(w, simulatorPage)
+	}
+}
+
+const simulatorPage = `<html>
+<head>
+<title>Simulator</title>
+<style>
+body { font-family: sans-serif; text-align: center; }
+td { padding: 8px; }
+table { margin-left: auto; margin-right: auto; }
+.high { color: white; background: green; }
+.low { color: white; background: gray; }
+</style>
+</head>
+<body>
+<img src="/live.mjpeg" alt="camera" width="640" />
+<table id="lines"></table>
+<script type="text/javascript">
+function send(command) {
+  fetch(location.pathname, {method: "POST", body: new URLSearchParams({command: command})});
+}
+function row(kind, l) {
+  var name = l.name || l.line;
+  var level = l.value ? "high" : "low";
+  var buttons = "";
+  if (kind == "input") {
+    ["press", "high", "low"].forEach(function(c) {
+      buttons += "<button onclick=\"send('" + c + " " + l.line + "')\">" + c + "</button> ";
+    });
+  }
+  return "<tr><td>" + kind + " " + l.line + "</td><td>" + name + "</td><td class=" + level + ">" + level + "</td><td>" + buttons + "</td></tr>";
+}
+function update() {
+  fetch(location.pathname + "?state").then(function(r) { return r.json(); }).then(function(st) {
+    var rows = "";
+    (st.inputs || []).forEach(function(l) { rows += row("input", l); });
+    (st.outputs || []).forEach(function(l) { rows += row("output", l); });
+    document.getElementById("lines").innerHTML = rows;
+  });
+}
+update();
+setInterval(update, 250);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,172 @@
+package hkdoorbell
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// testSimulator returns a simulator with a button at line 17, a case switch at line 4
+// and a LED at line 27 which is high.
+func testSimulator(t *testing.T) (*Simulator, rpi.InputLine, rpi.InputLine) {
+	chip := rpi.NewFakeChip()
+	button, err := chip.RequestInput(17, rpi.InputConfig{Edge: rpi.FallingEdge, Bias: rpi.PullUp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamper, err := chip.RequestInput(4, rpi.InputConfig{Edge: rpi.BothEdges, Bias: rpi.PullDown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	led, err := chip.RequestOutput(27, rpi.LOW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	led.Write(rpi.HIGH)
+
+	sim := NewSimulator(chip)
+	sim.Name(17, "button")
+	sim.Name(27, "led")
+
+	return sim, button, tamper
+}
+
+func expectEdge(t *testing.T, line rpi.InputLine, edge rpi.Edge) {
+	t.Helper()
+	select {
+	case e := <-line.Events():
+		if e.Edge != edge {
+			t.Fatalf("edge is=%v want=%v", e.Edge, edge)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no edge %v", edge)
+	}
+}
+
+func TestSimulatorCommands(t *testing.T) {
+	sim, button, tamper := testSimulator(t)
+
+	for _, c := range []string{"press button", "press 17", "high 4"} {
+		if _, err := sim.Exec(c); err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+	}
+	expectEdge(t, button, rpi.FallingEdge)
+	expectEdge(t, button, rpi.FallingEdge)
+	expectEdge(t, tamper, rpi.RisingEdge)
+
+	reply, err := sim.Exec("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "input 4 : high\ninput 17 button: high\noutput 27 led: high\n"
+	if reply != want {
+		t.Fatalf("state is=%q want=%q", reply, want)
+	}
+
+	for _, c := range []string{"press", "press door", "press led", "open 4"} {
+		if _, err := sim.Exec(c); err == nil {
+			t.Fatalf("%s: no error", c)
+		}
+	}
+}
+
+func TestSimulatorRun(t *testing.T) {
+	sim, button, _ := testSimulator(t)
+
+	var out bytes.Buffer
+	if err := sim.Run(context.Background(), strings.NewReader("press button\nring\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	expectEdge(t, button, rpi.FallingEdge)
+	if want := "ok\ninvalid command \"ring\"\n"; out.String() != want {
+		t.Fatalf("replies is=%q want=%q", out.String(), want)
+	}
+}
+
+func TestSimulatorFIFO(t *testing.T) {
+	sim, button, _ := testSimulator(t)
+	dir, err := ioutil.TempDir("", "simulator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hkdoorbell.fifo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sim.RunFIFO(ctx, path)
+	}()
+
+	// two writers one after the other
+	for i := 0; i < 2; i++ {
+		var f *os.File
+		for start := time.Now(); f == nil; {
+			var err error
+			if f, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+				if time.Since(start) > time.Second {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		f.WriteString("press button\n")
+		f.Close()
+		expectEdge(t, button, rpi.FallingEdge)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fifo did not stop")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("fifo not removed: %v", err)
+	}
+}
+
+func TestSimulatorHTTP(t *testing.T) {
+	sim, _, tamper := testSimulator(t)
+	srv := httptest.NewServer(sim)
+	defer srv.Close()
+
+	resp, err := http.PostForm(srv.URL, url.Values{"command": {"high 4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status is=%d", resp.StatusCode)
+	}
+	expectEdge(t, tamper, rpi.RisingEdge)
+
+	resp, err = http.Get(srv.URL + "?state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var st SimulatedState
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Inputs) != 2 || st.Inputs[0] != (SimulatedLine{Line: 4, Value: 1}) ||
+		len(st.Outputs) != 1 || st.Outputs[0] != (SimulatedLine{Line: 27, Name: "led", Value: 1}) {
+		t.Fatalf("state is=%+v", st)
+	}
+}
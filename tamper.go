@@ -0,0 +1,301 @@
+package hkdoorbell
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// reasons of a tamper
+const (
+	tamperCase    = "case opened"
+	tamperCovered = "lens covered"
+	tamperScene   = "scene changed"
+	tamperFrames  = "no frames"
+)
+
+// TamperHistory records the tamper events with a snapshot, e.g. the backend.
+type TamperHistory interface {
+	// InsertEvent records an event of kind with priority;
+	// recording is the file of its recording, empty if there is none
+	InsertEvent(kind string, priority string, detail string, recording string)
+	InsertSnapshot(image *image.Image)
+}
+
+// TamperConfig contains the thresholds of the camera tamper detection.
+// Frames are compared by their luma from 0 (black) to 255 (white); zero values disable a check.
+type TamperConfig struct {
+	// Interval between two frames checked; zero disables the camera tamper detection
+	Interval time.Duration
+	// CoveredBelow is the standard deviation of the luma under which a frame is uniform,
+	// that is the lens is covered or painted over
+	CoveredBelow float64
+	// Samples is the number of consecutive uniform frames which are needed for a covered lens
+	Samples int
+	// SceneChange is the mean difference of two consecutive frames, without the
+	// change of the brightness, over which the scene changed, e.g. the camera was turned
+	SceneChange float64
+	// FrameTimeout is the longest time without frames from the camera
+	FrameTimeout time.Duration
+	// RecordDir contains the recordings of RecordDuration started by a tamper
+	RecordDir      string
+	RecordDuration time.Duration
+}
+
+// Tamper raises the HomeKit tampered status while the case of the doorbell is open
+// or the camera is tampered with. Every tamper is recorded with a snapshot and a recording.
+type Tamper struct {
+	ff      ffmpeg.FFMPEG
+	cfg     TamperConfig
+	status  *characteristic.StatusTampered
+	history TamperHistory
+	now     func() time.Time
+
+	mutex     sync.Mutex
+	active    map[string]bool
+	recording bool
+
+	// state of the camera checks
+	previous  []float64
+	covered   int
+	lastFrame time.Time
+}
+
+// InitTamper returns a tamper detection which reports to status; history may be nil.
+func InitTamper(ff ffmpeg.FFMPEG, cfg TamperConfig, status *characteristic.StatusTampered, history TamperHistory) *Tamper {
+	if cfg.Samples < 1 {
+		cfg.Samples = 1
+	}
+
+	return &Tamper{
+		ff:      ff,
+		cfg:     cfg,
+		status:  status,
+		history: history,
+		now:     time.Now,
+		active:  make(map[string]bool),
+	}
+}
+
+// AddTamperStatus adds the tampered status to the doorbell service.
+func AddTamperStatus(doorbell *Doorbell) *characteristic.StatusTampered {
+	st := characteristic.NewStatusTampered()
+	doorbell.Control.AddCharacteristic(st.Characteristic)
+	doorbell.Tampered = st
+
+	return st
+}
+
+// WatchCase watches the case switch on line until ctx is done or the line is closed;
+// the case is open while the line is at open.
+func (t *Tamper) WatchCase(ctx context.Context, line rpi.InputLine, open rpi.Value) {
+	if v, err := line.Read(); err != nil {
+		log.Info.Println("tamper: case:", err)
+	} else {
+		t.set(tamperCase, v == open)
+	}
+
+	events := line.Events()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			v := rpi.Value(rpi.LOW)
+			if e.Edge == rpi.RisingEdge {
+				v = rpi.HIGH
+			}
+			t.set(tamperCase, v == open)
+		}
+	}
+}
+
+// Run checks the frames of the camera every interval until ctx is done.
+func (t *Tamper) Run(ctx context.Context) {
+	if t.cfg.Interval <= 0 {
+		return
+	}
+
+	t.lastFrame = t.now()
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sample()
+		}
+	}
+}
+
+// sample checks a shared frame of the camera.
+func (t *Tamper) sample() {
+	img, err := t.ff.Snapshot(brightnessWidth, 0)
+	now := t.now()
+	if err != nil || img == nil {
+		log.Debug.Println("tamper: no frame:", err)
+		if t.cfg.FrameTimeout > 0 && now.Sub(t.lastFrame) >= t.cfg.FrameTimeout {
+			t.set(tamperFrames, true)
+		}
+		return
+	}
+	t.lastFrame = now
+	t.set(tamperFrames, false)
+
+	luma := lumas(*img)
+	mean, deviation := meanDeviation(luma)
+
+	if t.cfg.CoveredBelow > 0 {
+		if deviation < t.cfg.CoveredBelow {
+			t.covered++
+		} else {
+			t.covered = 0
+		}
+		t.set(tamperCovered, t.covered >= t.cfg.Samples)
+	}
+
+	// the day/night switching changes the brightness of the whole frame
+	for i := range luma {
+		luma[i] -= mean
+	}
+	if t.cfg.SceneChange > 0 && len(t.previous) == len(luma) {
+		t.set(tamperScene, meanDifference(t.previous, luma) > t.cfg.SceneChange)
+	}
+	t.previous = luma
+}
+
+// set activates or clears a reason of tamper; the first activation raises an alert.
+func (t *Tamper) set(reason string, on bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if on == t.active[reason] {
+		return
+	}
+
+	if on {
+		log.Info.Printf("tamper: %s\n", reason)
+		t.active[reason] = true
+		go t.alert(reason)
+	} else {
+		log.Info.Printf("tamper: %s cleared\n", reason)
+		delete(t.active, reason)
+	}
+
+	if t.status == nil {
+		return
+	}
+	if len(t.active) > 0 {
+		t.status.SetValue(characteristic.StatusTamperedTampered)
+	} else {
+		t.status.SetValue(characteristic.StatusTamperedNotTampered)
+	}
+}
+
+// Tampered returns the active reasons of tamper.
+func (t *Tamper) Tampered() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var reasons []string
+	for r := range t.active {
+		reasons = append(reasons, r)
+	}
+
+	return reasons
+}
+
+// alert records a high priority event with a snapshot and starts a recording
+// unless another one is running.
+func (t *Tamper) alert(reason string) {
+	var file string
+	if t.cfg.RecordDuration > 0 {
+		t.mutex.Lock()
+		if !t.recording {
+			t.recording = true
+			file = filepath.Join(t.cfg.RecordDir, "tamper-"+t.now().Format("20060102-150405")+".mp4")
+		}
+		t.mutex.Unlock()
+	}
+
+	if t.history != nil {
+		var recording string
+		if file != "" {
+			recording = filepath.Base(file)
+		}
+		t.history.InsertEvent("tamper", "high", reason, recording)
+		img, err := t.ff.Snapshot(1280, 960)
+		if img != nil && err == nil {
+			t.history.InsertSnapshot(img)
+		}
+	}
+
+	if file == "" {
+		return
+	}
+	if err := t.ff.Record(file, t.cfg.RecordDuration); err != nil {
+		log.Info.Println("tamper: record:", err)
+	}
+
+	t.mutex.Lock()
+	t.recording = false
+	t.mutex.Unlock()
+}
+
+// lumas returns the luma of every pixel of img.
+func lumas(img image.Image) []float64 {
+	b := img.Bounds()
+	l := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			l = append(l, float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y))
+		}
+	}
+
+	return l
+}
+
+// meanDeviation returns the mean and the standard deviation of v.
+func meanDeviation(v []float64) (float64, float64) {
+	if len(v) == 0 {
+		return 0, 0
+	}
+
+	var sum, squares float64
+	for _, x := range v {
+		sum += x
+		squares += x * x
+	}
+	mean := sum / float64(len(v))
+
+	return mean, math.Sqrt(math.Max(squares/float64(len(v))-mean*mean, 0))
+}
+
+// meanDifference returns the mean absolute difference of a and b which have the same length.
+func meanDifference(a, b []float64) float64 {
+	if len(a) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for i := range a {
+		sum += math.Abs(a[i] - b[i])
+	}
+
+	return sum / float64(len(a))
+}
@@ -0,0 +1,157 @@
+package hkdoorbell
+
+import (
+	"context"
+	"errors"
+	"image"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// testEvents records the events of a Tamper.
+type testEvents struct {
+	events chan []string
+}
+
+func (h *testEvents) InsertEvent(kind string, priority string, detail string, recording string) {
+	h.events <- []string{kind, priority, detail, recording}
+}
+
+func (h *testEvents) InsertSnapshot(image *image.Image) {
+}
+
+// stripedImage returns a frame with vertical stripes starting with a white one if white;
+// the stripes are brighter by offset.
+func stripedImage(white bool, offset uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 8, 6))
+	for i := range img.Pix {
+		img.Pix[i] = offset
+		if (i%2 == 0) == white {
+			img.Pix[i] += 200
+		}
+	}
+
+	return img
+}
+
+func TestTamperCase(t *testing.T) {
+	status := characteristic.NewStatusTampered()
+	values := make(chan interface{}, 10)
+	status.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+		values <- new
+	})
+	history := &testEvents{events: make(chan []string, 10)}
+	ff := ffmpeg.NewFake()
+
+	tamper := InitTamper(ff, TamperConfig{RecordDir: "/data/recordings", RecordDuration: time.Second}, status, history)
+	tamper.now = func() time.Time { return time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC) }
+
+	chip := rpi.NewFakeChip()
+	line, err := chip.RequestInput(4, rpi.InputConfig{Edge: rpi.BothEdges, Bias: rpi.PullDown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		tamper.WatchCase(context.Background(), line, rpi.HIGH)
+		close(done)
+	}()
+
+	expect := func(want int) {
+		t.Helper()
+		select {
+		case v := <-values:
+			if v != want {
+				t.Fatalf("status is=%v want=%v", v, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("status not set to %v", want)
+		}
+	}
+
+	chip.Input(4).Set(rpi.HIGH)
+	expect(characteristic.StatusTamperedTampered)
+	select {
+	case e := <-history.events:
+		if want := []string{"tamper", "high", tamperCase, "tamper-20200501-123000.mp4"}; !reflect.DeepEqual(e, want) {
+			t.Fatalf("event is=%v want=%v", e, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	chip.Input(4).Set(rpi.LOW)
+	expect(characteristic.StatusTamperedNotTampered)
+
+	line.Close()
+	<-done
+
+	var recorded bool
+	for _, c := range ff.Calls() {
+		if c.Method == "Record" && c.File == "/data/recordings/tamper-20200501-123000.mp4" && c.Duration == time.Second {
+			recorded = true
+		}
+	}
+	if !recorded {
+		t.Fatalf("no recording in %v", ff.Methods())
+	}
+}
+
+func TestTamperCamera(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	now := time.Now()
+	tamper := InitTamper(ff, TamperConfig{
+		CoveredBelow: 4,
+		Samples:      2,
+		SceneChange:  60,
+		FrameTimeout: time.Minute,
+	}, nil, nil)
+	tamper.now = func() time.Time { return now }
+	tamper.lastFrame = now
+
+	sample := func(img image.Image, want ...string) {
+		t.Helper()
+		ff.Image = img
+		tamper.sample()
+		is := tamper.Tampered()
+		sort.Strings(is)
+		if len(is) != len(want) || len(want) > 0 && !reflect.DeepEqual(is, want) {
+			t.Fatalf("tampered is=%v want=%v", is, want)
+		}
+	}
+
+	sample(stripedImage(true, 0))
+	// the same scene lit by the IR LEDs
+	sample(stripedImage(true, 50))
+
+	// covering the lens changes the scene too
+	sample(uniformImage(30), tamperScene)
+	sample(uniformImage(30), tamperCovered)
+	sample(stripedImage(true, 0), tamperScene)
+	sample(stripedImage(true, 0))
+
+	// the camera was turned
+	sample(stripedImage(false, 0), tamperScene)
+	sample(stripedImage(false, 0))
+
+	ff.SnapshotErr = errors.New("camera is gone")
+	sample(nil)
+	now = now.Add(time.Minute)
+	sample(nil, tamperFrames)
+	ff.SnapshotErr = nil
+	sample(stripedImage(false, 0))
+}
+
+func TestMeanDeviation(t *testing.T) {
+	mean, deviation := meanDeviation([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	if mean != 5 || deviation != 2 {
+		t.Fatalf("mean is=%v deviation is=%v", mean, deviation)
+	}
+}
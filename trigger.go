@@ -0,0 +1,323 @@
+package hkdoorbell
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/log"
+
+	"github.com/ra1nb0w/hkdoorbell/mqtt"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// Trigger is a source of rings, e.g. the doorbell button.
+type Trigger interface {
+	// Name identifies the source in the logs and in the history.
+	Name() string
+	// Run calls ring for every ring until ctx is done.
+	Run(ctx context.Context, ring func()) error
+}
+
+// Ringer receives the rings of the triggers, e.g. a RingHandler.
+type Ringer interface {
+	Ring(source string)
+}
+
+// StartTriggers runs every trigger in the background until ctx is done and passes its rings to r.
+// The returned channel is closed when every trigger has returned.
+func StartTriggers(ctx context.Context, r Ringer, triggers ...Trigger) <-chan struct{} {
+	var wg sync.WaitGroup
+	for _, t := range triggers {
+		wg.Add(1)
+		go func(t Trigger) {
+			defer wg.Done()
+			if err := t.Run(ctx, func() { r.Ring(t.Name()) }); err != nil {
+				log.Info.Printf("trigger %s: %v\n", t.Name(), err)
+			}
+		}(t)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// closeWhenDone closes c when ctx is done or when the returned function is called.
+func closeWhenDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		c.Close()
+	}()
+
+	return func() { close(stop) }
+}
+
+// GPIOTrigger rings on the falling edges of a GPIO line;
+// the button pulls the line low and the kernel debounces it.
+// The line is closed when Run returns.
+type GPIOTrigger struct {
+	line rpi.InputLine
+}
+
+func NewGPIOTrigger(line rpi.InputLine) *GPIOTrigger {
+	return &GPIOTrigger{line: line}
+}
+
+func (t *GPIOTrigger) Name() string {
+	return "gpio"
+}
+
+func (t *GPIOTrigger) Run(ctx context.Context, ring func()) error {
+	defer t.line.Close()
+
+	events := t.line.Events()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if e.Edge == rpi.FallingEdge {
+				ring()
+			}
+		}
+	}
+}
+
+// StdinTrigger rings for every line written on the terminal;
+// it simulates the button on macOS.
+type StdinTrigger struct {
+	scanner *bufio.Scanner
+}
+
+func NewStdinTrigger(scanner *bufio.Scanner) *StdinTrigger {
+	return &StdinTrigger{scanner: scanner}
+}
+
+func (t *StdinTrigger) Name() string {
+	return "stdin"
+}
+
+// Run returns at the end of the input or when ctx is done;
+// a pending read of the terminal cannot be interrupted and ends with the next line.
+func (t *StdinTrigger) Run(ctx context.Context, ring func()) error {
+	lines := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		for t.scanner.Scan() {
+			select {
+			case lines <- t.scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		errc <- t.scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case line := <-lines:
+			if len(line) != 0 {
+				ring()
+			}
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+// HTTPTrigger rings on the POST requests it serves, e.g. at /ring of the backend.
+type HTTPTrigger struct {
+	mutex sync.Mutex
+	ring  func()
+}
+
+func NewHTTPTrigger() *HTTPTrigger {
+	return &HTTPTrigger{}
+}
+
+func (t *HTTPTrigger) Name() string {
+	return "http"
+}
+
+func (t *HTTPTrigger) Run(ctx context.Context, ring func()) error {
+	t.mutex.Lock()
+	t.ring = ring
+	t.mutex.Unlock()
+
+	<-ctx.Done()
+
+	t.mutex.Lock()
+	t.ring = nil
+	t.mutex.Unlock()
+
+	return nil
+}
+
+func (t *HTTPTrigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t.mutex.Lock()
+	ring := t.ring
+	t.mutex.Unlock()
+
+	if ring == nil {
+		http.Error(w, "trigger is not running", http.StatusServiceUnavailable)
+		return
+	}
+	ring()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SocketTrigger rings for every line written to a UNIX socket,
+// e.g. echo ring | nc -U /run/hkdoorbell.sock
+// The socket is removed when Run returns.
+type SocketTrigger struct {
+	path string
+}
+
+func NewSocketTrigger(path string) *SocketTrigger {
+	return &SocketTrigger{path: path}
+}
+
+func (t *SocketTrigger) Name() string {
+	return "socket"
+}
+
+func (t *SocketTrigger) Run(ctx context.Context, ring func()) error {
+	// a socket left by a previous run prevents listening
+	if fi, err := os.Lstat(t.path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(t.path)
+	}
+
+	l, err := net.Listen("unix", t.path)
+	if err != nil {
+		return err
+	}
+	defer closeWhenDone(ctx, l)()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			defer closeWhenDone(ctx, conn)()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				if strings.TrimSpace(scanner.Text()) != "" {
+					ring()
+				}
+			}
+		}()
+	}
+}
+
+// MQTTConfig describes the topic of an MQTT broker on which rings are published,
+// e.g. by a wireless button.
+type MQTTConfig struct {
+	// Broker is the address "host:port" of the broker
+	Broker string
+	Topic  string
+	// Payload rings only on messages with this payload; empty rings on every message
+	Payload  string
+	ClientID string
+	Username string
+	Password string
+}
+
+const (
+	// the connection to the broker is retried after mqttRetry,
+	// doubled after every failure up to mqttMaxRetry
+	mqttRetry    = time.Second
+	mqttMaxRetry = time.Minute
+)
+
+// MQTTTrigger rings on the messages published on a topic.
+// It reconnects to the broker until ctx is done.
+type MQTTTrigger struct {
+	cfg MQTTConfig
+}
+
+func NewMQTTTrigger(cfg MQTTConfig) *MQTTTrigger {
+	return &MQTTTrigger{cfg: cfg}
+}
+
+func (t *MQTTTrigger) Name() string {
+	return "mqtt"
+}
+
+func (t *MQTTTrigger) Run(ctx context.Context, ring func()) error {
+	retry := mqttRetry
+	for {
+		subscribed, err := t.subscribe(ctx, ring)
+		if subscribed {
+			retry = mqttRetry
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		log.Info.Printf("mqtt %s: %v; reconnect in %s\n", t.cfg.Broker, err, retry)
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return nil
+		}
+		if retry *= 2; retry > mqttMaxRetry {
+			retry = mqttMaxRetry
+		}
+	}
+}
+
+// subscribe receives the messages of the topic until the connection is lost or ctx is done.
+func (t *MQTTTrigger) subscribe(ctx context.Context, ring func()) (bool, error) {
+	c, err := mqtt.Dial(t.cfg.Broker, mqtt.Options{
+		ClientID: t.cfg.ClientID,
+		Username: t.cfg.Username,
+		Password: t.cfg.Password,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer closeWhenDone(ctx, c)()
+
+	if err := c.Subscribe(t.cfg.Topic); err != nil {
+		return false, err
+	}
+	log.Debug.Printf("mqtt %s: subscribed to %s\n", t.cfg.Broker, t.cfg.Topic)
+
+	for m := range c.Messages() {
+		if t.cfg.Payload == "" || string(m.Payload) == t.cfg.Payload {
+			ring()
+		}
+	}
+
+	return true, c.Err()
+}
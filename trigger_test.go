@@ -0,0 +1,295 @@
+package hkdoorbell
+
+import (
+	"bufio"
+	"context"
+	"image"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+
+	"github.com/ra1nb0w/hkdoorbell/ffmpeg"
+	"github.com/ra1nb0w/hkdoorbell/rpi"
+)
+
+// testRinger records the sources of the rings.
+type testRinger chan string
+
+func (r testRinger) Ring(source string) {
+	r <- source
+}
+
+func (r testRinger) expect(t *testing.T, source string) {
+	t.Helper()
+	select {
+	case is := <-r:
+		if is != source {
+			t.Fatalf("ring from %s want=%s", is, source)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no ring from %s", source)
+	}
+}
+
+// run starts trigger and returns the cancel of its context
+// and a channel which is closed when it returns.
+func run(r testRinger, trigger Trigger) (context.CancelFunc, chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		trigger.Run(ctx, func() { r.Ring(trigger.Name()) })
+		close(done)
+	}()
+
+	return cancel, done
+}
+
+func expectStopped(t *testing.T, trigger Trigger, cancel context.CancelFunc, done chan struct{}) {
+	t.Helper()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s trigger did not stop", trigger.Name())
+	}
+}
+
+func TestGPIOTrigger(t *testing.T) {
+	chip := rpi.NewFakeChip()
+	line, err := chip.RequestInput(17, rpi.InputConfig{Edge: rpi.FallingEdge, Bias: rpi.PullUp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chip.RequestInput(17, rpi.InputConfig{}); err == nil {
+		t.Fatal("line requested twice")
+	}
+
+	r := make(testRinger, 2)
+	trigger := NewGPIOTrigger(line)
+	cancel, done := run(r, trigger)
+
+	chip.Input(17).Press()
+	chip.Input(17).Press()
+	r.expect(t, "gpio")
+	r.expect(t, "gpio")
+
+	expectStopped(t, trigger, cancel, done)
+}
+
+func TestStdinTrigger(t *testing.T) {
+	r := make(testRinger, 2)
+	trigger := NewStdinTrigger(bufio.NewScanner(strings.NewReader("\nring\n")))
+	_, done := run(r, trigger)
+
+	r.expect(t, "stdin")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stdin trigger did not return at the end of the input")
+	}
+}
+
+func TestHTTPTrigger(t *testing.T) {
+	trigger := NewHTTPTrigger()
+	srv := httptest.NewServer(trigger)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status before run is=%d", resp.StatusCode)
+	}
+
+	r := make(testRinger, 1)
+	cancel, done := run(r, trigger)
+	for {
+		// Run may not have started yet
+		resp, err = http.Post(srv.URL, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status is=%d want=%d", resp.StatusCode, http.StatusNoContent)
+	}
+	r.expect(t, "http")
+
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status of GET is=%d", resp.StatusCode)
+	}
+
+	expectStopped(t, trigger, cancel, done)
+}
+
+func TestSocketTrigger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trigger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ring.sock")
+
+	r := make(testRinger, 2)
+	trigger := NewSocketTrigger(path)
+	cancel, done := run(r, trigger)
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	io.WriteString(conn, "ring\n\nring\n")
+	conn.Close()
+	r.expect(t, "socket")
+	r.expect(t, "socket")
+
+	expectStopped(t, trigger, cancel, done)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed: %v", err)
+	}
+}
+
+// testBroker accepts a single MQTT client, acknowledges its subscription
+// and publishes the payloads on topic.
+func testBroker(t *testing.T, topic string, payloads ...string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		packet := func() (byte, []byte) {
+			header, _ := r.ReadByte()
+			// the packets of the test are shorter than 128 bytes
+			length, _ := r.ReadByte()
+			body := make([]byte, length)
+			io.ReadFull(r, body)
+			return header, body
+		}
+
+		packet()
+		conn.Write([]byte{0x20, 2, 0, 0})
+		_, sub := packet()
+		conn.Write([]byte{0x90, 3, sub[0], sub[1], 0})
+		for _, p := range payloads {
+			msg := append([]byte{0x30, byte(2 + len(topic) + len(p)), 0, byte(len(topic))}, topic...)
+			conn.Write(append(msg, p...))
+		}
+		// wait for the disconnect
+		for {
+			if _, err := r.ReadByte(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestMQTTTrigger(t *testing.T) {
+	addr := testBroker(t, "doorbell/ring", "long", "press")
+
+	r := make(testRinger, 2)
+	trigger := NewMQTTTrigger(MQTTConfig{Broker: addr, Topic: "doorbell/ring", Payload: "press", ClientID: "test"})
+	cancel, done := run(r, trigger)
+
+	// only the second message has the payload
+	r.expect(t, "mqtt")
+	select {
+	case source := <-r:
+		t.Fatalf("unexpected ring from %s", source)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	expectStopped(t, trigger, cancel, done)
+}
+
+// testHistory records the rings and snapshots.
+type testHistory struct {
+	mutex     sync.Mutex
+	rings     []string
+	snapshots int
+	recorded  chan struct{}
+}
+
+func (h *testHistory) InsertRing(source string, suppressed string, prank bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.rings = append(h.rings, source)
+}
+
+func (h *testHistory) InsertSnapshot(image *image.Image) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.snapshots++
+	h.recorded <- struct{}{}
+}
+
+func TestRingHandler(t *testing.T) {
+	ff := ffmpeg.NewFake()
+	ff.Image = image.NewGray(image.Rect(0, 0, 4, 3))
+	event := characteristic.NewProgrammableSwitchEvent()
+	events := make(chan interface{}, 1)
+	event.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+		events <- new
+	})
+	history := &testHistory{recorded: make(chan struct{}, 1)}
+
+	h := InitRingHandler(ff, event, nil, history, RingLimits{})
+	StartTriggers(context.Background(), h, NewStdinTrigger(bufio.NewScanner(strings.NewReader("ring\n"))))
+
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("no HomeKit event")
+	}
+	select {
+	case <-history.recorded:
+	case <-time.After(time.Second):
+		t.Fatal("no snapshot")
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if len(history.rings) != 1 || history.rings[0] != "stdin" || history.snapshots != 1 {
+		t.Fatalf("history is=%v with %d snapshots", history.rings, history.snapshots)
+	}
+}